@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+const (
+	userSearchLimit    = 10
+	referrerChainDepth = 5
+)
+
+// balanceSteps are the quick adjustments offered on the user detail card.
+var balanceSteps = []float64{10, 50, 100}
+
+// userSearch handles /user <query>, matching by ID, username or name prefix.
+func (a *App) userSearch(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	if !can(user.Id, PermViewUsers) {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	args := ctx.Args()[1:]
+	if len(args) == 0 {
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/user &lt;id|username|name&gt;</code>", &gotgbot.SendMessageOpts{
+			ParseMode: "HTML",
+		})
+		return nil
+	}
+
+	users, err := a.store.SearchUsers(requestContext(ctx), strings.Join(args, " "), userSearchLimit)
+	if err != nil {
+		log.Printf("Failed to search users: %v", err)
+		_, _ = msg.Reply(b, "❌ An error occurred. Please try again later.", nil)
+		return nil
+	}
+
+	switch len(users) {
+	case 0:
+		_, _ = msg.Reply(b, "❌ <b>No users found.</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	case 1:
+		_, _ = msg.Reply(b, a.userCard(requestContext(ctx), &users[0]), &gotgbot.SendMessageOpts{
+			ParseMode:   "HTML",
+			ReplyMarkup: userCardMarkup(user.Id, &users[0]),
+			LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
+				IsDisabled: true,
+			},
+		})
+	default:
+		var buttons [][]gotgbot.InlineKeyboardButton
+		for _, u := range users {
+			label := u.FirstName
+			if u.Username != "" {
+				label += " @" + u.Username
+			}
+			buttons = append(buttons, []gotgbot.InlineKeyboardButton{{
+				Text:         fmt.Sprintf("%s (%d)", strings.TrimSpace(label), u.ID),
+				CallbackData: fmt.Sprintf("uadm.view.%d", u.ID),
+			}})
+		}
+
+		_, _ = msg.Reply(b, fmt.Sprintf("🔎 <b>%d users found.</b> Pick one:", len(users)), &gotgbot.SendMessageOpts{
+			ParseMode:   "HTML",
+			ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: buttons},
+		})
+	}
+
+	return nil
+}
+
+// userCard renders the admin detail view of a user.
+func (a *App) userCard(c context.Context, u *User) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("👤 <b>User</b> %s\n🔹 <b>ID:</b> <code>%d</code>\n", mention(u), u.ID))
+
+	status := "✅ Active"
+	if u.Inactive {
+		status = fmt.Sprintf("💤 Inactive (%s since %s)", u.InactiveReason, u.InactiveSince.Format("2006-01-02"))
+	}
+	if u.Banned {
+		status = "🚫 Banned"
+	}
+	sb.WriteString(fmt.Sprintf("📌 <b>Status:</b> %s\n", status))
+	if !u.JoinedAt.IsZero() {
+		sb.WriteString(fmt.Sprintf("📅 <b>Joined:</b> %s\n", u.JoinedAt.Format("2006-01-02")))
+	}
+	if !u.LastSeen.IsZero() {
+		sb.WriteString(fmt.Sprintf("👀 <b>Last Seen:</b> %s\n", u.LastSeen.Format("2006-01-02 15:04 MST")))
+	}
+	sb.WriteString(fmt.Sprintf("💰 <b>Balance:</b> %.2f\n🏦 <b>Account Number:</b> %d\n", u.Balance, u.AccNo))
+
+	if summary, err := a.store.GetLedgerSummary(c, u.ID); err == nil {
+		sb.WriteString(fmt.Sprintf("📒 <b>Ledger:</b> %d entries, +%.2f / %.2f\n", summary.Entries, summary.Credits, summary.Debits))
+	}
+
+	sb.WriteString("\n🔗 <b>Referrer Chain:</b> ")
+	if u.Referrer == 0 {
+		sb.WriteString("—\n")
+	} else {
+		seen := map[int64]bool{u.ID: true}
+		var chain []string
+		for id := u.Referrer; id != 0 && !seen[id] && len(chain) < referrerChainDepth; {
+			seen[id] = true
+			r, err := a.store.GetUser(c, id)
+			if err != nil {
+				chain = append(chain, fmt.Sprint(id))
+				break
+			}
+			chain = append(chain, string(mention(r)))
+			id = r.Referrer
+		}
+		sb.WriteString(strings.Join(chain, " ← ") + "\n")
+	}
+
+	sb.WriteString(fmt.Sprintf("🤝 <b>Referrals:</b> %d\n", u.ReferralCount))
+	if referred, _, err := a.store.GetReferredUsers(c, u.ID, 0, false, 5); err == nil {
+		for _, r := range referred {
+			sb.WriteString("    • " + string(mention(&r)) + "\n")
+		}
+	}
+
+	withdrawals, total, err := a.store.GetWithdrawals(c, u.ID, 5)
+	if err == nil {
+		sb.WriteString(fmt.Sprintf("\n💸 <b>Withdrawals:</b> %d\n", total))
+		for _, w := range withdrawals {
+			sb.WriteString(fmt.Sprintf("    • %.2f — %s (%s)\n", w.Amount, w.Status, w.RequestedAt.Format("2006-01-02")))
+		}
+	}
+
+	return sb.String()
+}
+
+// userCardMarkup builds the action buttons the viewer's role allows.
+func userCardMarkup(viewerID int64, u *User) gotgbot.InlineKeyboardMarkup {
+	var row []gotgbot.InlineKeyboardButton
+	if can(viewerID, PermAdjustBalance) {
+		row = append(row, gotgbot.InlineKeyboardButton{
+			Text:         "💰 Adjust Balance",
+			CallbackData: fmt.Sprintf("uadm.bal.%d", u.ID),
+		})
+	}
+
+	if can(viewerID, PermBanUsers) && roleOf(u.ID) == RoleUser {
+		if u.Banned {
+			row = append(row, gotgbot.InlineKeyboardButton{
+				Text:         "✅ Unban",
+				CallbackData: fmt.Sprintf("uadm.unban.%d", u.ID),
+			})
+		} else {
+			row = append(row, gotgbot.InlineKeyboardButton{
+				Text:         "🚫 Ban",
+				CallbackData: fmt.Sprintf("uadm.ban.%d", u.ID),
+			})
+		}
+	}
+
+	if can(viewerID, PermViewLedger) {
+		row = append(row, gotgbot.InlineKeyboardButton{
+			Text:         "📒 Ledger",
+			CallbackData: fmt.Sprintf("uadm.ledger.%d", u.ID),
+		})
+	}
+
+	markup := gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{}}
+	if len(row) > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+	}
+	return markup
+}
+
+func backToUserMarkup(userID int64) gotgbot.InlineKeyboardMarkup {
+	return gotgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
+			{
+				{
+					Text:         "🔙 Back",
+					CallbackData: fmt.Sprintf("uadm.view.%d", userID),
+				},
+			},
+		},
+	}
+}
+
+// userAdminCallback handles the buttons of the user detail card.
+// Callback data is "uadm.<action>.<user_id>[.<arg>]".
+func (a *App) userAdminCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	query := ctx.CallbackQuery
+	viewer := ctx.EffectiveUser
+
+	splitData := strings.SplitN(query.Data, ".", 4)
+	if len(splitData) < 3 {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ Invalid callback data.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	action := splitData[1]
+	userID := stringToInt64(splitData[2])
+
+	required := map[string]Permission{
+		"view":   PermViewUsers,
+		"bal":    PermAdjustBalance,
+		"adj":    PermAdjustBalance,
+		"ban":    PermBanUsers,
+		"unban":  PermBanUsers,
+		"ledger": PermViewLedger,
+	}
+
+	perm, ok := required[action]
+	if !ok {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ Invalid callback data.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	if !can(viewer.Id, perm) {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ You are not authorized to do this.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	switch action {
+	case "bal":
+		var rows [][]gotgbot.InlineKeyboardButton
+		for _, step := range balanceSteps {
+			rows = append(rows, []gotgbot.InlineKeyboardButton{
+				{Text: fmt.Sprintf("➕ %.0f", step), CallbackData: fmt.Sprintf("uadm.adj.%d.%g", userID, step)},
+				{Text: fmt.Sprintf("➖ %.0f", step), CallbackData: fmt.Sprintf("uadm.adj.%d.%g", userID, -step)},
+			})
+		}
+		markup := backToUserMarkup(userID)
+		markup.InlineKeyboard = append(rows, markup.InlineKeyboard...)
+
+		_, _ = query.Answer(b, nil)
+		_, _, _ = msg.EditReplyMarkup(b, &gotgbot.EditMessageReplyMarkupOpts{ReplyMarkup: markup})
+		return nil
+
+	case "adj":
+		if len(splitData) < 4 {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid amount.", ShowAlert: true})
+			return nil
+		}
+
+		amount, err := strconv.ParseFloat(splitData[3], 64)
+		if err != nil || amount == 0 {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid amount.", ShowAlert: true})
+			return nil
+		}
+
+		err = a.store.ApplyLedgerEntry(requestContext(ctx), LedgerEntry{UserID: userID, Amount: amount, Kind: LedgerAdjustment, Actor: viewer.Id})
+		if errors.Is(err, ErrNotFound) {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ User not found.", ShowAlert: true})
+			return nil
+		}
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + err.Error(), ShowAlert: true})
+			return nil
+		}
+
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: fmt.Sprintf("✅ Balance adjusted by %+.2f", amount)})
+
+	case "ban", "unban":
+		if roleOf(userID) != RoleUser {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Admins cannot be banned.", ShowAlert: true})
+			return nil
+		}
+
+		if err := a.store.SetUserBanned(requestContext(ctx), userID, action == "ban"); err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + err.Error(), ShowAlert: true})
+			return nil
+		}
+
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "✅ Status updated."})
+
+	case "ledger":
+		entries, err := a.store.GetLedgerEntries(requestContext(ctx), userID, 20)
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + err.Error(), ShowAlert: true})
+			return nil
+		}
+
+		text := fmt.Sprintf("📒 <b>Ledger of</b> <code>%d</code>\n\n", userID)
+		if len(entries) == 0 {
+			text += "No entries yet."
+		}
+		for _, e := range entries {
+			text += fmt.Sprintf("%s  <b>%+.2f</b>  %s\n", e.CreatedAt.Format("2006-01-02 15:04"), e.Amount, e.Kind)
+		}
+
+		_, _ = query.Answer(b, nil)
+		_, _, _ = msg.EditText(b, text, &gotgbot.EditMessageTextOpts{
+			ParseMode:   "HTML",
+			ReplyMarkup: backToUserMarkup(userID),
+		})
+		return nil
+
+	default:
+		_, _ = query.Answer(b, nil)
+	}
+
+	target, err := a.store.GetUser(requestContext(ctx), userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", userID, err)
+	}
+	if err != nil {
+		_, _, _ = msg.EditText(b, "❌ <b>User not found.</b>", &gotgbot.EditMessageTextOpts{
+			ParseMode: "HTML",
+		})
+		return nil
+	}
+
+	_, _, _ = msg.EditText(b, a.userCard(requestContext(ctx), target), &gotgbot.EditMessageTextOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: userCardMarkup(viewer.Id, target),
+		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
+			IsDisabled: true,
+		},
+	})
+	return nil
+}
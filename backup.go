@@ -0,0 +1,651 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A backup archive is gzip compressed JSON lines: a backupHeader, one
+// backupLine per record, and a closing backupLine with the record counts so a
+// truncated archive is rejected. It is the same for every store, so it also
+// moves data between them.
+const (
+	backupFormat  = "earnify-backup"
+	backupVersion = 1
+)
+
+// maxRestoreDownload is the largest file bots may download from Telegram.
+// Larger archives are restored with the restore subcommand.
+const maxRestoreDownload = 20 << 20
+
+// backupCollection is one collection of a backup archive.
+type backupCollection struct {
+	Name string
+	// New returns an empty record of the collection to decode into.
+	New func() any
+}
+
+// backupCollections lists what a backup holds, in the order it is written
+// and restored, so that records only refer to earlier collections. Users may
+// refer to each other. Conversations are left out as they expire within
+// minutes anyway.
+var backupCollections = []backupCollection{
+	{Name: "users", New: func() any { return new(User) }},
+	{Name: "referrals", New: func() any { return new(Referral) }},
+	{Name: "balance_batches", New: func() any { return new(BalanceBatch) }},
+	{Name: "ledger", New: func() any { return new(LedgerEntry) }},
+	{Name: "withdrawals", New: func() any { return new(Withdrawal) }},
+	{Name: "broadcasts", New: func() any { return new(Broadcast) }},
+	{Name: "broadcast_failures", New: func() any { return new(BroadcastFailure) }},
+	{Name: "broadcast_deliveries", New: func() any { return new(BroadcastDelivery) }},
+	{Name: "schedules", New: func() any { return new(Schedule) }},
+	{Name: "message_templates", New: func() any { return new(MessageTemplate) }},
+}
+
+// backupCollectionIndex returns the position of a collection in
+// backupCollections, or -1 for an unknown one.
+func backupCollectionIndex(name string) int {
+	for i, c := range backupCollections {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type backupLine struct {
+	Collection string          `json:"collection,omitempty"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	// Counts is only set on the last line.
+	Counts map[string]int64 `json:"counts,omitempty"`
+}
+
+// writeBackup writes an archive of every collection in store to w and
+// returns the number of records of each.
+func writeBackup(ctx context.Context, store Store, w io.Writer) (map[string]int64, error) {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	if err := enc.Encode(backupHeader{Format: backupFormat, Version: backupVersion, CreatedAt: time.Now().UTC()}); err != nil {
+		return nil, fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	counts := make(map[string]int64, len(backupCollections))
+	for _, c := range backupCollections {
+		counts[c.Name] = 0
+		err := store.ExportRecords(ctx, c.Name, func(record any) error {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			counts[c.Name]++
+			return enc.Encode(backupLine{Collection: c.Name, Record: data})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", c.Name, err)
+		}
+	}
+
+	if err := enc.Encode(backupLine{Counts: counts}); err != nil {
+		return nil, fmt.Errorf("failed to write backup: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write backup: %v", err)
+	}
+	return counts, nil
+}
+
+// backupReader reads the records of an archive one at a time.
+type backupReader struct {
+	gz     *gzip.Reader
+	dec    *json.Decoder
+	Header backupHeader
+	// Counts holds the records read so far of each collection.
+	Counts map[string]int64
+	// index is the position in backupCollections of the last record.
+	index int
+	done  bool
+}
+
+func newBackupReader(r io.Reader) (*backupReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %v", err)
+	}
+
+	br := &backupReader{gz: gz, dec: json.NewDecoder(gz), Counts: map[string]int64{}}
+	if err := br.dec.Decode(&br.Header); err != nil {
+		return nil, fmt.Errorf("not a backup archive: %v", err)
+	}
+	if br.Header.Format != backupFormat {
+		return nil, fmt.Errorf("not a backup archive")
+	}
+	if br.Header.Version < 1 || br.Header.Version > backupVersion {
+		return nil, fmt.Errorf("backup version %d is not supported, expected at most %d", br.Header.Version, backupVersion)
+	}
+	return br, nil
+}
+
+// Next returns the next record, or io.EOF once the archive has been read to
+// its end and found complete.
+func (br *backupReader) Next() (string, any, error) {
+	if br.done {
+		return "", nil, io.EOF
+	}
+
+	var line backupLine
+	if err := br.dec.Decode(&line); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", nil, fmt.Errorf("backup is truncated")
+		}
+		return "", nil, fmt.Errorf("invalid backup line: %v", err)
+	}
+
+	if line.Counts != nil {
+		if br.dec.More() {
+			return "", nil, fmt.Errorf("backup has data after its end")
+		}
+		for _, c := range backupCollections {
+			if line.Counts[c.Name] != br.Counts[c.Name] {
+				return "", nil, fmt.Errorf("backup should have %d %s, found %d", line.Counts[c.Name], c.Name, br.Counts[c.Name])
+			}
+		}
+		br.done = true
+		return "", nil, io.EOF
+	}
+
+	index := backupCollectionIndex(line.Collection)
+	if index < 0 {
+		return "", nil, fmt.Errorf("unknown collection %q", line.Collection)
+	}
+	if index < br.index {
+		return "", nil, fmt.Errorf("%s found after %s", line.Collection, backupCollections[br.index].Name)
+	}
+	br.index = index
+
+	record := backupCollections[index].New()
+	if err := json.Unmarshal(line.Record, record); err != nil {
+		return "", nil, fmt.Errorf("invalid record in %s: %v", line.Collection, err)
+	}
+	br.Counts[line.Collection]++
+	return line.Collection, record, nil
+}
+
+// backupValidator checks that the records of an archive make sense on their
+// own and refer to records that exist.
+type backupValidator struct {
+	users      map[int64]bool
+	batches    map[primitive.ObjectID]bool
+	broadcasts map[primitive.ObjectID]bool
+	// referrers are the referrers of users not seen yet when they were read.
+	referrers map[int64]int64
+}
+
+func newBackupValidator() *backupValidator {
+	return &backupValidator{
+		users:      map[int64]bool{},
+		batches:    map[primitive.ObjectID]bool{},
+		broadcasts: map[primitive.ObjectID]bool{},
+		referrers:  map[int64]int64{},
+	}
+}
+
+func (v *backupValidator) check(collection string, record any) error {
+	if collection != "users" {
+		// Users refer to each other, so they are only known after the last one.
+		for userID, referrer := range v.referrers {
+			if !v.users[referrer] {
+				return fmt.Errorf("user %d was referred by unknown user %d", userID, referrer)
+			}
+		}
+		clear(v.referrers)
+	}
+
+	switch r := record.(type) {
+	case *User:
+		if r.ID == 0 {
+			return fmt.Errorf("user without an ID")
+		}
+		if v.users[r.ID] {
+			return fmt.Errorf("user %d appears twice", r.ID)
+		}
+		v.users[r.ID] = true
+		if r.Referrer != 0 && !v.users[r.Referrer] {
+			v.referrers[r.ID] = r.Referrer
+		}
+	case *Referral:
+		if !v.users[r.Referee] || !v.users[r.Referrer] {
+			return fmt.Errorf("referral of user %d by %d refers to an unknown user", r.Referee, r.Referrer)
+		}
+	case *BalanceBatch:
+		if r.ID.IsZero() {
+			return fmt.Errorf("balance batch without an ID")
+		}
+		if !contains([]string{BatchPending, BatchApplying, BatchApplied, BatchCancelled, BatchReverting, BatchReverted}, r.Status) {
+			return fmt.Errorf("balance batch %s has unknown status %q", r.ID.Hex(), r.Status)
+		}
+		v.batches[r.ID] = true
+	case *LedgerEntry:
+		if r.ID.IsZero() || r.Kind == "" {
+			return fmt.Errorf("ledger entry of user %d has no ID or kind", r.UserID)
+		}
+		if !v.users[r.UserID] {
+			return fmt.Errorf("ledger entry %s belongs to unknown user %d", r.ID.Hex(), r.UserID)
+		}
+		if !r.Batch.IsZero() && !v.batches[r.Batch] {
+			return fmt.Errorf("ledger entry %s belongs to unknown balance batch %s", r.ID.Hex(), r.Batch.Hex())
+		}
+	case *Withdrawal:
+		if r.ID.IsZero() {
+			return fmt.Errorf("withdrawal of user %d has no ID", r.UserID)
+		}
+		if !v.users[r.UserID] {
+			return fmt.Errorf("withdrawal %s belongs to unknown user %d", r.ID.Hex(), r.UserID)
+		}
+		if r.Status != WithdrawalPending && r.Status != WithdrawalApproved {
+			return fmt.Errorf("withdrawal %s has unknown status %q", r.ID.Hex(), r.Status)
+		}
+	case *Broadcast:
+		if r.ID.IsZero() {
+			return fmt.Errorf("broadcast without an ID")
+		}
+		if !contains([]string{BroadcastDraft, BroadcastQueued, BroadcastRunning, BroadcastPaused, BroadcastDone, BroadcastCancelled}, r.Status) {
+			return fmt.Errorf("broadcast %s has unknown status %q", r.ID.Hex(), r.Status)
+		}
+		v.broadcasts[r.ID] = true
+	case *BroadcastFailure:
+		if !v.broadcasts[r.BroadcastID] {
+			return fmt.Errorf("failure of user %d belongs to unknown broadcast %s", r.UserID, r.BroadcastID.Hex())
+		}
+	case *BroadcastDelivery:
+		if !v.broadcasts[r.BroadcastID] {
+			return fmt.Errorf("delivery to user %d belongs to unknown broadcast %s", r.UserID, r.BroadcastID.Hex())
+		}
+	case *Schedule:
+		if r.ID.IsZero() {
+			return fmt.Errorf("schedule without an ID")
+		}
+		if r.Cron != "" {
+			if _, err := parseCron(r.Cron); err != nil {
+				return fmt.Errorf("schedule %s: %v", r.ID.Hex(), err)
+			}
+		}
+	case *MessageTemplate:
+		if r.ID != messageTemplateID(r.Message, r.Language) {
+			return fmt.Errorf("template %q does not match its message and language", r.ID)
+		}
+		if err := checkTemplate(localeFor(), r.Message, r.Text); err != nil {
+			return fmt.Errorf("template %s: %v", r.ID, err)
+		}
+	}
+	return nil
+}
+
+// validateBackup reads a whole archive and checks every record, returning the
+// header and the number of records of each collection.
+func validateBackup(r io.Reader) (*backupHeader, map[string]int64, error) {
+	br, err := newBackupReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v := newBackupValidator()
+	for {
+		collection, record, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := v.check(collection, record); err != nil {
+			return nil, nil, err
+		}
+	}
+	// An archive of users only has nothing after them to trigger the check.
+	if err := v.check("", nil); err != nil {
+		return nil, nil, err
+	}
+	return &br.Header, br.Counts, nil
+}
+
+// restoreBackup validates the archive in f and then imports it into store.
+// Records already in the store are replaced by those in the archive and the
+// others are kept, so an archive can be restored into an empty or a live
+// database.
+func restoreBackup(ctx context.Context, store Store, f io.ReadSeeker) (*backupHeader, map[string]int64, error) {
+	header, counts, err := validateBackup(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to read backup: %v", err)
+	}
+	br, err := newBackupReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := store.ImportRecords(ctx, br.Next); err != nil {
+		return nil, nil, fmt.Errorf("failed to restore backup: %v", err)
+	}
+	return header, counts, nil
+}
+
+// backupSummary lists the record counts of an archive, one collection per line.
+func backupSummary(counts map[string]int64) string {
+	var b strings.Builder
+	for _, c := range backupCollections {
+		fmt.Fprintf(&b, "\n• %s: <code>%d</code>", c.Name, counts[c.Name])
+	}
+	return b.String()
+}
+
+// backupFileName names an archive after the time it was made.
+func backupFileName(t time.Time) string {
+	return "earnify-backup-" + t.UTC().Format("20060102-150405") + ".json.gz"
+}
+
+// backup handles /backup, sending the owner an archive of all bot data.
+func (a *App) backup(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.Chat.Type != "private" {
+		return nil
+	}
+
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil
+	}
+
+	progress, err := msg.Reply(b, "🗄 <b>Creating backup...</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	if err != nil {
+		return err
+	}
+
+	a.goJob(func() {
+		err := a.sendBackup(b, OwnerID)
+		if err != nil {
+			log.Printf("Backup failed: %v", err)
+			_, _, _ = progress.EditText(b, "❌ <b>Backup failed:</b> "+html.EscapeString(err.Error()), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+			return
+		}
+		_, _ = progress.Delete(b, nil)
+	})
+	return nil
+}
+
+// sendBackup writes an archive to a temporary file and sends it to chatID.
+func (a *App) sendBackup(b *gotgbot.Bot, chatID int64) error {
+	f, err := os.CreateTemp("", "earnify-backup-*.json.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	now := time.Now()
+	counts, err := writeBackup(a.base, a.store, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read backup file: %v", err)
+	}
+
+	_, err = b.SendDocument(chatID, gotgbot.InputFileByReader(backupFileName(now), f), &gotgbot.SendDocumentOpts{
+		Caption:   "🗄 <b>Backup of " + now.UTC().Format("2006-01-02 15:04 MST") + "</b>\n" + backupSummary(counts) + "\n\nReply to this file with /restore to restore it.",
+		ParseMode: "HTML",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send backup: %v", err)
+	}
+	return nil
+}
+
+// restore handles /restore in reply to a backup archive. It validates the
+// archive and asks the owner to confirm before importing it.
+func (a *App) restore(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.Chat.Type != "private" {
+		return nil
+	}
+
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil
+	}
+
+	archive := msg.ReplyToMessage
+	if archive == nil || archive.Document == nil {
+		_, _ = msg.Reply(b, "❌ <b>Reply to a backup file with /restore</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	progress, err := msg.Reply(b, "🔍 <b>Checking backup...</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	if err != nil {
+		return err
+	}
+
+	a.goJob(func() {
+		err := withBackupFile(b, archive.Document, func(f *os.File) error {
+			header, counts, err := validateBackup(f)
+			if err != nil {
+				return err
+			}
+
+			// The prompt replies to the archive so the confirmation can find it.
+			_, err = b.SendMessage(msg.Chat.Id, "♻️ <b>Restore the backup of "+header.CreatedAt.UTC().Format("2006-01-02 15:04 MST")+"?</b>\n"+backupSummary(counts)+
+				"\n\nRecords in the backup replace those with the same ID. Records that are not in the backup are kept.",
+				&gotgbot.SendMessageOpts{
+					ParseMode:       "HTML",
+					ReplyParameters: &gotgbot.ReplyParameters{MessageId: archive.MessageId},
+					ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+						{Text: "✅ Restore", CallbackData: "restore.yes"},
+						{Text: "❌ Cancel", CallbackData: "restore.no"},
+					}}},
+				})
+			if err == nil {
+				_, _ = progress.Delete(b, nil)
+			}
+			return err
+		})
+		if err != nil {
+			_, _, _ = progress.EditText(b, "❌ <b>This backup can't be restored:</b> "+html.EscapeString(err.Error()), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		}
+	})
+	return nil
+}
+
+// restoreCallback handles the buttons of the restore prompt, which replies to
+// the archive to restore. Callback data is "restore.<yes|no>".
+func (a *App) restoreCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	query := ctx.CallbackQuery
+	if ctx.EffectiveUser.Id != OwnerID {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ You are not authorized to do this.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	prompt := ctx.EffectiveMessage
+	if query.Data != "restore.yes" {
+		_, _ = query.Answer(b, nil)
+		_, _, _ = prompt.EditText(b, "❌ <b>Restore cancelled.</b>", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	if prompt.ReplyToMessage == nil || prompt.ReplyToMessage.Document == nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ The backup file is gone.", ShowAlert: true})
+		return nil
+	}
+	document := prompt.ReplyToMessage.Document
+
+	_, _ = query.Answer(b, nil)
+	_, _, _ = prompt.EditText(b, "♻️ <b>Restoring backup...</b>", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+
+	a.goJob(func() {
+		var counts map[string]int64
+		err := withBackupFile(b, document, func(f *os.File) error {
+			var err error
+			_, counts, err = restoreBackup(a.base, a.store, f)
+			return err
+		})
+		if err != nil {
+			log.Printf("Restore failed: %v", err)
+			_, _, _ = prompt.EditText(b, "❌ <b>Restore failed:</b> "+html.EscapeString(err.Error()), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+			return
+		}
+		log.Printf("Restored backup %s", document.FileName)
+		_, _, _ = prompt.EditText(b, "✅ <b>Backup restored.</b>\n"+backupSummary(counts), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+	})
+	return nil
+}
+
+// withBackupFile downloads a document to a temporary file and passes it to fn.
+func withBackupFile(b *gotgbot.Bot, document *gotgbot.Document, fn func(f *os.File) error) error {
+	if document.FileSize > maxRestoreDownload {
+		return fmt.Errorf("the file is larger than %d MB, which bots can't download; restore it with the restore subcommand", maxRestoreDownload>>20)
+	}
+
+	body, err := downloadDocument(b, document)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp("", "earnify-restore-*.json.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, body); err != nil {
+		return fmt.Errorf("failed to download file: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	return fn(f)
+}
+
+// downloadDocument opens the contents of a document sent to the bot.
+func downloadDocument(b *gotgbot.Bot, document *gotgbot.Document) (io.ReadCloser, error) {
+	file, err := b.GetFile(document.FileId, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file: %v", err)
+	}
+
+	resp, err := http.Get(file.URL(b, nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download file: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// runBackup is the backup subcommand. It writes an archive of STORE to a file.
+func runBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("o", "", "file to write the backup to (default earnify-backup-<time>.json.gz)")
+	_ = flags.Parse(args)
+
+	if *out == "" {
+		*out = backupFileName(time.Now())
+	}
+
+	loadMongoConfig()
+	dbTimeout = durationEnv("DB_TIMEOUT", dbTimeout)
+	ctx := context.Background()
+	store := openStoreFromEnv(ctx)
+	defer store.Close(ctx)
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+
+	counts, err := writeBackup(ctx, store, f)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		_ = os.Remove(*out)
+		log.Fatal(err)
+	}
+
+	log.Printf("Wrote %s:%s", *out, plainSummary(counts))
+}
+
+// runRestore is the restore subcommand. It validates an archive and, unless
+// -dry-run is given, imports it into STORE.
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only validate the backup")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("usage: earnify restore [-dry-run] <backup file>")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open backup: %v", err)
+	}
+	defer f.Close()
+
+	if *dryRun {
+		header, counts, err := validateBackup(f)
+		if err != nil {
+			log.Fatalf("Backup is invalid: %v", err)
+		}
+		log.Printf("Backup of %s is valid:%s", header.CreatedAt.Format(time.RFC3339), plainSummary(counts))
+		return
+	}
+
+	loadMongoConfig()
+	dbTimeout = durationEnv("DB_TIMEOUT", dbTimeout)
+	ctx := context.Background()
+	store := openStoreFromEnv(ctx)
+	defer store.Close(ctx)
+
+	header, counts, err := restoreBackup(ctx, store, f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Restored backup of %s:%s", header.CreatedAt.Format(time.RFC3339), plainSummary(counts))
+}
+
+// plainSummary is backupSummary for the terminal.
+func plainSummary(counts map[string]int64) string {
+	var b strings.Builder
+	for _, c := range backupCollections {
+		fmt.Fprintf(&b, " %s=%d", c.Name, counts[c.Name])
+	}
+	return b.String()
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxBatchFile is the largest CSV file /bulk reads.
+	maxBatchFile = 1 << 20
+	// maxBatchRows keeps a batch small enough to store and review as one.
+	maxBatchRows = 5000
+	// maxListedErrors is how many problems a message lists before summing up the rest.
+	maxListedErrors = 20
+	maxReasonLength = 200
+)
+
+const bulkUsage = `Reply to a CSV file with /bulk. Each row is <code>user_id,amount,reason</code>; positive amounts are credited and negative amounts debited. A header row is optional.`
+
+// parseBatch reads the rows of a balance batch from CSV. Problems with single
+// rows are returned as messages so the owner sees all of them at once; the
+// error is for files that can't be read at all.
+func parseBatch(r io.Reader) ([]BatchRow, []string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var (
+		rows     []BatchRow
+		problems []string
+	)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		line, _ := cr.FieldPos(0)
+
+		if line == 1 {
+			// Spreadsheets often save CSV with a byte order mark and a header.
+			record[0] = strings.TrimPrefix(record[0], "\ufeff")
+			if strings.EqualFold(strings.TrimSpace(record[0]), "user_id") {
+				continue
+			}
+		}
+		if len(rows)+len(problems) >= maxBatchRows {
+			return nil, nil, fmt.Errorf("a batch may have at most %d rows", maxBatchRows)
+		}
+
+		row, err := parseBatchRow(record)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 && len(problems) == 0 {
+		return nil, nil, fmt.Errorf("the file has no rows")
+	}
+	return rows, problems, nil
+}
+
+func parseBatchRow(record []string) (BatchRow, error) {
+	if len(record) != 3 {
+		return BatchRow{}, fmt.Errorf("expected 3 columns, found %d", len(record))
+	}
+
+	userID, err := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+	if err != nil || userID <= 0 {
+		return BatchRow{}, fmt.Errorf("invalid user ID %q", record[0])
+	}
+
+	amount, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return BatchRow{}, fmt.Errorf("invalid amount %q", record[1])
+	}
+	if amount == 0 {
+		return BatchRow{}, fmt.Errorf("amount is zero")
+	}
+
+	reason := strings.TrimSpace(record[2])
+	if reason == "" {
+		return BatchRow{}, fmt.Errorf("missing reason")
+	}
+	if len([]rune(reason)) > maxReasonLength {
+		return BatchRow{}, fmt.Errorf("reason is longer than %d characters", maxReasonLength)
+	}
+
+	return BatchRow{UserID: userID, Amount: amount, Reason: reason}, nil
+}
+
+// checkBatch checks the rows against the store: every user must exist and
+// no balance may go negative once all of a user's rows are applied.
+func (a *App) checkBatch(rows []BatchRow) ([]string, error) {
+	net := map[int64]float64{}
+	for _, row := range rows {
+		net[row.UserID] += row.Amount
+	}
+
+	var problems []string
+	for _, row := range rows {
+		change, ok := net[row.UserID]
+		if !ok {
+			// Already checked.
+			continue
+		}
+		delete(net, row.UserID)
+
+		ctx, cancel := a.storeContext()
+		user, err := a.store.GetUser(ctx, row.UserID)
+		cancel()
+		if errors.Is(err, ErrNotFound) {
+			problems = append(problems, fmt.Sprintf("user %d is not registered", row.UserID))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user.Balance+change < 0 {
+			problems = append(problems, fmt.Sprintf("user %d has a balance of %.2f, which can't cover %.2f", row.UserID, user.Balance, change))
+		}
+	}
+	return problems, nil
+}
+
+// batchTotals renders the size and totals of a set of balance changes.
+func batchTotals(amounts map[int64][]float64) string {
+	var rows int
+	var credits, debits float64
+	for _, list := range amounts {
+		for _, amount := range list {
+			rows++
+			if amount > 0 {
+				credits += amount
+			} else {
+				debits += amount
+			}
+		}
+	}
+	return fmt.Sprintf("• Rows: <code>%d</code> for <code>%d</code> users\n"+
+		"• Credits: <code>%.2f</code>\n"+
+		"• Debits: <code>%.2f</code>\n"+
+		"• Net: <code>%.2f</code>",
+		rows, len(amounts), credits, debits, credits+debits)
+}
+
+func rowAmounts(rows []BatchRow) map[int64][]float64 {
+	amounts := map[int64][]float64{}
+	for _, row := range rows {
+		amounts[row.UserID] = append(amounts[row.UserID], row.Amount)
+	}
+	return amounts
+}
+
+// listProblems renders problems one per line, up to maxListedErrors of them.
+func listProblems(problems []string) string {
+	var b strings.Builder
+	for i, p := range problems {
+		if i == maxListedErrors {
+			fmt.Fprintf(&b, "\n…and %d more", len(problems)-i)
+			break
+		}
+		b.WriteString("\n• " + html.EscapeString(p))
+	}
+	return b.String()
+}
+
+// bulk handles /bulk in reply to a CSV file of balance changes. It checks
+// every row and, if all of them are fine, stores the batch and asks the
+// owner to confirm it.
+func (a *App) bulk(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.Chat.Type != "private" {
+		return nil
+	}
+
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	file := msg.ReplyToMessage
+	if file == nil || file.Document == nil {
+		_, _ = msg.Reply(b, "❌ "+bulkUsage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+	document := file.Document
+	if document.FileSize > maxBatchFile {
+		_, _ = msg.Reply(b, fmt.Sprintf("❌ The file is larger than %d MB. Split it into smaller batches.", maxBatchFile>>20), nil)
+		return nil
+	}
+
+	progress, err := msg.Reply(b, "🔍 <b>Checking batch...</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	if err != nil {
+		return err
+	}
+
+	a.goJob(func() {
+		text, markup, err := a.prepareBatch(b, document, msg.From.Id)
+		if err != nil {
+			_, _, _ = progress.EditText(b, "❌ <b>This batch can't be used:</b> "+html.EscapeString(CustomError(err).Error()), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+			return
+		}
+		_, _, _ = progress.EditText(b, text, &gotgbot.EditMessageTextOpts{ParseMode: "HTML", ReplyMarkup: markup})
+	})
+	return nil
+}
+
+// prepareBatch reads and checks a batch file. A valid batch is stored as
+// pending and the returned text asks to confirm it; otherwise the text lists
+// what is wrong.
+func (a *App) prepareBatch(b *gotgbot.Bot, document *gotgbot.Document, owner int64) (string, gotgbot.InlineKeyboardMarkup, error) {
+	body, err := downloadDocument(b, document)
+	if err != nil {
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+	defer body.Close()
+
+	rows, problems, err := parseBatch(io.LimitReader(body, maxBatchFile))
+	if err != nil {
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+	more, err := a.checkBatch(rows)
+	if err != nil {
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+	problems = append(problems, more...)
+
+	header := "📋 <b>Balance batch</b> <code>" + html.EscapeString(document.FileName) + "</code>\n" + batchTotals(rowAmounts(rows))
+	if len(problems) > 0 {
+		return header + "\n\n❌ <b>Fix these problems and send the file again:</b>" + listProblems(problems), gotgbot.InlineKeyboardMarkup{}, nil
+	}
+
+	ctx, cancel := a.storeContext()
+	id, err := a.store.AddBalanceBatch(ctx, BalanceBatch{FileName: document.FileName, Rows: rows, CreatedBy: owner})
+	cancel()
+	if err != nil {
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+
+	return header + "\n\nApply these balance changes?", gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+		{Text: "✅ Apply", CallbackData: "batch.apply." + id.Hex()},
+		{Text: "❌ Cancel", CallbackData: "batch.cancel." + id.Hex()},
+	}}}, nil
+}
+
+// revertBatch handles /revertbatch <id>, asking the owner to confirm the
+// reversal of an applied batch.
+func (a *App) revertBatch(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	args := ctx.Args()[1:]
+	if len(args) != 1 {
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/revertbatch &lt;batch_id&gt;</code>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	id, err := primitive.ObjectIDFromHex(args[0])
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Invalid batch ID.", nil)
+		return nil
+	}
+
+	batch, err := a.store.GetBalanceBatch(requestContext(ctx), id)
+	if errors.Is(err, ErrNotFound) {
+		_, _ = msg.Reply(b, "❌ Batch not found.", nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if batch.Status != BatchApplied {
+		_, _ = msg.Reply(b, fmt.Sprintf("❌ Only applied batches can be reversed; this one is %s.", batch.Status), nil)
+		return nil
+	}
+
+	entries, err := a.batchEntries(requestContext(ctx), id)
+	if err != nil {
+		return err
+	}
+	amounts := map[int64][]float64{}
+	for _, e := range entries {
+		amounts[e.UserID] = append(amounts[e.UserID], e.Amount)
+	}
+
+	_, err = msg.Reply(b, "↩️ <b>Reverse balance batch</b> <code>"+html.EscapeString(batch.FileName)+"</code>?\n"+batchTotals(amounts)+
+		"\n\nEvery change above is undone. Users who have since spent a credit can't be debited and are listed afterwards.",
+		&gotgbot.SendMessageOpts{
+			ParseMode: "HTML",
+			ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+				{Text: "↩️ Reverse", CallbackData: "batch.revert." + id.Hex()},
+				{Text: "❌ Keep", CallbackData: "batch.keep." + id.Hex()},
+			}}},
+		})
+	return err
+}
+
+// batchEntries returns the ledger entries a batch applied, leaving out those
+// of its reversal.
+func (a *App) batchEntries(ctx context.Context, id primitive.ObjectID) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	err := a.store.EachBatchLedgerEntry(ctx, id, func(e LedgerEntry) error {
+		if e.Kind == LedgerAdjustment {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// batchCallback handles the buttons of the /bulk and /revertbatch prompts.
+// Callback data is "batch.<apply|cancel|revert|keep>.<id>".
+func (a *App) batchCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	query := ctx.CallbackQuery
+	if ctx.EffectiveUser.Id != OwnerID {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ You are not authorized to do this.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	splitData := strings.Split(query.Data, ".")
+	if len(splitData) < 3 {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid callback data.", ShowAlert: true})
+		return nil
+	}
+	id, err := primitive.ObjectIDFromHex(splitData[2])
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid callback data.", ShowAlert: true})
+		return nil
+	}
+
+	prompt := ctx.EffectiveMessage
+	var from []string
+	var status string
+	switch splitData[1] {
+	case "apply":
+		from, status = []string{BatchPending}, BatchApplying
+	case "cancel":
+		from, status = []string{BatchPending}, BatchCancelled
+	case "revert":
+		from, status = []string{BatchApplied}, BatchReverting
+	case "keep":
+		_, _ = query.Answer(b, nil)
+		_, _, _ = prompt.EditText(b, "✅ <b>Batch kept.</b>", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		return nil
+	default:
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid callback data.", ShowAlert: true})
+		return nil
+	}
+
+	// Moving the status first makes sure a batch is applied or reversed once,
+	// however often the button is pressed.
+	batch, err := a.store.SetBalanceBatchStatus(requestContext(ctx), id, from, status)
+	if errors.Is(err, ErrBatchChanged) {
+		text := "❌ Batch not found."
+		if current, err := a.store.GetBalanceBatch(requestContext(ctx), id); err == nil {
+			text = "❌ This batch is already " + current.Status + "."
+		}
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: text, ShowAlert: true})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, _ = query.Answer(b, nil)
+
+	actor := ctx.EffectiveUser.Id
+	switch status {
+	case BatchCancelled:
+		_, _, _ = prompt.EditText(b, "❌ <b>Batch cancelled.</b>", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+	case BatchApplying:
+		_, _, _ = prompt.EditText(b, "⏳ <b>Applying batch...</b>", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		a.goJob(func() {
+			failures := a.applyBatch(batch, actor)
+			_, _, _ = prompt.EditText(b, appliedText(batch, failures), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		})
+	case BatchReverting:
+		_, _, _ = prompt.EditText(b, "⏳ <b>Reversing batch...</b>", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		a.goJob(func() {
+			reversed, failures, err := a.reverseBatch(id, actor)
+			if err != nil {
+				log.Printf("Reversal of batch %s failed: %v", id.Hex(), err)
+			}
+			_, _, _ = prompt.EditText(b, reversedText(id, reversed, failures, err), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		})
+	}
+	return nil
+}
+
+// applyBatchEntry applies one entry of a batch. An entry already applied by an
+// earlier, interrupted run is skipped.
+func (a *App) applyBatchEntry(entry LedgerEntry) error {
+	ctx, cancel := a.storeContext()
+	defer cancel()
+
+	_, err := a.store.ApplyBatchEntry(ctx, entry)
+	return err
+}
+
+// applyBatch applies the rows of a batch and returns the ones that failed.
+// Balances may have changed since the batch was checked, so a debit can
+// still fail here; the other rows are applied regardless.
+func (a *App) applyBatch(batch *BalanceBatch, actor int64) []string {
+	var failures []string
+	for i, row := range batch.Rows {
+		err := a.applyBatchEntry(LedgerEntry{
+			UserID: row.UserID,
+			Amount: row.Amount,
+			Kind:   LedgerAdjustment,
+			Actor:  actor,
+			Batch:  batch.ID,
+			Row:    i + 1,
+			Reason: row.Reason,
+		})
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("user %d, %.2f: %v", row.UserID, row.Amount, err))
+		}
+	}
+
+	ctx, cancel := a.storeContext()
+	defer cancel()
+	if _, err := a.store.SetBalanceBatchStatus(ctx, batch.ID, []string{BatchApplying}, BatchApplied); err != nil {
+		log.Printf("Failed to mark batch %s applied: %v", batch.ID.Hex(), err)
+	}
+	log.Printf("Applied batch %s: %d rows, %d failed", batch.ID.Hex(), len(batch.Rows), len(failures))
+	return failures
+}
+
+// reverseBatch undoes every ledger entry a batch applied and returns how many
+// were undone and the ones that could not be.
+func (a *App) reverseBatch(id primitive.ObjectID, actor int64) (int, []string, error) {
+	ctx, cancel := a.storeContext()
+	entries, err := a.batchEntries(ctx, id)
+	cancel()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var failures []string
+	for _, e := range entries {
+		err := a.applyBatchEntry(LedgerEntry{
+			UserID: e.UserID,
+			Amount: -e.Amount,
+			Kind:   LedgerReversal,
+			Actor:  actor,
+			Batch:  id,
+			Row:    e.Row,
+			Reason: e.Reason,
+		})
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("user %d, %.2f: %v", e.UserID, -e.Amount, err))
+		}
+	}
+
+	ctx, cancel = a.storeContext()
+	defer cancel()
+	if _, err := a.store.SetBalanceBatchStatus(ctx, id, []string{BatchReverting}, BatchReverted); err != nil {
+		log.Printf("Failed to mark batch %s reverted: %v", id.Hex(), err)
+	}
+	log.Printf("Reversed batch %s: %d entries, %d failed", id.Hex(), len(entries), len(failures))
+	return len(entries) - len(failures), failures, nil
+}
+
+// appliedText reports the outcome of applying a batch.
+func appliedText(batch *BalanceBatch, failures []string) string {
+	text := fmt.Sprintf("✅ <b>Batch <code>%s</code> applied.</b>\n%s", batch.ID.Hex(), batchTotals(rowAmounts(batch.Rows)))
+	if len(failures) > 0 {
+		text += fmt.Sprintf("\n\n⚠️ <b>%d rows failed:</b>%s", len(failures), listProblems(failures))
+	}
+	return text + "\n\nTo undo it, send <code>/revertbatch " + batch.ID.Hex() + "</code>"
+}
+
+// reversedText reports the outcome of reversing a batch.
+func reversedText(id primitive.ObjectID, reversed int, failures []string, err error) string {
+	if err != nil {
+		return "❌ <b>Reversal failed:</b> " + html.EscapeString(err.Error())
+	}
+	text := fmt.Sprintf("✅ <b>Batch <code>%s</code> reversed:</b> %d changes undone.", id.Hex(), reversed)
+	if len(failures) > 0 {
+		text += fmt.Sprintf("\n\n⚠️ <b>%d changes could not be undone:</b>%s", len(failures), listProblems(failures))
+	}
+	return text
+}
+
+// resumeBatches finishes the batches a previous run left applying or
+// reverting, and tells their owner how it went. Rows applied before the
+// interruption are skipped.
+func (a *App) resumeBatches(b *gotgbot.Bot) {
+	ctx, cancel := a.storeContext()
+	batches, err := a.store.GetBalanceBatchesByStatus(ctx, []string{BatchApplying, BatchReverting})
+	cancel()
+	if err != nil {
+		log.Printf("Failed to look for interrupted batches: %v", err)
+		return
+	}
+
+	for _, batch := range batches {
+		var text string
+		switch batch.Status {
+		case BatchApplying:
+			log.Printf("Resuming application of batch %s", batch.ID.Hex())
+			text = appliedText(&batch, a.applyBatch(&batch, batch.CreatedBy))
+		case BatchReverting:
+			log.Printf("Resuming reversal of batch %s", batch.ID.Hex())
+			reversed, failures, err := a.reverseBatch(batch.ID, batch.CreatedBy)
+			if err != nil {
+				log.Printf("Reversal of batch %s failed: %v", batch.ID.Hex(), err)
+			}
+			text = reversedText(batch.ID, reversed, failures, err)
+		}
+		_, _ = b.SendMessage(batch.CreatedBy, "🔁 <b>Resumed after a restart.</b>\n\n"+text, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		csv          string
+		want         []BatchRow
+		wantProblems []string
+	}{
+		{
+			name: "rows",
+			csv:  "1,10,bonus\n2,-2.5,correction\n",
+			want: []BatchRow{{1, 10, "bonus"}, {2, -2.5, "correction"}},
+		},
+		{
+			name: "header",
+			csv:  "user_id,amount,reason\n1,10,bonus\n",
+			want: []BatchRow{{1, 10, "bonus"}},
+		},
+		{
+			name: "byte order mark and header",
+			csv:  "\ufeffUser_ID,amount,reason\r\n1,10,bonus\r\n",
+			want: []BatchRow{{1, 10, "bonus"}},
+		},
+		{
+			name: "byte order mark without header",
+			csv:  "\ufeff1,10,bonus\n",
+			want: []BatchRow{{1, 10, "bonus"}},
+		},
+		{
+			name:         "header only counts on the first line",
+			csv:          "1,10,bonus\nuser_id,amount,reason\n",
+			want:         []BatchRow{{1, 10, "bonus"}},
+			wantProblems: []string{`line 2: invalid user ID "user_id"`},
+		},
+		{
+			name: "spaces and quoted reason",
+			csv:  " 1 , 10 , \"prize, first place\"\n",
+			want: []BatchRow{{1, 10, "prize, first place"}},
+		},
+		{
+			name: "duplicate rows are kept",
+			csv:  "1,10,bonus\n1,10,bonus\n",
+			want: []BatchRow{{1, 10, "bonus"}, {1, 10, "bonus"}},
+		},
+		{
+			name: "invalid rows",
+			csv: "1,10\n" +
+				"0,10,bonus\n" +
+				"x,10,bonus\n" +
+				"1,ten,bonus\n" +
+				"1,NaN,bonus\n" +
+				"1,Inf,bonus\n" +
+				"1,0,bonus\n" +
+				"1,10, \n" +
+				"1,10," + strings.Repeat("a", maxReasonLength+1) + "\n" +
+				"2,5,fine\n",
+			want: []BatchRow{{2, 5, "fine"}},
+			wantProblems: []string{
+				"line 1: expected 3 columns, found 2",
+				`line 2: invalid user ID "0"`,
+				`line 3: invalid user ID "x"`,
+				`line 4: invalid amount "ten"`,
+				`line 5: invalid amount "NaN"`,
+				`line 6: invalid amount "Inf"`,
+				"line 7: amount is zero",
+				"line 8: missing reason",
+				fmt.Sprintf("line 9: reason is longer than %d characters", maxReasonLength),
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, problems, err := parseBatch(strings.NewReader(tc.csv))
+			if err != nil {
+				t.Fatalf("parseBatch() error = %v", err)
+			}
+			if !reflect.DeepEqual(rows, tc.want) {
+				t.Errorf("parseBatch() rows = %v, want %v", rows, tc.want)
+			}
+			if !reflect.DeepEqual(problems, tc.wantProblems) {
+				t.Errorf("parseBatch() problems = %q, want %q", problems, tc.wantProblems)
+			}
+		})
+	}
+}
+
+func TestParseBatchRejectsFiles(t *testing.T) {
+	rows := func(n int) string {
+		return strings.Repeat("1,1,bonus\n", n)
+	}
+
+	tests := []struct {
+		name    string
+		csv     string
+		wantErr bool
+	}{
+		{name: "empty", csv: "", wantErr: true},
+		{name: "header only", csv: "user_id,amount,reason\n", wantErr: true},
+		{name: "unterminated quote", csv: "1,10,\"bonus\n", wantErr: true},
+		{name: "most rows", csv: "user_id,amount,reason\n" + rows(maxBatchRows)},
+		{name: "too many rows", csv: rows(maxBatchRows + 1), wantErr: true},
+		{name: "too many invalid rows", csv: strings.Repeat("x\n", maxBatchRows+1), wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := parseBatch(strings.NewReader(tc.csv))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("parseBatch() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckBatch(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, u := range []User{{ID: 1, Balance: 5}, {ID: 2, Balance: 5}} {
+		if err := store.AddUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &App{store: store, base: ctx}
+
+	tests := []struct {
+		name string
+		rows []BatchRow
+		want []string
+	}{
+		{
+			name: "credits",
+			rows: []BatchRow{{1, 10, "bonus"}, {2, 1, "bonus"}},
+		},
+		{
+			name: "debit covered by the balance",
+			rows: []BatchRow{{1, -5, "fee"}},
+		},
+		{
+			name: "debit covered by a credit in the same batch",
+			rows: []BatchRow{{1, -12, "fee"}, {1, 10, "bonus"}},
+		},
+		{
+			name: "debits adding up past the balance",
+			rows: []BatchRow{{1, -4, "fee"}, {2, -1, "fee"}, {1, -4, "fee"}},
+			want: []string{"user 1 has a balance of 5.00, which can't cover -8.00"},
+		},
+		{
+			name: "unregistered user reported once",
+			rows: []BatchRow{{3, 1, "bonus"}, {1, 1, "bonus"}, {3, 1, "bonus"}},
+			want: []string{"user 3 is not registered"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := a.checkBatch(tc.rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("checkBatch() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// broadcastRate stays under Telegram's limit of about 30 messages per second.
+	broadcastRate      = 25
+	broadcastBurst     = 5
+	broadcastBatchSize = 100
+	broadcastMaxTries  = 3
+	// broadcastCheckpointEvery bounds how many users may receive a duplicate
+	// message if the worker dies between checkpoints.
+	broadcastCheckpointEvery = 20
+	broadcastLease           = time.Minute
+	broadcastProgressEvery   = 5 * time.Second
+	broadcastPollInterval    = 10 * time.Second
+)
+
+var (
+	// broadcastLimiter is shared by everything that messages users in bulk.
+	broadcastLimiter = newTokenBucket(broadcastRate, broadcastBurst)
+	// broadcastWake nudges the worker to look for a new job without waiting for the next poll.
+	broadcastWake = make(chan struct{}, 1)
+	workerID      = fmt.Sprintf("%s-%d", hostname(), os.Getpid())
+)
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "earnify"
+	}
+	return name
+}
+
+func (a *App) broadcast(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.Chat.Type != "private" {
+		return nil
+	}
+
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil
+	}
+
+	reply := ctx.EffectiveMessage.ReplyToMessage
+	if reply == nil {
+		_, err := ctx.EffectiveMessage.Reply(b, "❌ <b>Reply to a message to broadcast</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		if err != nil {
+			return fmt.Errorf("error while replying to user: %v", err)
+		}
+		return ext.EndGroups
+	}
+
+	button := &gotgbot.InlineKeyboardMarkup{}
+	if reply.ReplyMarkup != nil {
+		button.InlineKeyboard = reply.ReplyMarkup.InlineKeyboard
+	}
+
+	query := strings.Join(ctx.Args()[1:], " ")
+	segment, err := parseSegment(query)
+	if err != nil {
+		_, _ = msg.Reply(b, segmentUsage(err.Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	total, err := a.store.CountReachableUsers(requestContext(ctx), segment)
+	if err != nil {
+		_, _ = msg.Reply(b, "Error getting users.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+
+	progress, err := msg.Reply(b, "📢 <b>Preparing broadcast...</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	if err != nil {
+		return fmt.Errorf("error while replying to user: %v", err)
+	}
+
+	job := Broadcast{
+		FromChatID:        msg.Chat.Id,
+		MessageID:         reply.MessageId,
+		ReplyMarkup:       button,
+		CreatedBy:         msg.From.Id,
+		Segment:           query,
+		Status:            BroadcastDraft,
+		Total:             total,
+		ProgressChatID:    progress.Chat.Id,
+		ProgressMessageID: progress.MessageId,
+	}
+
+	job.ID, err = a.store.AddBroadcast(requestContext(ctx), job)
+	if err != nil {
+		_, _, _ = progress.EditText(b, "❌ Failed to queue broadcast.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+
+	updateBroadcastProgress(b, &job)
+	return nil
+}
+
+func wakeBroadcastWorker() {
+	select {
+	case broadcastWake <- struct{}{}:
+	default:
+	}
+}
+
+// broadcastWorker processes persisted broadcast jobs one at a time until
+// stop is cancelled.
+func (a *App) broadcastWorker(stop context.Context, b *gotgbot.Bot) {
+	for stop.Err() == nil {
+		ctx, cancel := a.storeContext()
+		job, err := a.store.ClaimBroadcast(ctx, workerID, broadcastLease)
+		cancel()
+		if err != nil {
+			log.Printf("Broadcast worker: %v", err)
+		}
+
+		if job == nil {
+			select {
+			case <-broadcastWake:
+			case <-time.After(broadcastPollInterval):
+			case <-stop.Done():
+			}
+			continue
+		}
+
+		if err := a.runBroadcast(stop, b, job, broadcastLimiter); err != nil {
+			log.Printf("Broadcast %s: %v", job.ID.Hex(), err)
+		}
+	}
+}
+
+// runBroadcast sends a claimed job to its remaining audience. When stop is
+// cancelled it checkpoints and hands the job back to the queue, so the next
+// worker to start resumes it straight away.
+func (a *App) runBroadcast(stop context.Context, b *gotgbot.Bot, job *Broadcast, limiter *tokenBucket) error {
+	if job.Cursor != 0 {
+		log.Printf("Resuming broadcast %s after user %d", job.ID.Hex(), job.Cursor)
+	}
+
+	if job.Errors == nil {
+		job.Errors = map[string]int64{}
+	}
+
+	segment, err := parseSegment(job.Segment)
+	if err != nil {
+		return err
+	}
+
+	var deliveries []BroadcastDelivery
+	checkpoint := func() (string, error) {
+		ctx, cancel := a.storeContext()
+		defer cancel()
+
+		// Deliveries are saved before the cursor moves past them.
+		if err := a.store.AddBroadcastDeliveries(ctx, deliveries); err != nil {
+			log.Printf("Broadcast %s: %v", job.ID.Hex(), err)
+		}
+		deliveries = deliveries[:0]
+		return a.store.CheckpointBroadcast(ctx, job, workerID, broadcastLease)
+	}
+
+	updateBroadcastProgress(b, job)
+	lastProgress := time.Now()
+	sinceCheckpoint := 0
+	for {
+		ctx, cancel := a.storeContext()
+		ids, err := a.store.GetUserIDsAfter(ctx, job.Cursor, broadcastBatchSize, segment)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, userID := range ids {
+			messageID, err := sendBroadcast(b, job, userID, limiter)
+			if err != nil {
+				kind := classifyError(err)
+				job.Failed++
+				job.Errors[kind]++
+
+				ctx, cancel := a.storeContext()
+				if err := a.store.AddBroadcastFailure(ctx, BroadcastFailure{
+					BroadcastID: job.ID,
+					UserID:      userID,
+					Kind:        kind,
+					Description: CustomError(err).Error(),
+				}); err != nil {
+					log.Printf("Broadcast %s: %v", job.ID.Hex(), err)
+				}
+
+				if isUnreachable(kind) {
+					if err := a.store.MarkUserInactive(ctx, userID, kind); err != nil {
+						log.Printf("Broadcast %s: %v", job.ID.Hex(), err)
+					}
+				}
+				cancel()
+			} else {
+				job.Sent++
+				deliveries = append(deliveries, BroadcastDelivery{BroadcastID: job.ID, UserID: userID, MessageID: messageID})
+			}
+			job.Cursor = userID
+
+			sinceCheckpoint++
+			if sinceCheckpoint < broadcastCheckpointEvery && stop.Err() == nil {
+				continue
+			}
+
+			sinceCheckpoint = 0
+			status, err := checkpoint()
+			if err != nil {
+				return err
+			}
+
+			switch status {
+			case "":
+				return fmt.Errorf("lease lost to another worker")
+			case BroadcastPaused:
+				job.Status = status
+				updateBroadcastProgress(b, job)
+				return nil
+			case BroadcastCancelled:
+				return a.completeBroadcast(b, job, BroadcastCancelled)
+			}
+
+			if stop.Err() != nil {
+				return a.requeueBroadcast(job)
+			}
+
+			if time.Since(lastProgress) >= broadcastProgressEvery {
+				lastProgress = time.Now()
+				updateBroadcastProgress(b, job)
+			}
+		}
+	}
+
+	ctx, cancel := a.storeContext()
+	defer cancel()
+	if err := a.store.AddBroadcastDeliveries(ctx, deliveries); err != nil {
+		log.Printf("Broadcast %s: %v", job.ID.Hex(), err)
+	}
+	return a.completeBroadcast(b, job, BroadcastDone)
+}
+
+// requeueBroadcast releases a running job so that any worker can claim it.
+func (a *App) requeueBroadcast(job *Broadcast) error {
+	ctx, cancel := a.storeContext()
+	defer cancel()
+
+	if _, err := a.store.SetBroadcastStatus(ctx, job.ID, []string{BroadcastRunning}, BroadcastQueued); err != nil {
+		return err
+	}
+	log.Printf("Broadcast %s stopped for shutdown after user %d", job.ID.Hex(), job.Cursor)
+	return nil
+}
+
+// completeBroadcast stores the final state and sends the delivery report.
+func (a *App) completeBroadcast(b *gotgbot.Bot, job *Broadcast, status string) error {
+	ctx, cancel := a.storeContext()
+	defer cancel()
+	if err := a.store.FinishBroadcast(ctx, job, status); err != nil {
+		return err
+	}
+
+	updateBroadcastProgress(b, job)
+	_, err := b.SendMessage(job.ProgressChatID, broadcastReport(job), &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: broadcastMarkup(job),
+		ReplyParameters: &gotgbot.ReplyParameters{
+			MessageId:                job.ProgressMessageID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	return err
+}
+
+func broadcastMarkup(job *Broadcast) gotgbot.InlineKeyboardMarkup {
+	id := job.ID.Hex()
+	var row []gotgbot.InlineKeyboardButton
+	switch job.Status {
+	case BroadcastDraft:
+		markup := gotgbot.InlineKeyboardMarkup{InlineKeyboard: optionRows(job.BroadcastOptions, "bcast", id)}
+		row = []gotgbot.InlineKeyboardButton{
+			{Text: "🚀 Send", CallbackData: "bcast.send." + id},
+			{Text: "✖️ Cancel", CallbackData: "bcast.cancel." + id},
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+		return markup
+	case BroadcastQueued, BroadcastRunning:
+		row = []gotgbot.InlineKeyboardButton{
+			{Text: "⏸ Pause", CallbackData: "bcast.pause." + id},
+			{Text: "✖️ Cancel", CallbackData: "bcast.cancel." + id},
+		}
+	case BroadcastPaused:
+		row = []gotgbot.InlineKeyboardButton{
+			{Text: "▶️ Resume", CallbackData: "bcast.resume." + id},
+			{Text: "✖️ Cancel", CallbackData: "bcast.cancel." + id},
+		}
+	default:
+		if job.Failed > 0 {
+			row = []gotgbot.InlineKeyboardButton{
+				{Text: "📄 Download CSV", CallbackData: "bcast.csv." + id},
+			}
+		}
+	}
+
+	markup := gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{}}
+	if len(row) > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+	}
+	return markup
+}
+
+// optionRows are the toggle buttons for the delivery options o. Each button's
+// data is "<prefix>.<option>.<id>".
+func optionRows(o BroadcastOptions, prefix, id string) [][]gotgbot.InlineKeyboardButton {
+	toggle := func(on bool, text, action string) gotgbot.InlineKeyboardButton {
+		mark := "▫️"
+		if on {
+			mark = "✅"
+		}
+		return gotgbot.InlineKeyboardButton{Text: mark + " " + text, CallbackData: prefix + "." + action + "." + id}
+	}
+
+	mode := "📋 Mode: Copy"
+	if o.Forward {
+		mode = "↪️ Mode: Forward"
+	}
+
+	return [][]gotgbot.InlineKeyboardButton{
+		{
+			{Text: mode, CallbackData: prefix + ".forward." + id},
+			toggle(o.Silent, "Silent", "silent"),
+		},
+		{
+			toggle(o.Pin, "Pin", "pin"),
+			toggle(o.Protect, "Protect", "protect"),
+		},
+	}
+}
+
+// toggleOption flips the delivery option named by a toggle button.
+func toggleOption(o BroadcastOptions, name string) BroadcastOptions {
+	toggles := map[string]*bool{"forward": &o.Forward, "silent": &o.Silent, "pin": &o.Pin, "protect": &o.Protect}
+	*toggles[name] = !*toggles[name]
+	return o
+}
+
+// describeOptions lists the delivery mode and options of o, e.g. "copy, silent".
+func describeOptions(o BroadcastOptions) string {
+	mode := []string{"copy"}
+	if o.Forward {
+		mode[0] = "forward"
+	}
+	for _, opt := range []struct {
+		on   bool
+		name string
+	}{{o.Silent, "silent"}, {o.Pin, "pin"}, {o.Protect, "protect"}} {
+		if opt.on {
+			mode = append(mode, opt.name)
+		}
+	}
+	return strings.Join(mode, ", ")
+}
+
+// updateBroadcastProgress edits the progress message with the job's counters.
+func updateBroadcastProgress(b *gotgbot.Bot, job *Broadcast) {
+	audience := "all users"
+	if job.Segment != "" {
+		audience = "<code>" + html.EscapeString(job.Segment) + "</code>"
+	}
+
+	remaining := max(job.Total-job.Sent-job.Failed, 0)
+	text := fmt.Sprintf(
+		"📢 <b>Broadcast %s</b>\n"+
+			"🆔 <code>%s</code>\n\n"+
+			"🎯 <b>Audience:</b> %s (%d users)\n"+
+			"⚙️ <b>Mode:</b> %s\n"+
+			"✅ <b>Sent:</b> %d\n"+
+			"❌ <b>Failed:</b> %d\n"+
+			"🚫 <b>Blocked:</b> %d\n"+
+			"⏳ <b>Remaining:</b> %d",
+		job.Status, job.ID.Hex(), audience, job.Total, describeOptions(job.BroadcastOptions), job.Sent, job.Failed, job.Errors[ErrKindBlocked], remaining)
+
+	_, _, err := b.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:      job.ProgressChatID,
+		MessageId:   job.ProgressMessageID,
+		ParseMode:   "HTML",
+		ReplyMarkup: broadcastMarkup(job),
+	})
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("Broadcast %s: failed to update progress: %v", job.ID.Hex(), err)
+	}
+}
+
+func broadcastReport(job *Broadcast) string {
+	title := "✅ <b>Broadcast finished</b>"
+	if job.Status == BroadcastCancelled {
+		title = "✖️ <b>Broadcast cancelled</b>"
+	}
+
+	text := fmt.Sprintf("%s\n\n✅ <b>Broadcast successfully to %d users</b>\n❌ <b>Failed:</b> %d\n", title, job.Sent, job.Failed)
+	if len(job.Errors) > 0 {
+		kinds := make([]string, 0, len(job.Errors))
+		for kind := range job.Errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		text += "\n<b>Failures by type</b>\n"
+		for _, kind := range kinds {
+			text += fmt.Sprintf("• %s: %d\n", kind, job.Errors[kind])
+		}
+	}
+	return text
+}
+
+// broadcastCallback handles the buttons on broadcast progress and report messages.
+// Callback data is "bcast.<action>.<broadcast_id>".
+func (a *App) broadcastCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	query := ctx.CallbackQuery
+	if ctx.EffectiveUser.Id != OwnerID {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ You are not authorized to do this.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	splitData := strings.Split(query.Data, ".")
+	if len(splitData) < 3 {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid callback data.", ShowAlert: true})
+		return nil
+	}
+
+	id, err := primitive.ObjectIDFromHex(splitData[2])
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid broadcast ID.", ShowAlert: true})
+		return nil
+	}
+
+	var job *Broadcast
+	switch splitData[1] {
+	case "forward", "silent", "pin", "protect":
+		job, err = a.store.GetBroadcast(requestContext(ctx), id)
+		if err == nil {
+			job, err = a.store.SetBroadcastOptions(requestContext(ctx), id, toggleOption(job.BroadcastOptions, splitData[1]))
+		}
+		if err == nil {
+			updateBroadcastProgress(b, job)
+		}
+	case "send":
+		job, err = a.store.SetBroadcastStatus(requestContext(ctx), id, []string{BroadcastDraft}, BroadcastQueued)
+		if err == nil {
+			job.Status = BroadcastQueued
+			updateBroadcastProgress(b, job)
+			wakeBroadcastWorker()
+		}
+	case "pause":
+		job, err = a.store.SetBroadcastStatus(requestContext(ctx), id, []string{BroadcastQueued, BroadcastRunning}, BroadcastPaused)
+		if err == nil {
+			job.Status = BroadcastPaused
+			updateBroadcastProgress(b, job)
+		}
+	case "resume":
+		job, err = a.store.SetBroadcastStatus(requestContext(ctx), id, []string{BroadcastPaused}, BroadcastQueued)
+		if err == nil {
+			job.Status = BroadcastQueued
+			updateBroadcastProgress(b, job)
+			wakeBroadcastWorker()
+		}
+	case "cancel":
+		job, err = a.store.SetBroadcastStatus(requestContext(ctx), id, []string{BroadcastDraft, BroadcastQueued, BroadcastRunning, BroadcastPaused}, BroadcastCancelled)
+		switch {
+		case err != nil:
+		case job.Status == BroadcastDraft:
+			job.Status = BroadcastCancelled
+			updateBroadcastProgress(b, job)
+		// A running job is finished by its worker at the next checkpoint,
+		// unless that worker has gone away.
+		case job.Status != BroadcastRunning || job.LeaseUntil.Before(time.Now()):
+			err = a.completeBroadcast(b, job, BroadcastCancelled)
+		}
+	case "csv":
+		job, err = a.store.GetBroadcast(requestContext(ctx), id)
+		if err == nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "📄 Preparing report..."})
+			return a.sendBroadcastCSV(b, ctx.EffectiveChat.Id, job)
+		}
+	default:
+		err = fmt.Errorf("unknown action")
+	}
+
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + err.Error(), ShowAlert: true})
+		return nil
+	}
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "✅ Done."})
+	return nil
+}
+
+// sendBroadcastCSV streams the failures of a broadcast into a CSV document.
+func (a *App) sendBroadcastCSV(b *gotgbot.Bot, chatID int64, job *Broadcast) error {
+	pr, pw := io.Pipe()
+	go func() {
+		w := csv.NewWriter(pw)
+		_ = w.Write([]string{"user_id", "error_type", "description", "at"})
+		err := a.store.EachBroadcastFailure(a.base, job.ID, func(f BroadcastFailure) error {
+			return w.Write([]string{strconv.FormatInt(f.UserID, 10), f.Kind, f.Description, f.At.Format(time.RFC3339)})
+		})
+		w.Flush()
+		if err == nil {
+			err = w.Error()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	_, err := b.SendDocument(chatID, gotgbot.InputFileByReader(fmt.Sprintf("broadcast-%s.csv", job.ID.Hex()), pr), &gotgbot.SendDocumentOpts{
+		Caption: fmt.Sprintf("📄 Delivery report: %d sent, %d failed", job.Sent, job.Failed),
+	})
+	_ = pr.Close()
+	return err
+}
+
+// sendBroadcast delivers the job's message to one user, waiting out flood
+// limits, and returns the ID of the message in the user's chat.
+func sendBroadcast(b *gotgbot.Bot, job *Broadcast, userID int64, limiter *tokenBucket) (int64, error) {
+	var (
+		messageID int64
+		err       error
+	)
+	for try := 0; try < broadcastMaxTries; try++ {
+		limiter.Wait()
+		if job.Forward {
+			var m *gotgbot.Message
+			m, err = b.ForwardMessage(userID, job.FromChatID, job.MessageID, &gotgbot.ForwardMessageOpts{
+				DisableNotification: job.Silent,
+				ProtectContent:      job.Protect,
+			})
+			if err == nil {
+				messageID = m.MessageId
+			}
+		} else {
+			var m *gotgbot.MessageId
+			m, err = b.CopyMessage(userID, job.FromChatID, job.MessageID, &gotgbot.CopyMessageOpts{
+				ReplyMarkup:         job.ReplyMarkup,
+				DisableNotification: job.Silent,
+				ProtectContent:      job.Protect,
+			})
+			if err == nil {
+				messageID = m.MessageId
+			}
+		}
+
+		wait := retryAfter(err)
+		if wait == 0 {
+			break
+		}
+
+		limiter.Pause(wait)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if job.Pin {
+		limiter.Wait()
+		// A failed pin still counts as a delivery.
+		if _, pinErr := b.PinChatMessage(userID, messageID, &gotgbot.PinChatMessageOpts{DisableNotification: job.Silent}); pinErr != nil {
+			log.Printf("Broadcast %s: failed to pin for %d: %v", job.ID.Hex(), userID, pinErr)
+		}
+	}
+	return messageID, nil
+}
+
+// deleteBroadcast handles /delbroadcast <id>, removing a sent broadcast from
+// every recipient's chat.
+func (a *App) deleteBroadcast(b *gotgbot.Bot, ctx *ext.Context) error {
+	job, ok := a.broadcastFromArgs(b, ctx)
+	if !ok {
+		return nil
+	}
+
+	progress, err := ctx.EffectiveMessage.Reply(b, "🗑 <b>Deleting broadcast...</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	if err != nil {
+		return err
+	}
+
+	a.goJob(func() {
+		done, failed, err := a.eachDeliveryLimited(job, func(d BroadcastDelivery) error {
+			_, err := b.DeleteMessage(d.UserID, d.MessageID, nil)
+			return err
+		})
+		if err == nil {
+			storeCtx, cancel := a.storeContext()
+			err = a.store.DeleteBroadcastDeliveries(storeCtx, job.ID)
+			cancel()
+		}
+		reportDeliveryUpdate(b, progress, "🗑 Deleted", done, failed, err)
+	})
+	return nil
+}
+
+// editBroadcast handles /editbroadcast <id> in reply to a message, replacing
+// the text or caption of a sent broadcast in every recipient's chat.
+func (a *App) editBroadcast(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	reply := msg.ReplyToMessage
+	if reply == nil {
+		_, _ = msg.Reply(b, "❌ <b>Reply to the new content with</b> <code>/editbroadcast &lt;id&gt;</code>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	job, ok := a.broadcastFromArgs(b, ctx)
+	if !ok {
+		return nil
+	}
+
+	if job.Forward {
+		_, _ = msg.Reply(b, "❌ Forwarded broadcasts cannot be edited.", nil)
+		return nil
+	}
+
+	if reply.Text == "" && reply.Caption == "" {
+		_, _ = msg.Reply(b, "❌ Only text and captions can be edited.", nil)
+		return nil
+	}
+
+	markup := gotgbot.InlineKeyboardMarkup{}
+	if reply.ReplyMarkup != nil {
+		markup = *reply.ReplyMarkup
+	}
+
+	progress, err := msg.Reply(b, "✏️ <b>Editing broadcast...</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	if err != nil {
+		return err
+	}
+
+	a.goJob(func() {
+		done, failed, err := a.eachDeliveryLimited(job, func(d BroadcastDelivery) error {
+			var err error
+			if reply.Text != "" {
+				_, _, err = b.EditMessageText(reply.Text, &gotgbot.EditMessageTextOpts{
+					ChatId:      d.UserID,
+					MessageId:   d.MessageID,
+					Entities:    reply.Entities,
+					ReplyMarkup: markup,
+				})
+			} else {
+				_, _, err = b.EditMessageCaption(&gotgbot.EditMessageCaptionOpts{
+					ChatId:          d.UserID,
+					MessageId:       d.MessageID,
+					Caption:         reply.Caption,
+					CaptionEntities: reply.CaptionEntities,
+					ReplyMarkup:     markup,
+				})
+			}
+			return err
+		})
+		reportDeliveryUpdate(b, progress, "✏️ Edited", done, failed, err)
+	})
+	return nil
+}
+
+// broadcastFromArgs loads the broadcast named by the first command argument,
+// replying with an error when the caller is not the owner or the ID is bad.
+func (a *App) broadcastFromArgs(b *gotgbot.Bot, ctx *ext.Context) (*Broadcast, bool) {
+	msg := ctx.EffectiveMessage
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil, false
+	}
+
+	args := ctx.Args()[1:]
+	if len(args) < 1 {
+		_, _ = msg.Reply(b, "❌ Please provide the broadcast ID shown on its progress message.", nil)
+		return nil, false
+	}
+
+	id, err := primitive.ObjectIDFromHex(args[0])
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Invalid broadcast ID.", nil)
+		return nil, false
+	}
+
+	job, err := a.store.GetBroadcast(requestContext(ctx), id)
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Broadcast not found.", nil)
+		return nil, false
+	}
+
+	if job.Status != BroadcastDone && job.Status != BroadcastCancelled {
+		_, _ = msg.Reply(b, "❌ Wait for the broadcast to finish first.", nil)
+		return nil, false
+	}
+	return job, true
+}
+
+// eachDeliveryLimited applies fn to every delivery of a broadcast under the
+// broadcast rate limit, retrying once after a flood wait.
+func (a *App) eachDeliveryLimited(job *Broadcast, fn func(BroadcastDelivery) error) (done, failed int, err error) {
+	err = a.store.EachBroadcastDelivery(a.base, job.ID, func(d BroadcastDelivery) error {
+		broadcastLimiter.Wait()
+		err := fn(d)
+		if wait := retryAfter(err); wait > 0 {
+			broadcastLimiter.Pause(wait)
+			broadcastLimiter.Wait()
+			err = fn(d)
+		}
+
+		if err != nil {
+			failed++
+		} else {
+			done++
+		}
+		return nil
+	})
+	return done, failed, err
+}
+
+func reportDeliveryUpdate(b *gotgbot.Bot, progress *gotgbot.Message, action string, done, failed int, err error) {
+	text := fmt.Sprintf("%s in %d chats, %d failed.", action, done, failed)
+	if err != nil {
+		text += "\n\n❌ " + CustomError(err).Error()
+	}
+	_, _, _ = progress.EditText(b, text, nil)
+}
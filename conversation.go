@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/conversation"
+)
+
+// ConversationStorage is a conversation.Storage kept in the Store, so with a
+// shared database conversations survive restarts and are shared between
+// replicas. States listed in timeouts expire after the given
+// duration of inactivity.
+type ConversationStorage struct {
+	store       Store
+	keyStrategy conversation.KeyStrategy
+	timeouts    map[string]time.Duration
+}
+
+const conversationSweepInterval = 30 * time.Second
+
+func NewConversationStorage(store Store, strategy conversation.KeyStrategy, timeouts map[string]time.Duration) *ConversationStorage {
+	return &ConversationStorage{
+		store:       store,
+		keyStrategy: strategy,
+		timeouts:    timeouts,
+	}
+}
+
+func (s *ConversationStorage) Get(c *ext.Context) (*conversation.State, error) {
+	key, err := conversation.StateKey(c, s.keyStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	conv, err := s.store.GetConversation(requestContext(c), key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, conversation.ErrKeyNotFound
+		}
+		return nil, err
+	}
+
+	// Expired conversations are treated as over; the sweeper tidies them up.
+	if !conv.ExpiresAt.IsZero() && conv.ExpiresAt.Before(time.Now()) {
+		return nil, conversation.ErrKeyNotFound
+	}
+	return &conv.State, nil
+}
+
+func (s *ConversationStorage) Set(c *ext.Context, state conversation.State) error {
+	key, err := conversation.StateKey(c, s.keyStrategy)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	conv := Conversation{Key: key, State: state, UpdatedAt: now}
+	if timeout := s.timeouts[state.Key]; timeout > 0 {
+		conv.ExpiresAt = now.Add(timeout)
+	}
+
+	// Flows start from a button, whose message the bot turns into the prompt.
+	if c.CallbackQuery != nil && c.EffectiveMessage != nil {
+		conv.PromptChatID = c.EffectiveMessage.Chat.Id
+		conv.PromptMessageID = c.EffectiveMessage.MessageId
+	}
+
+	return s.store.SaveConversation(requestContext(c), conv)
+}
+
+func (s *ConversationStorage) Delete(c *ext.Context) error {
+	key, err := conversation.StateKey(c, s.keyStrategy)
+	if err != nil {
+		return err
+	}
+
+	return s.store.DeleteConversation(requestContext(c), key)
+}
+
+// expireConversations removes conversations past their deadline and edits
+// their prompt to tell the user. Each conversation is claimed by removing it,
+// so only one replica notifies the user.
+func (s *ConversationStorage) expireConversations(ctx context.Context, b *gotgbot.Bot) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		takeCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+		conv, err := s.store.TakeExpiredConversation(takeCtx, time.Now().UTC())
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to expire conversations: %v", err)
+			}
+			return
+		}
+		if conv == nil {
+			return
+		}
+
+		if conv.PromptMessageID == 0 {
+			continue
+		}
+
+		// Prompts are sent in private chats, whose ID is the user's.
+		lookupCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+		l := userLocale(lookupCtx, s.store, conv.PromptChatID)
+		cancel()
+
+		_, _, err = b.EditMessageText(l.T("conversation.expired"), &gotgbot.EditMessageTextOpts{
+			ChatId:      conv.PromptChatID,
+			MessageId:   conv.PromptMessageID,
+			ParseMode:   "HTML",
+			ReplyMarkup: menuMarkup(b, l, "back", conv.PromptChatID),
+		})
+		if err != nil {
+			log.Printf("Failed to edit expired prompt: %v", err)
+		}
+	}
+}
+
+// conversationSweeper expires idle conversations until ctx is cancelled.
+func (s *ConversationStorage) conversationSweeper(ctx context.Context, b *gotgbot.Bot) {
+	ticker := time.NewTicker(conversationSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expireConversations(ctx, b)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
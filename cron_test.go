@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 7",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	} {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := parseCron(expr); err == nil {
+				t.Errorf("parseCron(%q) succeeded, want an error", expr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(value string) time.Time {
+		t.Helper()
+		parsed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name, expr, from, want string
+	}{
+		{"step", "*/15 * * * *", "2024-01-01 10:07", "2024-01-01 10:15"},
+		{"strictly after", "0 9 * * *", "2024-01-01 09:00", "2024-01-02 09:00"},
+		{"list", "1,2,3 * * * *", "2024-01-01 10:02", "2024-01-01 10:03"},
+		{"range with step", "10-50/20 * * * *", "2024-01-01 10:31", "2024-01-01 10:50"},
+		{"value with step", "45/5 * * * *", "2024-01-01 10:56", "2024-01-01 11:45"},
+		{"day of month", "30 8 1 * *", "2024-01-15 00:00", "2024-02-01 08:30"},
+		{"sunday", "0 0 * * 0", "2024-01-03 00:00", "2024-01-07 00:00"},
+		{"weekdays", "0 0 * * 1-5", "2024-01-06 12:00", "2024-01-08 00:00"},
+		{"leap day", "0 12 29 2 *", "2024-03-01 00:00", "2028-02-29 12:00"},
+		{"either day, weekday first", "0 0 13 * 5", "2024-01-01 00:00", "2024-01-05 00:00"},
+		{"either day, date first", "0 0 13 * 5", "2024-01-12 00:00", "2024-01-13 00:00"},
+		// Only an exact "*" leaves a day field unrestricted, so a stepped
+		// day of month still combines with the day of week.
+		{"stepped day of month", "0 0 */10 * 1", "2024-01-01 00:00", "2024-01-08 00:00"},
+		{"any day of month", "0 0 * * 1", "2024-01-02 00:00", "2024-01-08 00:00"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseCron(tc.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q) error = %v", tc.expr, err)
+			}
+			got, err := c.Next(at(tc.from))
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			if want := at(tc.want); !got.Equal(want) {
+				t.Errorf("Next(%s) = %s, want %s", tc.from, got.Format("2006-01-02 15:04"), tc.want)
+			}
+		})
+	}
+}
+
+func TestCronNextIsUTC(t *testing.T) {
+	c, err := parseCron("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 1, 1, 10, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	got, err := c.Next(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10:30 at UTC+2 is 08:30 UTC, before the 09:00 run.
+	if want := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC); !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
+
+func TestCronNextNeverMatches(t *testing.T) {
+	c, err := parseCron("0 0 31 4 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Errorf("Next() = %s, want an error", got)
+	}
+}
@@ -1,158 +1,483 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/conversation"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// User represents the structure of a user document in MongoDB
+// ErrNotFound is returned by Store lookups that match nothing.
+var ErrNotFound = errors.New("not found")
+
+// ErrAlreadyQueued is returned when the broadcast of a scheduled run was
+// queued before.
+var ErrAlreadyQueued = errors.New("broadcast already queued")
+
+// ErrBatchChanged is returned when a balance batch is not in a status it may
+// move from, because someone else already moved it on.
+var ErrBatchChanged = errors.New("batch can no longer be changed")
+
+// Store is the data layer used by the handlers and background workers.
+// MongoStore is used in production and MemoryStore keeps everything in
+// process memory for local runs and tests.
+type Store interface {
+	UserStore
+	ReferralStore
+	LedgerStore
+	WithdrawalStore
+	BroadcastStore
+	ScheduleStore
+	BalanceBatchStore
+	MessageTemplateStore
+	ConversationStore
+	BackupStore
+
+	// Close releases the connection to the database.
+	Close(ctx context.Context) error
+}
+
+// UserStore manages users and their balances.
+type UserStore interface {
+	// AddUser registers a new user. Registering an existing user is an error.
+	AddUser(ctx context.Context, user User) error
+	// GetUser returns ErrNotFound for unregistered users.
+	GetUser(ctx context.Context, userID int64) (*User, error)
+	// UpdateUserProfile refreshes the Telegram metadata of a registered user,
+	// marks them seen and reactivates them. Unregistered users are left alone
+	// and yield ErrNotFound; registration happens in /start.
+	UpdateUserProfile(ctx context.Context, profile User) (*User, error)
+	// SearchUsers finds users by exact ID, username prefix or first name prefix.
+	SearchUsers(ctx context.Context, query string, limit int64) ([]User, error)
+	SetUserBanned(ctx context.Context, userID int64, banned bool) error
+	UpdateUserAccNo(ctx context.Context, userID int64, accNo int64) error
+	// SetUserLanguage stores the interface language picked with /language.
+	// An empty language follows the user's Telegram language again.
+	SetUserLanguage(ctx context.Context, userID int64, language string) error
+	// UpdateUserBalance returns ErrNotFound for unregistered users.
+	UpdateUserBalance(ctx context.Context, userID int64, amount float64) error
+	// RemoveBalance debits amount and returns the new balance. The balance
+	// never goes negative; an insufficient balance is an error.
+	RemoveBalance(ctx context.Context, userID int64, amount float64) (float64, error)
+	// MarkUserInactive flags a user the bot can no longer reach.
+	MarkUserInactive(ctx context.Context, userID int64, reason string) error
+	CountUsers(ctx context.Context) (int64, error)
+	CountActiveUsers(ctx context.Context, since time.Time) (int64, error)
+	// CountInactiveUsers returns the number of inactive users per reason.
+	CountInactiveUsers(ctx context.Context) (map[string]int64, error)
+	GetTopReferrers(ctx context.Context, limit int64) ([]User, error)
+	// CountReachableUsers returns the number of users matching segment that
+	// broadcasts can reach: neither inactive nor banned.
+	CountReachableUsers(ctx context.Context, segment *Segment) (int64, error)
+	// GetUserIDsAfter returns up to limit reachable user IDs greater than
+	// after that match segment, in ascending order.
+	GetUserIDsAfter(ctx context.Context, after int64, limit int64, segment *Segment) ([]int64, error)
+	// EachUser streams the users who joined in [from, before) to fn, ordered
+	// by ID. A zero time leaves that end of the range open.
+	EachUser(ctx context.Context, from, before time.Time, fn func(User) error) error
+}
+
+// ReferralStore manages the edges between referrers and the users they invited.
+type ReferralStore interface {
+	// ReferUser registers user as invited by referrerID, who must exist.
+	// The reward stays pending until MarkReferralRewarded.
+	ReferUser(ctx context.Context, referrerID int64, user User) error
+	// GetReferredUsers returns up to limit users referred by referrerID, ordered
+	// by ID. The page starts after cursor, or ends before it when backward is
+	// set. The boolean reports whether more users exist beyond the page in
+	// that direction.
+	GetReferredUsers(ctx context.Context, referrerID, cursor int64, backward bool, limit int64) ([]User, bool, error)
+	CountReferredUsers(ctx context.Context, referrerID int64) (int64, error)
+	// MarkReferralRewarded clears the pending flag once the referrer has been paid.
+	MarkReferralRewarded(ctx context.Context, userID int64) error
+}
+
+// LedgerStore records every change to a balance.
+type LedgerStore interface {
+	AddLedgerEntry(ctx context.Context, entry LedgerEntry) error
+	// ApplyLedgerEntry changes the balance of entry.UserID by entry.Amount and
+	// records entry, both or neither. It returns ErrNotFound for unregistered
+	// users and fails rather than take a balance below zero.
+	ApplyLedgerEntry(ctx context.Context, entry LedgerEntry) error
+	// GetLedgerEntries returns the newest entries of a user first.
+	GetLedgerEntries(ctx context.Context, userID int64, limit int64) ([]LedgerEntry, error)
+	GetLedgerSummary(ctx context.Context, userID int64) (*LedgerSummary, error)
+	// EachLedgerEntry streams the entries created in [from, before) to fn,
+	// oldest first. A zero time leaves that end of the range open.
+	EachLedgerEntry(ctx context.Context, from, before time.Time, fn func(LedgerEntry) error) error
+	// EachBatchLedgerEntry streams the entries recorded under a balance
+	// batch to fn, oldest first.
+	EachBatchLedgerEntry(ctx context.Context, batch primitive.ObjectID, fn func(LedgerEntry) error) error
+	// ApplyBatchEntry changes the balance of entry.UserID by entry.Amount and
+	// records entry, both or neither. An entry is applied once per batch, row
+	// and kind; it reports false for one applied before, so an interrupted
+	// batch can be run again from the start.
+	ApplyBatchEntry(ctx context.Context, entry LedgerEntry) (bool, error)
+}
+
+// WithdrawalStore manages withdrawal requests.
+type WithdrawalStore interface {
+	// AddWithdrawal stores a pending withdrawal and returns its ID.
+	AddWithdrawal(ctx context.Context, w Withdrawal) (primitive.ObjectID, error)
+	// ApproveWithdrawal marks a pending withdrawal approved and returns it.
+	// Approving an already approved withdrawal is an error so the user is paid once.
+	ApproveWithdrawal(ctx context.Context, id primitive.ObjectID) (*Withdrawal, error)
+	// GetWithdrawals returns the newest withdrawals of a user and their total count.
+	GetWithdrawals(ctx context.Context, userID int64, limit int64) ([]Withdrawal, int64, error)
+	// EachWithdrawal streams the withdrawals requested in [from, before) to
+	// fn, oldest first. A zero time leaves that end of the range open.
+	EachWithdrawal(ctx context.Context, from, before time.Time, fn func(Withdrawal) error) error
+}
+
+// BroadcastStore persists broadcast jobs, their deliveries and failures.
+type BroadcastStore interface {
+	// AddBroadcast stores a job, queued unless it has a status, and returns its ID.
+	// A scheduled run is queued once; adding it again returns ErrAlreadyQueued.
+	AddBroadcast(ctx context.Context, job Broadcast) (primitive.ObjectID, error)
+	// GetBroadcast returns ErrNotFound for unknown jobs.
+	GetBroadcast(ctx context.Context, id primitive.ObjectID) (*Broadcast, error)
+	// ClaimBroadcast leases the oldest unfinished broadcast whose lease has
+	// expired to worker, so only one instance processes a job at a time.
+	// It returns nil when there is nothing to do.
+	ClaimBroadcast(ctx context.Context, worker string, lease time.Duration) (*Broadcast, error)
+	// CheckpointBroadcast saves progress, renews the lease and returns the
+	// job's current status so the worker notices pauses and cancellations.
+	// An empty status means the job is no longer leased to worker.
+	CheckpointBroadcast(ctx context.Context, job *Broadcast, worker string, lease time.Duration) (string, error)
+	// FinishBroadcast stores the final counters and marks the job done or cancelled.
+	FinishBroadcast(ctx context.Context, job *Broadcast, status string) error
+	// SetBroadcastStatus moves a job from one of the given statuses to status
+	// and returns the job as it was before the change.
+	SetBroadcastStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*Broadcast, error)
+	// SetBroadcastOptions updates the delivery options of a draft broadcast
+	// and returns the updated job.
+	SetBroadcastOptions(ctx context.Context, id primitive.ObjectID, opts BroadcastOptions) (*Broadcast, error)
+	AddBroadcastFailure(ctx context.Context, f BroadcastFailure) error
+	// EachBroadcastFailure streams the failures of a broadcast to fn, ordered by user ID.
+	EachBroadcastFailure(ctx context.Context, id primitive.ObjectID, fn func(BroadcastFailure) error) error
+	AddBroadcastDeliveries(ctx context.Context, deliveries []BroadcastDelivery) error
+	// EachBroadcastDelivery streams the deliveries of a broadcast to fn.
+	EachBroadcastDelivery(ctx context.Context, id primitive.ObjectID, fn func(BroadcastDelivery) error) error
+	DeleteBroadcastDeliveries(ctx context.Context, id primitive.ObjectID) error
+}
+
+// ScheduleStore persists scheduled broadcasts.
+type ScheduleStore interface {
+	AddSchedule(ctx context.Context, sch Schedule) (primitive.ObjectID, error)
+	// GetActiveSchedules returns the active schedules, soonest first.
+	GetActiveSchedules(ctx context.Context) ([]Schedule, error)
+	GetDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error)
+	// GetSchedule returns an active schedule, or ErrNotFound.
+	GetSchedule(ctx context.Context, id primitive.ObjectID) (*Schedule, error)
+	// AdvanceSchedule moves a due schedule to its next run, or deactivates it
+	// when next is zero, and records sch.CurrentRun and the failures of the
+	// current run. It only succeeds if NextRun is unchanged since sch was
+	// read, so when several instances race for the same run exactly one of
+	// them wins.
+	AdvanceSchedule(ctx context.Context, sch *Schedule, next time.Time, failures int, lastError string) (bool, error)
+	// SetScheduleOptions updates the delivery options of an active schedule
+	// and returns it.
+	SetScheduleOptions(ctx context.Context, id primitive.ObjectID, opts BroadcastOptions) (*Schedule, error)
+	UpdateSchedule(ctx context.Context, id primitive.ObjectID, cron string, next time.Time, segment string) error
+	CancelSchedule(ctx context.Context, id primitive.ObjectID) error
+}
+
+// BalanceBatchStore persists bulk balance changes, see batch.go.
+type BalanceBatchStore interface {
+	// AddBalanceBatch stores a pending batch and returns its ID.
+	AddBalanceBatch(ctx context.Context, batch BalanceBatch) (primitive.ObjectID, error)
+	// GetBalanceBatch returns ErrNotFound for unknown batches.
+	GetBalanceBatch(ctx context.Context, id primitive.ObjectID) (*BalanceBatch, error)
+	// SetBalanceBatchStatus moves a batch from one of the given statuses to
+	// status and returns the batch as it was before the change, so only one
+	// caller gets to apply or reverse it. It returns ErrBatchChanged when the
+	// batch is in none of them.
+	SetBalanceBatchStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*BalanceBatch, error)
+	// GetBalanceBatchesByStatus returns the batches in any of statuses,
+	// oldest first.
+	GetBalanceBatchesByStatus(ctx context.Context, statuses []string) ([]BalanceBatch, error)
+}
+
+// MessageTemplateStore persists the owner's edits of message templates, see
+// templates.go.
+type MessageTemplateStore interface {
+	// GetMessageTemplate returns ErrNotFound when the message of language has
+	// not been edited.
+	GetMessageTemplate(ctx context.Context, message, language string) (*MessageTemplate, error)
+	// GetMessageTemplates returns every edited message, ordered by ID.
+	GetMessageTemplates(ctx context.Context) ([]MessageTemplate, error)
+	// SetMessageTemplate creates or replaces the edit of a message.
+	SetMessageTemplate(ctx context.Context, tmpl MessageTemplate) error
+	// DeleteMessageTemplate restores the default of a message. It returns
+	// ErrNotFound when the message has not been edited.
+	DeleteMessageTemplate(ctx context.Context, message, language string) error
+}
+
+// ConversationStore persists the state of in-progress conversations.
+type ConversationStore interface {
+	// GetConversation returns ErrNotFound when there is no conversation for key.
+	GetConversation(ctx context.Context, key string) (*Conversation, error)
+	// SaveConversation creates or replaces a conversation. A zero prompt keeps
+	// the prompt already stored.
+	SaveConversation(ctx context.Context, conv Conversation) error
+	DeleteConversation(ctx context.Context, key string) error
+	// TakeExpiredConversation removes and returns one conversation that expired
+	// before now, or nil when there is none. Only one caller gets each one.
+	TakeExpiredConversation(ctx context.Context, now time.Time) (*Conversation, error)
+}
+
+// BackupStore copies every record in and out of the store, see backup.go.
+// Records are pointers to the type of their collection in backupCollections.
+type BackupStore interface {
+	// ExportRecords streams every record of collection to fn.
+	ExportRecords(ctx context.Context, collection string, fn func(record any) error) error
+	// ImportRecords writes the records next returns until io.EOF, replacing
+	// records with the same identity and keeping the others. The SQL stores
+	// import them in one transaction.
+	ImportRecords(ctx context.Context, next func() (collection string, record any, err error)) error
+}
+
+// User is a registered user of the bot.
 type User struct {
 	ID            int64   `bson:"_id,omitempty" json:"_id,omitempty"`
 	Referrer      int64   `bson:"referrer,omitempty" json:"referrer,omitempty"`
-	ReferredUsers []int64 `bson:"referred_users,omitempty" json:"referred_users,omitempty"`
+	ReferralCount int64   `bson:"referral_count,omitempty" json:"referral_count,omitempty"`
 	AccNo         int64   `bson:"acc_no,omitempty" json:"acc_no,omitempty"`
 	Balance       float64 `bson:"balance,omitempty" json:"balance,omitempty"`
+	FirstName     string  `bson:"first_name,omitempty" json:"first_name,omitempty"`
+	Username      string  `bson:"username,omitempty" json:"username,omitempty"`
+	LanguageCode  string  `bson:"language_code,omitempty" json:"language_code,omitempty"`
+	// Language is the interface language picked by the user, overriding LanguageCode.
+	Language  string    `bson:"language,omitempty" json:"language,omitempty"`
+	IsPremium bool      `bson:"is_premium,omitempty" json:"is_premium,omitempty"`
+	JoinedAt  time.Time `bson:"joined_at,omitempty" json:"joined_at,omitempty"`
+	LastSeen  time.Time `bson:"last_seen,omitempty" json:"last_seen,omitempty"`
+	// RewardPending is set while the referrer has not yet been credited for this user.
+	RewardPending bool `bson:"reward_pending,omitempty" json:"reward_pending,omitempty"`
+	Banned        bool `bson:"banned,omitempty" json:"banned,omitempty"`
+	// Inactive users blocked the bot or deleted their account and are skipped by broadcasts.
+	Inactive       bool      `bson:"inactive,omitempty" json:"inactive,omitempty"`
+	InactiveSince  time.Time `bson:"inactive_since,omitempty" json:"inactive_since,omitempty"`
+	InactiveReason string    `bson:"inactive_reason,omitempty" json:"inactive_reason,omitempty"`
+}
+
+// effectiveLanguage is the language picked with /language, else the
+// Telegram language code. Language segments match on it.
+func (u *User) effectiveLanguage() string {
+	if u.Language != "" {
+		return u.Language
+	}
+	return u.LanguageCode
 }
 
-var userColl *mongo.Collection
+// Ledger entry kinds.
+const (
+	LedgerReferral   = "referral"
+	LedgerAdjustment = "adjustment"
+	LedgerWithdrawal = "withdrawal"
+	LedgerReversal   = "reversal"
+)
 
-func addUser(user User) error {
-	filter := bson.M{"$or": []bson.M{
-		{"_id": user.ID},
-	}}
+// LedgerEntry records a single change to a user's balance. Batch is set on
+// the entries of a balance batch and its reversal, and Row to the 1-based
+// number of the batch row they apply or reverse.
+type LedgerEntry struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID    int64              `bson:"user_id" json:"user_id"`
+	Amount    float64            `bson:"amount" json:"amount"`
+	Kind      string             `bson:"kind" json:"kind"`
+	Actor     int64              `bson:"actor,omitempty" json:"actor,omitempty"`
+	Batch     primitive.ObjectID `bson:"batch,omitempty" json:"batch,omitempty"`
+	Row       int                `bson:"row,omitempty" json:"row,omitempty"`
+	Reason    string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
 
-	count, err := userColl.CountDocuments(ctx, filter)
-	if err != nil {
-		return fmt.Errorf("failed to check user existence: %v", err)
-	}
+// LedgerSummary aggregates a user's ledger entries.
+type LedgerSummary struct {
+	Credits float64 `bson:"credits"`
+	Debits  float64 `bson:"debits"`
+	Entries int64   `bson:"entries"`
+}
 
-	if count > 0 {
-		return fmt.Errorf("user with ID %d already exists", user.ID)
-	}
+// Withdrawal statuses.
+const (
+	WithdrawalPending  = "pending"
+	WithdrawalApproved = "approved"
+)
 
-	_, err = userColl.InsertOne(ctx, user)
-	if err != nil {
-		return fmt.Errorf("failed to add user: %v", err)
-	}
+// Withdrawal is a user's request to cash out part of their balance.
+type Withdrawal struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID      int64              `bson:"user_id" json:"user_id"`
+	Amount      float64            `bson:"amount" json:"amount"`
+	AccNo       int64              `bson:"acc_no" json:"acc_no"`
+	Status      string             `bson:"status" json:"status"`
+	RequestedAt time.Time          `bson:"requested_at" json:"requested_at"`
+	ApprovedAt  time.Time          `bson:"approved_at,omitempty" json:"approved_at,omitempty"`
+}
 
-	return nil
+// Referral is an edge from a referrer to a user they invited. Referrals live in
+// their own collection so a referrer's document does not grow with every invite.
+// CreatedAt is zero for referrals migrated from before their time was kept.
+type Referral struct {
+	Referrer  int64     `bson:"referrer" json:"referrer"`
+	Referee   int64     `bson:"referee" json:"referee"`
+	CreatedAt time.Time `bson:"created_at,omitempty" json:"created_at,omitempty"`
 }
 
-func referUser(referrerID, newUserID int64) error {
-	// Check if referrer exists
-	referrer := User{}
-	err := userColl.FindOne(ctx, bson.M{"_id": referrerID}).Decode(&referrer)
-	if err != nil {
-		return fmt.Errorf("referrer with ID %d does not exist", referrerID)
-	}
+// Broadcast statuses.
+const (
+	BroadcastDraft     = "draft"
+	BroadcastQueued    = "queued"
+	BroadcastRunning   = "running"
+	BroadcastPaused    = "paused"
+	BroadcastDone      = "done"
+	BroadcastCancelled = "cancelled"
+)
 
-	newUser := User{
-		ID:       newUserID,
-		Referrer: referrerID,
-		Balance:  0,
-	}
+// Broadcast is a persisted broadcast job. Cursor is the last user ID the job
+// has been checkpointed past, so a restarted worker resumes from there.
+type Broadcast struct {
+	ID          primitive.ObjectID            `bson:"_id,omitempty" json:"_id,omitempty"`
+	FromChatID  int64                         `bson:"from_chat_id" json:"from_chat_id"`
+	MessageID   int64                         `bson:"message_id" json:"message_id"`
+	ReplyMarkup *gotgbot.InlineKeyboardMarkup `bson:"reply_markup,omitempty" json:"reply_markup,omitempty"`
+	CreatedBy   int64                         `bson:"created_by" json:"created_by"`
+	// ScheduleID and ScheduleRun identify the scheduled run that queued the
+	// broadcast, if any.
+	ScheduleID  primitive.ObjectID `bson:"schedule_id,omitempty" json:"schedule_id,omitempty"`
+	ScheduleRun time.Time          `bson:"schedule_run,omitempty" json:"schedule_run,omitempty"`
+	// Segment is the targeting query, see parseSegment. Empty targets everyone.
+	Segment          string `bson:"segment,omitempty" json:"segment,omitempty"`
+	BroadcastOptions `bson:",inline"`
+	Status           string `bson:"status" json:"status"`
+	Cursor           int64  `bson:"cursor" json:"cursor"`
+	Total            int64  `bson:"total" json:"total"`
+	Sent             int64  `bson:"sent" json:"sent"`
+	Failed           int64  `bson:"failed" json:"failed"`
+	// Errors counts failed deliveries by error kind, see classifyError.
+	Errors map[string]int64 `bson:"errors,omitempty" json:"errors,omitempty"`
+	// ProgressChatID and ProgressMessageID locate the message edited with live progress.
+	ProgressChatID    int64     `bson:"progress_chat_id" json:"progress_chat_id"`
+	ProgressMessageID int64     `bson:"progress_message_id" json:"progress_message_id"`
+	Worker            string    `bson:"worker,omitempty" json:"worker,omitempty"`
+	LeaseUntil        time.Time `bson:"lease_until" json:"lease_until"`
+	CreatedAt         time.Time `bson:"created_at" json:"created_at"`
+	FinishedAt        time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
 
-	err = addUser(newUser)
-	if err != nil {
-		return err
-	}
+// BroadcastOptions control how a broadcast is delivered.
+type BroadcastOptions struct {
+	// Forward sends the message with attribution instead of copying it.
+	Forward bool `bson:"forward,omitempty" json:"forward,omitempty"`
+	// Silent disables the notification, Pin pins the delivered message in each
+	// chat and Protect stops recipients from forwarding or saving it.
+	Silent  bool `bson:"silent,omitempty" json:"silent,omitempty"`
+	Pin     bool `bson:"pin,omitempty" json:"pin,omitempty"`
+	Protect bool `bson:"protect,omitempty" json:"protect,omitempty"`
+}
 
-	_, err = userColl.UpdateOne(ctx, bson.M{"_id": referrerID}, bson.M{"$push": bson.M{"referred_users": newUserID}})
-	if err != nil {
-		return fmt.Errorf("failed to update referrer's referred users: %v", err)
-	}
-	return nil
+// BroadcastDelivery records the message a broadcast left in a user's chat,
+// so the broadcast can later be edited or deleted everywhere.
+type BroadcastDelivery struct {
+	BroadcastID primitive.ObjectID `bson:"broadcast_id" json:"broadcast_id"`
+	UserID      int64              `bson:"user_id" json:"user_id"`
+	MessageID   int64              `bson:"message_id" json:"message_id"`
 }
 
-func getUser(userID int64) (*User, error) {
-	user := User{}
-	err := userColl.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
-	if err != nil {
-		return nil, err
-	}
-	return &user, nil
-}
-
-// // Retrieve all users referred by a specific user
-// func getReferredUsers(referrerID int64) ([]User, error) {
-// 	// Fetch the referrer's referred_users list
-// 	referrer, err := getUser(referrerID)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	// Fetch details of all referred users
-// 	filter := bson.M{"_id": bson.M{"$in": referrer.ReferredUsers}}
-// 	cursor, err := userColl.Find(ctx, filter)
-// 	if err != nil {
-// 		return nil, fmt.Errorf("failed to retrieve referred users: %v", err)
-// 	}
-// 	defer cursor.Close(ctx)
-
-// 	var referredUsers []User
-// 	if err = cursor.All(ctx, &referredUsers); err != nil {
-// 		return nil, fmt.Errorf("failed to decode referred users: %v", err)
-// 	}
-// 	return referredUsers, nil
-// }
-
-func updateUserBalance(userID int64, amount float64) error {
-	_, err := userColl.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$inc": bson.M{"balance": amount}})
-	if err != nil {
-		return fmt.Errorf("failed to update balance for user %d: %v", userID, err)
-	}
-	return nil
+// BroadcastFailure records one undelivered broadcast message for the CSV report.
+type BroadcastFailure struct {
+	BroadcastID primitive.ObjectID `bson:"broadcast_id" json:"broadcast_id"`
+	UserID      int64              `bson:"user_id" json:"user_id"`
+	Kind        string             `bson:"kind" json:"kind"`
+	Description string             `bson:"description" json:"description"`
+	At          time.Time          `bson:"at" json:"at"`
 }
 
-func removeBalance(userID int64, amount float64) (float64, error) {
-	if amount <= 0 {
-		return 0, fmt.Errorf("amount to remove must be greater than zero")
-	}
+// Schedule is a broadcast that is queued at NextRun, once or on a cron schedule.
+type Schedule struct {
+	ID          primitive.ObjectID            `bson:"_id,omitempty" json:"_id,omitempty"`
+	FromChatID  int64                         `bson:"from_chat_id" json:"from_chat_id"`
+	MessageID   int64                         `bson:"message_id" json:"message_id"`
+	ReplyMarkup *gotgbot.InlineKeyboardMarkup `bson:"reply_markup,omitempty" json:"reply_markup,omitempty"`
+	Segment     string                        `bson:"segment,omitempty" json:"segment,omitempty"`
+	// BroadcastOptions are copied to every broadcast the schedule queues.
+	BroadcastOptions `bson:",inline"`
+	// Cron is empty for one-shot schedules.
+	Cron    string    `bson:"cron,omitempty" json:"cron,omitempty"`
+	NextRun time.Time `bson:"next_run" json:"next_run"`
+	LastRun time.Time `bson:"last_run,omitempty" json:"last_run,omitempty"`
+	// CurrentRun is the run being queued, kept from its first claim until it
+	// is queued or given up so that a run claimed again after a crash is
+	// recognized. It is zero between runs.
+	CurrentRun time.Time `bson:"current_run,omitempty" json:"current_run,omitempty"`
+	// Failures counts the failed attempts at the current run, which is
+	// retried until scheduleMaxFailures. LastError is the latest failure.
+	Failures  int       `bson:"failures,omitempty" json:"failures,omitempty"`
+	LastError string    `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	Active    bool      `bson:"active" json:"active"`
+	CreatedBy int64     `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
 
-	filter := bson.M{"_id": userID}
-	update := bson.M{"$inc": bson.M{"balance": -amount}}
-	options := options.FindOneAndUpdate().SetReturnDocument(options.After)
-	var updatedUser User
-	err := userColl.FindOneAndUpdate(ctx, filter, update, options).Decode(&updatedUser)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return 0, fmt.Errorf("user with ID %d does not exist", userID)
-		}
-		return 0, fmt.Errorf("failed to update balance: %v", err)
-	}
+// Balance batch statuses.
+const (
+	BatchPending   = "pending"
+	BatchApplying  = "applying"
+	BatchApplied   = "applied"
+	BatchCancelled = "cancelled"
+	BatchReverting = "reverting"
+	BatchReverted  = "reverted"
+)
 
-	if updatedUser.Balance < 0 {
-		_, rollbackErr := userColl.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"balance": amount}})
-		if rollbackErr != nil {
-			return 0, fmt.Errorf("balance went negative, rollback failed: %v", rollbackErr)
-		}
-		return 0, fmt.Errorf("insufficient balance for user %d", userID)
-	}
+// BalanceBatch is a set of balance changes uploaded as one CSV file. Its rows
+// are applied together and recorded in the ledger under its ID, so the whole
+// batch can be reversed later.
+type BalanceBatch struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	FileName  string             `bson:"file_name,omitempty" json:"file_name,omitempty"`
+	Rows      []BatchRow         `bson:"rows" json:"rows"`
+	Status    string             `bson:"status" json:"status"`
+	CreatedBy int64              `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
 
-	return updatedUser.Balance, nil
+// MessageTemplate is the owner's version of a catalog message in one language.
+type MessageTemplate struct {
+	// ID is "<language>:<message>", see messageTemplateID.
+	ID        string    `bson:"_id" json:"_id"`
+	Message   string    `bson:"message" json:"message"`
+	Language  string    `bson:"language" json:"language"`
+	Text      string    `bson:"text" json:"text"`
+	UpdatedBy int64     `bson:"updated_by" json:"updated_by"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
 }
 
-func updateUserAccNo(userID int64, accNo int64) error {
-	_, err := userColl.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"acc_no": accNo}})
-	if err != nil {
-		return fmt.Errorf("failed to update acc_no for user %d: %v", userID, err)
-	}
-	return nil
+// messageTemplateID returns the ID of the edit of message in language.
+func messageTemplateID(message, language string) string {
+	return language + ":" + message
 }
 
-func getAllUsers() ([]User, error) {
-	cursor, err := userColl.Find(ctx, bson.M{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve users: %v", err)
-	}
-	defer cursor.Close(ctx)
+// BatchRow is one line of a balance batch.
+type BatchRow struct {
+	UserID int64   `bson:"user_id" json:"user_id"`
+	Amount float64 `bson:"amount" json:"amount"`
+	Reason string  `bson:"reason" json:"reason"`
+}
 
-	var users []User
-	if err = cursor.All(ctx, &users); err != nil {
-		return nil, fmt.Errorf("failed to decode users: %v", err)
-	}
-	return users, nil
+// Conversation is the stored form of a conversation. The whole State is kept
+// as gotgbot may add fields to it.
+type Conversation struct {
+	Key       string             `bson:"_id"`
+	State     conversation.State `bson:"state"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+	ExpiresAt time.Time          `bson:"expires_at,omitempty"`
+	// PromptChatID and PromptMessageID locate the bot message that asked the
+	// question, which is edited when the conversation expires.
+	PromptChatID    int64 `bson:"prompt_chat_id,omitempty"`
+	PromptMessageID int64 `bson:"prompt_message_id,omitempty"`
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const exportUsage = `Usage: <code>/export &lt;users|ledger|withdrawals&gt; [csv|json] [from..to]</code>
+Dates are <code>YYYY-MM-DD</code>, either end is optional: <code>/export ledger 2024-01-01..2024-01-31</code>`
+
+// exportDataset is a collection /export can stream. Only the Columns are
+// exported, so nothing else about a record can leak into a file.
+type exportDataset struct {
+	// Perm is what the caller needs to export the dataset.
+	Perm    Permission
+	Columns []string
+	// Sensitive columns are left out for callers without their permission.
+	Sensitive map[string]Permission
+	// Each streams the values of the Columns of every record in [from, before).
+	Each func(ctx context.Context, s Store, from, before time.Time, row func(values ...any) error) error
+}
+
+var exportDatasets = map[string]exportDataset{
+	"users": {
+		Perm: PermViewUsers,
+		Columns: []string{"id", "username", "first_name", "language_code", "language", "referrer", "referral_count",
+			"balance", "acc_no", "joined_at", "last_seen", "banned", "inactive", "inactive_reason"},
+		Sensitive: map[string]Permission{"balance": PermViewPayouts, "acc_no": PermViewPayouts},
+		Each: func(ctx context.Context, s Store, from, before time.Time, row func(values ...any) error) error {
+			return s.EachUser(ctx, from, before, func(u User) error {
+				return row(u.ID, u.Username, u.FirstName, u.LanguageCode, u.Language, u.Referrer, u.ReferralCount,
+					u.Balance, u.AccNo, u.JoinedAt, u.LastSeen, u.Banned, u.Inactive, u.InactiveReason)
+			})
+		},
+	},
+	"ledger": {
+		Perm:    PermViewLedger,
+		Columns: []string{"id", "user_id", "amount", "kind", "actor", "created_at"},
+		Each: func(ctx context.Context, s Store, from, before time.Time, row func(values ...any) error) error {
+			return s.EachLedgerEntry(ctx, from, before, func(e LedgerEntry) error {
+				return row(e.ID, e.UserID, e.Amount, e.Kind, e.Actor, e.CreatedAt)
+			})
+		},
+	},
+	"withdrawals": {
+		Perm:    PermViewWithdrawals,
+		Columns: []string{"id", "user_id", "amount", "acc_no", "status", "requested_at", "approved_at"},
+		Each: func(ctx context.Context, s Store, from, before time.Time, row func(values ...any) error) error {
+			return s.EachWithdrawal(ctx, from, before, func(w Withdrawal) error {
+				return row(w.ID, w.UserID, w.Amount, w.AccNo, w.Status, w.RequestedAt, w.ApprovedAt)
+			})
+		},
+	},
+}
+
+// columnsFor returns the columns userID may export and the index of each
+// in Columns.
+func (d exportDataset) columnsFor(userID int64) ([]string, []int) {
+	var columns []string
+	var indexes []int
+	for i, column := range d.Columns {
+		if perm, ok := d.Sensitive[column]; ok && !can(userID, perm) {
+			continue
+		}
+		columns = append(columns, column)
+		indexes = append(indexes, i)
+	}
+	return columns, indexes
+}
+
+// exportWriter writes the rows of an export in one file format.
+type exportWriter interface {
+	Write(values []any) error
+	Flush() error
+}
+
+// csvExportWriter writes CSV with a header row.
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer, columns []string) (*csvExportWriter, error) {
+	cw := csv.NewWriter(w)
+	return &csvExportWriter{w: cw}, cw.Write(columns)
+}
+
+func (c *csvExportWriter) Write(values []any) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			// Spreadsheets run cells that start like a formula.
+			if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+				v = "'" + v
+			}
+			record[i] = v
+		case int64:
+			record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			record[i] = strconv.FormatBool(v)
+		case time.Time:
+			if !v.IsZero() {
+				record[i] = v.UTC().Format(time.RFC3339)
+			}
+		case primitive.ObjectID:
+			if !v.IsZero() {
+				record[i] = v.Hex()
+			}
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvExportWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonExportWriter writes one JSON object per line, keyed by column.
+type jsonExportWriter struct {
+	w       *bufio.Writer
+	columns []string
+}
+
+func (j *jsonExportWriter) Write(values []any) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(j.columns[i])
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		switch t := v.(type) {
+		case time.Time:
+			if t.IsZero() {
+				v = nil
+			} else {
+				v = t.UTC().Format(time.RFC3339)
+			}
+		case primitive.ObjectID:
+			if t.IsZero() {
+				v = nil
+			} else {
+				v = t.Hex()
+			}
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	_, err := j.w.Write(buf.Bytes())
+	return err
+}
+
+func (j *jsonExportWriter) Flush() error {
+	return j.w.Flush()
+}
+
+// describeRange renders [from, before) as the dates the caller typed.
+func describeRange(from, before time.Time) string {
+	start, end := "…", "…"
+	if !from.IsZero() {
+		start = from.Format("2006-01-02")
+	}
+	if !before.IsZero() {
+		end = before.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	if from.IsZero() && before.IsZero() {
+		return "all time"
+	}
+	return start + " – " + end
+}
+
+// export handles /export <users|ledger|withdrawals> [csv|json] [from..to],
+// streaming the records into a document in the caller's private chat.
+func (a *App) export(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	if msg.Chat.Type != "private" {
+		return nil
+	}
+
+	if roleOf(user.Id) == RoleUser {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	args := ctx.Args()[1:]
+	if len(args) == 0 {
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\n"+exportUsage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	name := strings.ToLower(args[0])
+	dataset, ok := exportDatasets[name]
+	if !ok {
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\n"+exportUsage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+	if !can(user.Id, dataset.Perm) {
+		_, _ = msg.Reply(b, "❌ You are not authorized to export "+name+".", nil)
+		return nil
+	}
+
+	format := "csv"
+	var from, before time.Time
+	for _, arg := range args[1:] {
+		switch arg = strings.ToLower(arg); arg {
+		case "csv", "json":
+			format = arg
+		default:
+			var err error
+			if from, before, err = parseDateRange(arg); err != nil {
+				_, _ = msg.Reply(b, "❌ "+html.EscapeString(fmt.Sprintf("%v: %s", err, arg))+"\n\n"+exportUsage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+				return nil
+			}
+		}
+	}
+
+	progress, err := msg.Reply(b, fmt.Sprintf("📤 <b>Exporting %s...</b>", name), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	if err != nil {
+		return err
+	}
+
+	a.goJob(func() {
+		rows, err := a.sendExport(b, msg.Chat.Id, user.Id, name, dataset, format, from, before)
+		if err != nil {
+			log.Printf("Export of %s for %d failed: %v", name, user.Id, err)
+			_, _, _ = progress.EditText(b, "❌ <b>Export failed:</b> "+html.EscapeString(err.Error()), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+			return
+		}
+		_, _, _ = progress.EditText(b, fmt.Sprintf("✅ <b>Exported %d %s.</b>", rows, name), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+	})
+	return nil
+}
+
+// sendExport streams the columns of a dataset userID may see into a document
+// without holding it in memory and returns the number of rows sent.
+func (a *App) sendExport(b *gotgbot.Bot, chatID, userID int64, name string, dataset exportDataset, format string, from, before time.Time) (int64, error) {
+	pr, pw := io.Pipe()
+	count := make(chan int64, 1)
+	columns, indexes := dataset.columnsFor(userID)
+	go func() {
+		var (
+			rows int64
+			w    exportWriter
+			err  error
+		)
+		bw := bufio.NewWriter(pw)
+		if format == "json" {
+			w = &jsonExportWriter{w: bw, columns: columns}
+		} else {
+			w, err = newCSVExportWriter(bw, columns)
+		}
+		if err == nil {
+			kept := make([]any, len(indexes))
+			err = dataset.Each(a.base, a.store, from, before, func(values ...any) error {
+				for i, index := range indexes {
+					kept[i] = values[index]
+				}
+				rows++
+				return w.Write(kept)
+			})
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		count <- rows
+		_ = pw.CloseWithError(err)
+	}()
+	// An empty NDJSON file can't be sent, so look before uploading.
+	body := bufio.NewReader(pr)
+	if _, err := body.Peek(1); err == io.EOF {
+		return 0, fmt.Errorf("no %s found (%s)", name, describeRange(from, before))
+	} else if err != nil {
+		return 0, err
+	}
+
+	extension := format
+	if format == "json" {
+		extension = "ndjson"
+	}
+	fileName := fmt.Sprintf("%s-%s.%s", name, time.Now().UTC().Format("20060102-150405"), extension)
+	_, err := b.SendDocument(chatID, gotgbot.InputFileByReader(fileName, body), &gotgbot.SendDocumentOpts{
+		Caption: fmt.Sprintf("📤 Export of %s, %s", name, describeRange(from, before)),
+	})
+	// Unblock the writer if the upload stopped early.
+	_ = pr.Close()
+	rows := <-count
+	if err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
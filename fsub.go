@@ -19,16 +19,16 @@ var (
 	}
 )
 
-func retryMarkup(b *gotgbot.Bot, args, link string) *gotgbot.InlineKeyboardMarkup {
+func retryMarkup(b *gotgbot.Bot, l *Locale, args, link string) *gotgbot.InlineKeyboardMarkup {
 	buttons := [][]gotgbot.InlineKeyboardButton{
 		{
-			{Text: "Jᴏɪɴ", Url: link},
+			{Text: l.T("fsub.join"), Url: link},
 		},
 	}
 
 	if args != "" {
 		buttons = append(buttons, []gotgbot.InlineKeyboardButton{
-			{Text: "Tʀʏ ᴀɢᴀɪɴ", Url: fmt.Sprintf("https://t.me/%s?start=%s", b.Username, args)},
+			{Text: l.T("fsub.retry"), Url: fmt.Sprintf("https://t.me/%s?start=%s", b.Username, args)},
 		})
 	}
 
@@ -62,7 +62,7 @@ func fetchInviteLink(b *gotgbot.Bot, chatID int64) (string, error) {
 	return chat.InviteLink, nil
 }
 
-func fSub(b *gotgbot.Bot, userId int64, arg string) (bool, error) {
+func fSub(b *gotgbot.Bot, l *Locale, userId int64, arg string) (bool, error) {
 	chats := FSubIds
 	if len(chats) == 0 {
 		log.Print("FSub IDs not set")
@@ -82,9 +82,10 @@ func fSub(b *gotgbot.Bot, userId int64, arg string) (bool, error) {
 				return false, fmt.Errorf("invite link not available")
 			}
 
-			btn := retryMarkup(b, arg, inviteLink)
-			_, err = b.SendMessage(userId, "❌ You must be a member of the channel to use this bot.\nPlease join the channel and try again.", &gotgbot.SendMessageOpts{
+			btn := retryMarkup(b, l, arg, inviteLink)
+			_, err = b.SendMessage(userId, l.T("fsub.required"), &gotgbot.SendMessageOpts{
 				ReplyMarkup: btn,
+				ParseMode:   "HTML",
 			})
 
 			if err != nil {
@@ -99,3 +100,20 @@ func fSub(b *gotgbot.Bot, userId int64, arg string) (bool, error) {
 
 	return true, nil
 }
+
+// isSubscribed reports whether the user is currently a member of every force-subscribe chat.
+// Unlike fSub it never messages the user, so it can be used to check third parties.
+func isSubscribed(b *gotgbot.Bot, userId int64) (bool, error) {
+	for _, chatID := range FSubIds {
+		userMember, err := b.GetChatMember(chatID, userId, nil)
+		if err != nil {
+			return false, fmt.Errorf("error getting chat member: %s", err)
+		}
+
+		if !memberStatuses[userMember.MergeChatMember().Status] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
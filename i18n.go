@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// Message catalogs live in locales/<tag>.json and map message IDs to
+// text/template strings. A message that depends on a count maps its plural
+// forms ("one", "few", "many", "other") to templates instead, and is picked
+// by the "count" argument.
+//
+//go:embed locales/*.json
+var catalogFS embed.FS
+
+// defaultLanguage is used for users whose language has no catalog and for
+// chats without a user, such as the logger. Set it with DEFAULT_LANGUAGE.
+var defaultLanguage = "en"
+
+// Locale is the message catalog and number format of one language.
+type Locale struct {
+	Tag string
+	// Decimal and Group separate the fraction and the digit groups of numbers.
+	Decimal, Group string
+	// MinGrouping is the fewest integer digits that get grouped at all.
+	MinGrouping int
+	// Indian groups digits as 12,34,567 rather than 1,234,567.
+	Indian bool
+	// Plural returns the plural form of n.
+	Plural func(n int64) string
+
+	messages map[string]map[string]*template.Template
+	// sources holds the text of the "other" form of each message.
+	sources map[string]string
+}
+
+// locales holds the supported languages by tag. Adding a language takes a
+// catalog and an entry here.
+var locales = loadLocales([]*Locale{
+	{Tag: "en", Decimal: ".", Group: ",", MinGrouping: 4, Plural: pluralOneOther},
+	{Tag: "es", Decimal: ",", Group: ".", MinGrouping: 5, Plural: pluralOneOther},
+	{Tag: "hi", Decimal: ".", Group: ",", MinGrouping: 4, Indian: true, Plural: pluralHindi},
+	{Tag: "ru", Decimal: ",", Group: "\u00a0", MinGrouping: 5, Plural: pluralRussian},
+})
+
+func pluralOneOther(n int64) string {
+	if n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+func pluralHindi(n int64) string {
+	if n == 0 || n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+func pluralRussian(n int64) string {
+	if n < 0 {
+		n = -n
+	}
+	switch mod10, mod100 := n%10, n%100; {
+	case mod10 == 1 && mod100 != 11:
+		return "one"
+	case mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14):
+		return "few"
+	default:
+		return "many"
+	}
+}
+
+// loadLocales parses the embedded catalog of every locale. A broken catalog
+// is a bug in the build, so it stops the bot right away.
+func loadLocales(list []*Locale) map[string]*Locale {
+	byTag := make(map[string]*Locale, len(list))
+	for _, l := range list {
+		data, err := catalogFS.ReadFile(path.Join("locales", l.Tag+".json"))
+		if err != nil {
+			log.Fatalf("Failed to read the %s catalog: %v", l.Tag, err)
+		}
+
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			log.Fatalf("Failed to parse the %s catalog: %v", l.Tag, err)
+		}
+
+		l.messages = make(map[string]map[string]*template.Template, len(raw))
+		l.sources = make(map[string]string, len(raw))
+		for id, value := range raw {
+			forms := map[string]string{}
+			var text string
+			if err := json.Unmarshal(value, &text); err == nil {
+				forms["other"] = text
+			} else if err := json.Unmarshal(value, &forms); err != nil || forms["other"] == "" {
+				log.Fatalf("Message %s in the %s catalog must be a string or plural forms with \"other\"", id, l.Tag)
+			}
+
+			l.sources[id] = forms["other"]
+			l.messages[id] = make(map[string]*template.Template, len(forms))
+			for form, text := range forms {
+				tmpl, err := template.New(id).Parse(text)
+				if err != nil {
+					log.Fatalf("Failed to parse message %s in the %s catalog: %v", id, l.Tag, err)
+				}
+				l.messages[id][form] = tmpl
+			}
+		}
+		byTag[l.Tag] = l
+	}
+	return byTag
+}
+
+// languageTags returns the supported language tags in order.
+func languageTags() []string {
+	tags := make([]string, 0, len(locales))
+	for tag := range locales {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// localeFor returns the locale of the first supported language among codes,
+// which may be regional ("pt-br"), or the default locale.
+func localeFor(codes ...string) *Locale {
+	for _, code := range codes {
+		tag, _, _ := strings.Cut(strings.ToLower(code), "-")
+		if l, ok := locales[tag]; ok {
+			return l
+		}
+	}
+	return locales[defaultLanguage]
+}
+
+// userLocale returns the locale of a stored user, for messages sent to
+// someone other than the sender of the update.
+func userLocale(c context.Context, store UserStore, userID int64) *Locale {
+	user, err := store.GetUser(c, userID)
+	if err != nil {
+		return localeFor()
+	}
+	return localeFor(user.Language, user.LanguageCode)
+}
+
+// localeKey is where trackProfile leaves the locale of a registered user in
+// the update's context data.
+const localeKey = "locale"
+
+// tr returns the locale of the user behind an update: the language they
+// picked, or else their Telegram language.
+func tr(ctx *ext.Context) *Locale {
+	if l, ok := ctx.Data[localeKey].(*Locale); ok {
+		return l
+	}
+	if ctx.EffectiveUser != nil {
+		return localeFor(ctx.EffectiveUser.LanguageCode)
+	}
+	return localeFor()
+}
+
+// HTML is a message argument that is already HTML, such as a mention or
+// another rendered message, and is inserted as is.
+type HTML string
+
+// T renders message id with args given as name, value pairs. Messages are
+// HTML: every argument other than an HTML value is escaped, so names, errors
+// and other user input can't break the markup. Amounts (float64) and counts
+// (int, int64) are formatted for the locale; pass IDs as strings to keep them
+// ungrouped. Messages missing from the catalog fall back to the default
+// language and then to the ID itself.
+func (l *Locale) T(id string, args ...any) string {
+	data, count := l.data(args)
+	forms, ok := l.messages[id]
+	if !ok {
+		if fallback := locales[defaultLanguage]; fallback != l && fallback.messages[id] != nil {
+			return fallback.T(id, args...)
+		}
+		log.Printf("Missing message %s in the %s catalog", id, l.Tag)
+		return id
+	}
+
+	tmpl, ok := forms[l.Plural(count)]
+	if !ok {
+		tmpl = forms["other"]
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Printf("Failed to render message %s in the %s catalog: %v", id, l.Tag, err)
+		return id
+	}
+	return buf.String()
+}
+
+// Source returns the catalog text of message id, falling back to the default
+// language like T.
+func (l *Locale) Source(id string) string {
+	if text, ok := l.sources[id]; ok {
+		return text
+	}
+	return locales[defaultLanguage].sources[id]
+}
+
+// Render executes text, an edited version of message id, with args like T
+// does, escaping them the same way. Unlike T it fails on arguments the
+// message does not have.
+func (l *Locale) Render(id, text string, args ...any) (string, error) {
+	tmpl, err := template.New(id).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data, _ := l.data(args)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// data turns name, value pairs into template data with numbers formatted for
+// the locale and other values escaped, and returns the "count" argument.
+func (l *Locale) data(args []any) (map[string]any, int64) {
+	data := make(map[string]any, len(args)/2)
+	var count int64
+	for i := 0; i+1 < len(args); i += 2 {
+		name := fmt.Sprint(args[i])
+		switch v := args[i+1].(type) {
+		case float64:
+			data[name] = l.Amount(v)
+		case int:
+			data[name] = l.Number(int64(v))
+			if name == "count" {
+				count = int64(v)
+			}
+		case int64:
+			data[name] = l.Number(v)
+			if name == "count" {
+				count = v
+			}
+		case HTML:
+			data[name] = string(v)
+		default:
+			data[name] = html.EscapeString(fmt.Sprint(v))
+		}
+	}
+	return data, count
+}
+
+// Number formats n with the digit grouping of the locale.
+func (l *Locale) Number(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	return sign + l.group(digits)
+}
+
+// Amount formats a balance with two decimals in the locale.
+func (l *Locale) Amount(f float64) string {
+	text := strconv.FormatFloat(f, 'f', 2, 64)
+	sign := ""
+	if strings.HasPrefix(text, "-") {
+		sign, text = "-", text[1:]
+	}
+	whole, frac, _ := strings.Cut(text, ".")
+	return sign + l.group(whole) + l.Decimal + frac
+}
+
+func (l *Locale) group(digits string) string {
+	if len(digits) < l.MinGrouping {
+		return digits
+	}
+
+	var parts []string
+	size := 3
+	for len(digits) > size {
+		parts = append([]string{digits[len(digits)-size:]}, parts...)
+		digits = digits[:len(digits)-size]
+		if l.Indian {
+			size = 2
+		}
+	}
+	return strings.Join(append([]string{digits}, parts...), l.Group)
+}
+
+// language shows the language picker. Picking a language is stored on the
+// user, so only registered users can pick one.
+func (a *App) language(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	l := tr(ctx)
+
+	user, err := a.store.GetUser(requestContext(ctx), ctx.EffectiveUser.Id)
+	if errors.Is(err, ErrNotFound) {
+		_, _ = msg.Reply(b, l.T("language.start_first"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+	if err != nil {
+		_, _ = msg.Reply(b, l.T("error.generic"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return fmt.Errorf("language: %v", err)
+	}
+
+	_, _ = msg.Reply(b, l.T("language.choose", "language", HTML(l.T("language.name"))), &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: languageMarkup(l, user.Language),
+	})
+	return nil
+}
+
+// languageMarkup lists the supported languages, marking the current choice.
+func languageMarkup(l *Locale, current string) gotgbot.InlineKeyboardMarkup {
+	var markup gotgbot.InlineKeyboardMarkup
+	var row []gotgbot.InlineKeyboardButton
+	for _, tag := range languageTags() {
+		text := locales[tag].T("language.name")
+		if tag == current {
+			text = "✅ " + text
+		}
+		row = append(row, gotgbot.InlineKeyboardButton{Text: text, CallbackData: "lang." + tag})
+		if len(row) == 2 {
+			markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+	}
+
+	auto := l.T("language.auto")
+	if current == "" {
+		auto = "✅ " + auto
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []gotgbot.InlineKeyboardButton{
+		{Text: auto, CallbackData: "lang.auto"},
+	})
+	return markup
+}
+
+// languageCallback stores the language picked as "lang.<tag>", or clears it
+// for "lang.auto", and redraws the picker in the new language.
+func (a *App) languageCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	query := ctx.CallbackQuery
+	l := tr(ctx)
+
+	tag := strings.TrimPrefix(query.Data, "lang.")
+	if tag == "auto" {
+		tag = ""
+	} else if _, ok := locales[tag]; !ok {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.invalid_callback"),
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	user, err := a.store.GetUser(requestContext(ctx), query.From.Id)
+	if err == nil {
+		err = a.store.SetUserLanguage(requestContext(ctx), user.ID, tag)
+	}
+	if err != nil {
+		text := l.T("error.generic")
+		if errors.Is(err, ErrNotFound) {
+			text = l.T("language.start_first")
+		}
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      text,
+			ShowAlert: true,
+		})
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to set language: %v", err)
+	}
+
+	l = localeFor(tag, user.LanguageCode)
+	ctx.Data[localeKey] = l
+	name := l.T("language.name")
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+		Text: l.T("language.changed", "language", HTML(name)),
+	})
+	_, _, _ = ctx.EffectiveMessage.EditText(b, l.T("language.choose", "language", HTML(name)), &gotgbot.EditMessageTextOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: languageMarkup(l, tag),
+	})
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// hostileNames are user-controlled values that would break HTML messages if
+// they were inserted unescaped, with the text they must turn into.
+var hostileNames = []struct {
+	name, escaped string
+}{
+	{"<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+	{"</b><a href=\"x\">", "&lt;/b&gt;&lt;a href=&#34;x&#34;&gt;"},
+	{"Tom & Jerry", "Tom &amp; Jerry"},
+	{"a > b", "a &gt; b"},
+	{`"Quoted"`, "&#34;Quoted&#34;"},
+}
+
+func TestLocaleTEscapesArguments(t *testing.T) {
+	for _, tag := range languageTags() {
+		l := locales[tag]
+		for _, tc := range hostileNames {
+			t.Run(tag+"/"+tc.name, func(t *testing.T) {
+				got := l.T("start.welcome_back", "name", tc.name, "balance", 1.5, "referrals", 2)
+				if !strings.Contains(got, tc.escaped) {
+					t.Errorf("T() = %q, want it to contain %q", got, tc.escaped)
+				}
+				if strings.Contains(got, tc.name) {
+					t.Errorf("T() = %q, contains the unescaped name", got)
+				}
+			})
+		}
+	}
+}
+
+func TestLocaleTKeepsHTMLArguments(t *testing.T) {
+	l := locales["en"]
+	got := l.T("start.welcome_back", "name", HTML(`<a href="tg://user?id=1">Alice</a>`), "balance", 1.5, "referrals", 2)
+	if !strings.Contains(got, `<a href="tg://user?id=1">Alice</a>`) {
+		t.Errorf("T() = %q, want the HTML argument as is", got)
+	}
+}
+
+func TestLocaleRenderEscapesArguments(t *testing.T) {
+	l := locales["en"]
+	for _, tc := range hostileNames {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := l.Render("start.welcome", "<b>Hi {{.name}}</b>", "name", tc.name)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			if want := "<b>Hi " + tc.escaped + "</b>"; got != want {
+				t.Errorf("Render() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLocaleRenderRejectsUnknownArguments(t *testing.T) {
+	if _, err := locales["en"].Render("start.welcome", "Hi {{.nickname}}", "name", "Alice"); err == nil {
+		t.Error("Render() succeeded with an argument the message does not have")
+	}
+}
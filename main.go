@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
@@ -15,6 +18,8 @@ import (
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/conversation"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/callbackquery"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/message"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -30,15 +35,38 @@ var (
 	WebhookURL     string
 	Port           string
 	MongoDBURI     string
+	MongoDBName    string
 	secretToken    string
 	OwnerID        int64
 	LoggerID       int64
 	FSubIds        []int64
-	ctx            = context.TODO()
 	allowedUpdates = []string{"message", "callback_query"}
 )
 
+// App holds the dependencies of the handlers and background workers.
+type App struct {
+	store Store
+	// base is the parent of every request and job context, cancelled on shutdown.
+	base context.Context
+	// jobs tracks the background work shutdown waits for.
+	jobs sync.WaitGroup
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrations(os.Args[2:])
+			return
+		case "backup":
+			runBackup(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		}
+	}
+
 	var err error
 	token := os.Getenv("TOKEN")
 	if token == "" {
@@ -61,7 +89,15 @@ func main() {
 	}
 
 	FSubIds = append(FSubIds, fsubids)
-	MongoDBURI = os.Getenv("MONGO_URI")
+
+	for _, id := range strings.Fields(strings.ReplaceAll(os.Getenv("ADMIN_IDS"), ",", " ")) {
+		adminID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid ADMIN_IDS entry: %s", id)
+		}
+		AdminIDs[adminID] = true
+	}
+	loadMongoConfig()
 
 	secretToken = os.Getenv("SECRET_TOKEN")
 	if secretToken == "" {
@@ -71,19 +107,19 @@ func main() {
 	WebhookURL = os.Getenv("WEBHOOK_URL")
 	Port = os.Getenv("PORT")
 
-	clientOptions := options.Client().ApplyURI(MongoDBURI)
-	client, err := mongo.Connect(ctx, clientOptions)
-	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-
-	if err := client.Ping(ctx, nil); err != nil {
-		log.Fatalf("Failed to ping MongoDB: %v", err)
+	dbTimeout = durationEnv("DB_TIMEOUT", dbTimeout)
+	shutdownTimeout = durationEnv("SHUTDOWN_TIMEOUT", shutdownTimeout)
+	if lang := os.Getenv("DEFAULT_LANGUAGE"); lang != "" {
+		if _, ok := locales[lang]; !ok {
+			log.Fatalf("Unknown DEFAULT_LANGUAGE %q, expected one of %s", lang, strings.Join(languageTags(), ", "))
+		}
+		defaultLanguage = lang
 	}
+	base, stop := context.WithCancel(context.Background())
+	defer stop()
 
-	fmt.Println("Connected to MongoDB")
-	db := client.Database("tgreferearn")
-	userColl = db.Collection("users")
+	store := openStoreFromEnv(base)
+	app := &App{store: store, base: base}
 
 	bot, err := gotgbot.NewBot(token, &gotgbot.BotOpts{
 		BotClient: &gotgbot.BaseBotClient{
@@ -102,45 +138,86 @@ func main() {
 	dispatcher := ext.NewDispatcher(&ext.DispatcherOpts{
 		Error: func(b *gotgbot.Bot, ctx *ext.Context, err error) ext.DispatcherAction {
 			log.Println("an error occurred while handling update:", err.Error())
+			// Handlers return store errors other than ErrNotFound, so a
+			// timed out update ends here whichever way the error was wrapped.
+			if errors.Is(err, context.DeadlineExceeded) || requestContext(ctx).Err() != nil {
+				replyTimedOut(b, ctx)
+			}
 			return ext.DispatcherActionNoop
 		},
+		Processor:   requestProcessor{base: base},
 		MaxRoutines: ext.DefaultMaxRoutines,
 	})
 
-	dispatcher.AddHandler(handlers.NewCommand("start", start))
+	// Keep stored profiles fresh before any other handler runs.
+	dispatcher.AddHandlerToGroup(handlers.NewMessage(message.All, app.trackProfile), -1)
+	dispatcher.AddHandlerToGroup(handlers.NewCallback(callbackquery.All, app.trackProfile), -1)
+
+	dispatcher.AddHandler(handlers.NewCommand("start", app.start))
 	dispatcher.AddHandler(handlers.NewCommand("help", help))
-	dispatcher.AddHandler(handlers.NewCommand("info", info))
-	dispatcher.AddHandler(handlers.NewCommand("add", addBalance))
-	dispatcher.AddHandler(handlers.NewCommand("remove", removeBalanceCmd))
-	dispatcher.AddHandler(handlers.NewCommand("accno", updateAccNo))
-	dispatcher.AddHandler(handlers.NewCommand("stats", stats))
-	dispatcher.AddHandler(handlers.NewCommand("broadcast", broadcast))
-
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("info"), infoCallback))
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("wallet"), walletCallback))
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("confirm_withdrawal"), confirmWithdrawal))
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("home"), home))
+	dispatcher.AddHandler(handlers.NewCommand("info", app.info))
+	dispatcher.AddHandler(handlers.NewCommand("add", app.addBalance))
+	dispatcher.AddHandler(handlers.NewCommand("remove", app.removeBalanceCmd))
+	dispatcher.AddHandler(handlers.NewCommand("accno", app.updateAccNo))
+	dispatcher.AddHandler(handlers.NewCommand("language", app.language))
+	dispatcher.AddHandler(handlers.NewCommand("stats", app.stats))
+	dispatcher.AddHandler(handlers.NewCommand("broadcast", app.broadcast))
+	dispatcher.AddHandler(handlers.NewCommand("user", app.userSearch))
+	dispatcher.AddHandler(handlers.NewCommand("delbroadcast", app.deleteBroadcast))
+	dispatcher.AddHandler(handlers.NewCommand("editbroadcast", app.editBroadcast))
+	dispatcher.AddHandler(handlers.NewCommand("schedule", app.schedule))
+	dispatcher.AddHandler(handlers.NewCommand("schedules", app.listSchedules))
+	dispatcher.AddHandler(handlers.NewCommand("reschedule", app.reschedule))
+	dispatcher.AddHandler(handlers.NewCommand("unschedule", app.unschedule))
+	dispatcher.AddHandler(handlers.NewCommand("backup", app.backup))
+	dispatcher.AddHandler(handlers.NewCommand("restore", app.restore))
+	dispatcher.AddHandler(handlers.NewCommand("export", app.export))
+	dispatcher.AddHandler(handlers.NewCommand("bulk", app.bulk))
+	dispatcher.AddHandler(handlers.NewCommand("revertbatch", app.revertBatch))
+	dispatcher.AddHandler(handlers.NewCommand("templates", app.templates))
+	dispatcher.AddHandler(handlers.NewCommand("template", app.template))
+	dispatcher.AddHandler(handlers.NewCommand("settemplate", app.setTemplate))
+
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("info"), app.infoCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("wallet"), app.walletCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("confirm_withdrawal"), app.confirmWithdrawal))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("home"), app.home))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("referrals"), app.referralsCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Equal("stats"), app.statsCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("lang."), app.languageCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("uadm."), app.userAdminCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("bcast."), app.broadcastCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("sched."), app.scheduleCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("restore."), app.restoreCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("batch."), app.batchCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("tmpl."), app.templateCallback))
+
+	// Both flows share one storage, so a user is only ever in one of them.
+	convStorage := NewConversationStorage(store, conversation.KeyStrategySenderAndChat, map[string]time.Duration{
+		WITHDRAWAL: durationEnv("WITHDRAWAL_TIMEOUT", 5*time.Minute),
+		SetAcc:     durationEnv("SET_ACCOUNT_TIMEOUT", 5*time.Minute),
+	})
 
 	dispatcher.AddHandler(handlers.NewConversation(
-		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("withdraw"), withdrawal)},
+		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("withdraw"), app.withdrawal)},
 		map[string][]ext.Handler{
-			WITHDRAWAL: {handlers.NewMessage(onlyFloat64, withdrawalAsk)},
+			WITHDRAWAL: {handlers.NewMessage(onlyFloat64, app.withdrawalAsk)},
 		},
 		&handlers.ConversationOpts{
 			Exits:        []ext.Handler{handlers.NewCommand("cancel", cancel)},
-			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
+			StateStorage: convStorage,
 			AllowReEntry: true,
 		},
 	))
 
 	dispatcher.AddHandler(handlers.NewConversation(
-		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("setAccNo"), setAccNo)},
+		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("setAccNo"), app.setAccNo)},
 		map[string][]ext.Handler{
-			SetAcc: {handlers.NewMessage(onlyInt64, setAccAsk)},
+			SetAcc: {handlers.NewMessage(onlyInt64, app.setAccAsk)},
 		},
 		&handlers.ConversationOpts{
 			Exits:        []ext.Handler{handlers.NewCommand("cancel", cancel)},
-			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
+			StateStorage: convStorage,
 			AllowReEntry: true,
 		},
 	))
@@ -184,14 +261,163 @@ func main() {
 		}
 	}
 
+	// Jobs stop at a safe point once stopping is cancelled, ahead of base.
+	stopping, stopJobs := context.WithCancel(base)
+	defer stopJobs()
+	app.goJob(func() { app.broadcastWorker(stopping, bot) })
+	app.goJob(func() { app.scheduleWorker(stopping, bot) })
+	app.goJob(func() { convStorage.conversationSweeper(stopping, bot) })
+	app.goJob(func() { app.resumeBatches(bot) })
+
 	log.Printf("%s has been started...\n", bot.User.Username)
-	updater.Idle()
+	app.waitForShutdown(bot, shutdown{
+		updater:       updater,
+		stopJobs:      stopJobs,
+		abort:         stop,
+		deleteWebhook: WebhookURL != "" && Port != "" && os.Getenv("DELETE_WEBHOOK_ON_SHUTDOWN") == "true",
+	})
+}
+
+// openStoreFromEnv opens the storage backend selected by STORE.
+func openStoreFromEnv(ctx context.Context) Store {
+	switch backend := os.Getenv("STORE"); backend {
+	case "", "mongo":
+		return openMongoStore(ctx)
+	case "memory":
+		log.Println("Using the in-memory store, data will be lost on restart")
+		return NewMemoryStore()
+	case DialectPostgres, DialectSQLite:
+		return openSQLStore(ctx, backend)
+	default:
+		log.Fatalf("Unknown STORE %q, expected mongo, postgres, sqlite or memory", backend)
+		return nil
+	}
+}
+
+// loadMongoConfig reads MONGO_URI and MONGO_DB from the environment.
+func loadMongoConfig() {
+	MongoDBURI = os.Getenv("MONGO_URI")
+	MongoDBName = os.Getenv("MONGO_DB")
+	if MongoDBName == "" {
+		MongoDBName = "tgreferearn"
+	}
+}
+
+// connectMongo connects to MONGO_URI and opens the MONGO_DB database.
+func connectMongo(ctx context.Context) *MongoStore {
+	clientOptions := options.Client().ApplyURI(MongoDBURI)
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if err := client.Ping(pingCtx, nil); err != nil {
+		log.Fatalf("Failed to ping MongoDB: %v", err)
+	}
+
+	fmt.Println("Connected to MongoDB")
+	return NewMongoStore(client.Database(MongoDBName))
+}
+
+// openMongoStore connects to MONGO_URI and prepares the collections.
+func openMongoStore(ctx context.Context) *MongoStore {
+	store := connectMongo(ctx)
+	if err := store.EnsureIndexes(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := store.Migrate(ctx, false); err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+// runMigrations is the migrate subcommand. It applies pending migrations, or
+// with -dry-run only lists them, and exits without starting the bot.
+func runMigrations(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	_ = flags.Parse(args)
+
+	loadMongoConfig()
+	dbTimeout = durationEnv("DB_TIMEOUT", dbTimeout)
+	ctx := context.Background()
+
+	switch backend := os.Getenv("STORE"); backend {
+	case "", "mongo":
+		store := connectMongo(ctx)
+		if !*dryRun {
+			if err := store.EnsureIndexes(ctx); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := store.Migrate(ctx, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+	case DialectPostgres, DialectSQLite:
+		if *dryRun {
+			log.Fatal("-dry-run is only supported by the mongo store")
+		}
+		// Opening the store applies its migrations.
+		_ = openSQLStore(ctx, backend).Close(ctx)
+	default:
+		log.Fatalf("STORE %q has no migrations", backend)
+	}
+}
+
+// openSQLStore connects to DATABASE_URL and applies pending migrations. SQLite
+// falls back to a file in the working directory.
+func openSQLStore(ctx context.Context, dialect string) *SQLStore {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		if dialect != DialectSQLite {
+			log.Fatal("DATABASE_URL is not set")
+		}
+		dsn = "earnify.db"
+	}
+
+	store, err := OpenSQLStore(ctx, dialect, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Connected to %s\n", dialect)
+	return store
 }
 
-func start(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) trackProfile(b *gotgbot.Bot, ctx *ext.Context) error {
+	if ctx.EffectiveUser == nil || ctx.EffectiveUser.IsBot {
+		return nil
+	}
+
+	user, err := a.store.UpdateUserProfile(requestContext(ctx), newUser(ctx.EffectiveUser))
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("Failed to track profile: %v", err)
+		}
+		return nil
+	}
+	ctx.Data[localeKey] = localeFor(user.Language, user.LanguageCode)
+
+	if user.Banned && roleOf(user.ID) == RoleUser {
+		if ctx.CallbackQuery != nil {
+			_, _ = ctx.CallbackQuery.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+				Text:      tr(ctx).T("error.banned"),
+				ShowAlert: true,
+			})
+		}
+		return ext.EndGroups
+	}
+	return nil
+}
+
+func (a *App) start(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	args := ctx.Args()[1:]
+	l := tr(ctx)
 
 	var userArgs string
 	if len(args) > 0 {
@@ -200,9 +426,9 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 		userArgs = ""
 	}
 
-	isMember, err := fSub(b, user.Id, userArgs)
+	isMember, err := fSub(b, l, user.Id, userArgs)
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ An error occurred. Please try again later.", nil)
+		_, _ = msg.Reply(b, l.T("error.generic"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return fmt.Errorf("start: %v", err)
 	}
 
@@ -210,53 +436,18 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 		return ext.EndGroups
 	}
 
-	referUrl := fmt.Sprintf("https://t.me/%s?start=%d", b.User.Username, user.Id)
-
-	button := gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text: "👤 Owner",
-					Url:  fmt.Sprintf("tg://user?id=%d", OwnerID),
-				},
-			},
-			{
-				{
-					Text: "🔗 Refer & Earn",
-					Url:  fmt.Sprintf("https://t.me/share/url?url=%s", referUrl),
-				},
-				{
-					Text:         "ℹ️ Info",
-					CallbackData: fmt.Sprintf("info.%d", user.Id),
-				},
-			},
-			{
-				{
-					Text:         "💼 Wallet",
-					CallbackData: fmt.Sprintf("wallet.%d", user.Id),
-				},
-				{
-					Text:         "💸 Withdraw",
-					CallbackData: fmt.Sprintf("withdraw.%d", user.Id),
-				},
-			},
-		},
-	}
+	button := menuMarkup(b, l, "home", user.Id)
 
-	existingUser, err := getUser(user.Id)
-	if err != nil && err.Error() != "mongo: no documents in result" {
+	existingUser, err := a.store.GetUser(requestContext(ctx), user.Id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		log.Printf("Failed to fetch user: %v", err)
-		_, _ = msg.Reply(b, "❌ An error occurred. Please try again later.\n/start", nil)
+		_, _ = msg.Reply(b, l.T("error.retry_start"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
 	if existingUser != nil {
-		response := fmt.Sprintf(
-			"👋 <b>Welcome back, %s!</b>\n\n"+
-				"💰 <b>Balance:</b> %.2f\n"+
-				"🤝 <b>Referred Users:</b> %d\n\n"+
-				"🚀 Keep earning rewards by referring your friends!",
-			user.FirstName, existingUser.Balance, len(existingUser.ReferredUsers))
+		response := a.message(requestContext(ctx), l, "start.welcome_back",
+			"name", user.FirstName, "balance", existingUser.Balance, "referrals", existingUser.ReferralCount)
 
 		_, _ = msg.Reply(b, response, &gotgbot.SendMessageOpts{
 			ReplyMarkup: button,
@@ -274,15 +465,15 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 		referralCode := strings.TrimSpace(args[0])
 		referrerID, err = strconv.ParseInt(referralCode, 10, 64)
 		if err != nil || referrerID <= 0 {
-			_, _ = msg.Reply(b, "❌ <b>Invalid referral code!</b>\n\nPlease check the code and try again.", &gotgbot.SendMessageOpts{
+			_, _ = msg.Reply(b, l.T("start.invalid_code"), &gotgbot.SendMessageOpts{
 				ParseMode: "HTML",
 			})
 			return nil
 		}
 
-		referrer, err := getUser(referrerID)
+		referrer, err := a.store.GetUser(requestContext(ctx), referrerID)
 		if err != nil {
-			_, _ = msg.Reply(b, "❌ <b>The referral code is not valid.</b>\n\nPlease check with the person who referred you.", &gotgbot.SendMessageOpts{
+			_, _ = msg.Reply(b, l.T("start.unknown_code"), &gotgbot.SendMessageOpts{
 				ParseMode: "HTML",
 			})
 
@@ -290,40 +481,41 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 		}
 
 		log.Printf("Referrer ID: %d", referrer.ID)
-		err = referUser(referrerID, user.Id)
+		err = a.store.ReferUser(requestContext(ctx), referrerID, newUser(user))
 		if err != nil {
 			log.Printf("Failed to refer user: %v", err)
-			_, _ = msg.Reply(b, "⚠️ <b>Failed to register with the referral. Please try again.</b>", &gotgbot.SendMessageOpts{
+			_, _ = msg.Reply(b, l.T("start.refer_failed"), &gotgbot.SendMessageOpts{
 				ParseMode: "HTML",
 			})
 
 			return nil
 		}
-		_, _ = b.SendMessage(referrerID, fmt.Sprintf(
-			"🎉 <b>Referral Successful!</b>\n\n"+
-				"👤 You referred <b>%s</b> (%d) successfully!\n"+
-				"💵 You’ve earned <b>10.00 tokens</b>! Keep sharing and earning more! 🚀",
-			user.FirstName, user.Id), &gotgbot.SendMessageOpts{
+		notice := a.message(requestContext(ctx), localeFor(referrer.Language, referrer.LanguageCode), "start.referral_success",
+			"name", user.FirstName, "id", fmt.Sprint(user.Id), "reward", 10.0)
+		_, err = b.SendMessage(referrerID, notice, &gotgbot.SendMessageOpts{
 			ParseMode: "HTML",
 		})
+		if err != nil {
+			log.Printf("Failed to notify referrer %d: %v", referrerID, err)
+		}
 
-		err = updateUserBalance(referrerID, 10.0)
+		err = a.store.ApplyLedgerEntry(requestContext(ctx), LedgerEntry{UserID: referrerID, Amount: 10.0, Kind: LedgerReferral, Actor: user.Id})
 		if err != nil {
-			log.Printf("Failed to update referrer's balance: %v", err)
+			log.Printf("Failed to reward referrer: %v", err)
+		} else {
+			if err = a.store.MarkReferralRewarded(requestContext(ctx), user.Id); err != nil {
+				log.Printf("Failed to mark referral reward: %v", err)
+			}
 		}
 	}
 
 	// Register the user (if no referrer)
 	if referrerID == 0 {
-		err = addUser(User{
-			ID:       user.Id,
-			Balance:  0,
-			Referrer: 0,
-		})
+		err = a.store.AddUser(requestContext(ctx), newUser(user))
 
 		if err != nil {
 			log.Printf("Failed to add user: %v", err)
-			_, _ = msg.Reply(b, "❌ <b>Failed to register. Please try again later.</b>", &gotgbot.SendMessageOpts{
+			_, _ = msg.Reply(b, l.T("start.register_failed"), &gotgbot.SendMessageOpts{
 				ParseMode: "HTML",
 			})
 
@@ -332,12 +524,7 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 
 	// Success message for the new user
-	response := fmt.Sprintf(
-		"🎉 <b>Welcome to the Refer & Earn Bot, %s!</b>\n\n"+
-			"💰 <b>Balance:</b> %.2f\n"+
-			"🤝 <b>Referred Users:</b> %d\n\n"+
-			"🔗 Use your referral link to invite friends and earn rewards!",
-		user.FirstName, 0.00, 0)
+	response := a.message(requestContext(ctx), l, "start.welcome", "name", user.FirstName, "balance", 0.0, "referrals", 0)
 
 	_, _ = msg.Reply(b, response, &gotgbot.SendMessageOpts{
 		ReplyMarkup: button,
@@ -351,35 +538,10 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 }
 func help(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
-	text := `
-<b>🤖 Bot Commands</b>
-Here are the commands you can use:
-
-<b>🔹 General Commands</b>
-/start - 🚀 Start the bot  
-/help - 📖 Show this help message  
-/info - ℹ️ Show your user info  
-/accno - 🆔 Set or update account number 
-
-<b>🔸 Owner Commands</b>
-/add - ➕ Add balance  
-/remove - ➖ Remove balance  
-/stats - 📊 Show bot statistics  
-/broadcast - 📢 Broadcast a message to all users  
-
-⚠️ <i>Note: Owner commands are restricted to the bot owner only.</i>
-`
-
-	button := &gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text:         " Home",
-					CallbackData: "home",
-				},
-			},
-		},
-	}
+	l := tr(ctx)
+	text := l.T("help.text")
+
+	button := menuMarkup(b, l, "help", ctx.EffectiveUser.Id)
 	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
 		ParseMode:   "HTML",
 		ReplyMarkup: button,
@@ -388,7 +550,7 @@ Here are the commands you can use:
 	return nil
 }
 
-func info(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) info(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	args := ctx.Args()[1:]
@@ -400,22 +562,24 @@ func info(b *gotgbot.Bot, ctx *ext.Context) error {
 		userId = stringToInt64(args[0])
 	}
 
-	userInfo, err := getUser(userId)
+	// Other users' cards hold their profile and account number.
+	if userId != user.Id && !can(user.Id, PermViewUsers) {
+		_, _ = msg.Reply(b, tr(ctx).T("error.unauthorized"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	userInfo, err := a.store.GetUser(requestContext(ctx), userId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", userId, err)
+	}
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ <b>User not found.</b>\n\nPlease check the User ID and try again.", &gotgbot.SendMessageOpts{
+		_, _ = msg.Reply(b, tr(ctx).T("info.not_found"), &gotgbot.SendMessageOpts{
 			ParseMode: "HTML",
 		})
 		return nil
 	}
 
-	response := fmt.Sprintf(
-		"👤 <b>User Information</b>\n\n"+
-			"🔹 <b>User ID:</b> %d\n"+
-			"🔗 <b>Referrer ID:</b> %d\n"+
-			"🤝 <b>Referred Users:</b> %d\n"+
-			"💰 <b>Account Balance:</b> %.2f\n"+
-			"<b>Account Number</b> %d",
-		userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), userInfo.Balance, userInfo.AccNo)
+	response := a.formatUserInfo(requestContext(ctx), tr(ctx), userInfo)
 
 	_, _ = msg.Reply(b, response, &gotgbot.SendMessageOpts{
 		ParseMode: "HTML",
@@ -424,55 +588,76 @@ func info(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func infoCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+// formatUserInfo renders the user information card shown by /info and the Info button.
+func (a *App) formatUserInfo(c context.Context, l *Locale, userInfo *User) string {
+	referrer := HTML("—")
+	if userInfo.Referrer != 0 {
+		referrer = HTML(fmt.Sprint(userInfo.Referrer))
+		if r, err := a.store.GetUser(c, userInfo.Referrer); err == nil {
+			referrer = mention(r)
+		}
+	}
+
+	lastSeen := "—"
+	if !userInfo.LastSeen.IsZero() {
+		lastSeen = userInfo.LastSeen.Format("2006-01-02 15:04 MST")
+	}
+
+	joined := "—"
+	if !userInfo.JoinedAt.IsZero() {
+		joined = userInfo.JoinedAt.Format("2006-01-02")
+	}
+
+	return l.T("info.card",
+		"name", mention(userInfo), "id", fmt.Sprint(userInfo.ID), "referrer", referrer,
+		"referrals", userInfo.ReferralCount, "balance", userInfo.Balance, "acc_no", fmt.Sprint(userInfo.AccNo),
+		"joined", joined, "last_seen", lastSeen)
+}
+
+func (a *App) infoCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	query := ctx.CallbackQuery
+	l := tr(ctx)
 	callbackData := query.Data
 	splitData := strings.Split(callbackData, ".")
 	if len(splitData) < 2 {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid callback data.",
+			Text:      l.T("error.invalid_callback"),
 			ShowAlert: true,
 		})
 		return nil
 	}
 
 	userId := stringToInt64(splitData[1])
+	if userId != ctx.EffectiveUser.Id && !can(ctx.EffectiveUser.Id, PermViewUsers) {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.unauthorized"),
+			ShowAlert: true,
+		})
+		return nil
+	}
 
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(requestContext(ctx), userId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", userId, err)
+	}
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ User not found.",
+			Text:      l.T("error.user_not_found"),
 			ShowAlert: true,
 		})
 
-		_, _, _ = msg.EditText(b, "❌ <b>User not found.</b>", &gotgbot.EditMessageTextOpts{
+		_, _, _ = msg.EditText(b, l.T("error.user_not_found_html"), &gotgbot.EditMessageTextOpts{
 			ParseMode: "HTML",
 		})
 		return nil
 	}
 
-	button := gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text:         " Home",
-					CallbackData: "home",
-				},
-			},
-		},
-	}
-	response := fmt.Sprintf(
-		"👤 <b>User Information</b>\n\n"+
-			"🔹 <b>User ID:</b> %d\n"+
-			"🔗 <b>Referrer ID:</b> %d\n"+
-			"🤝 <b>Referred Users:</b> %d\n"+
-			"💰 <b>Account Balance:</b> %.2f\n"+
-			"<b>Account Number</b> %d",
-		userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), userInfo.Balance, userInfo.AccNo)
+	button := menuMarkup(b, l, "info", ctx.EffectiveUser.Id)
+	response := a.formatUserInfo(requestContext(ctx), l, userInfo)
 
 	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-		Text: "ℹ️ User information loaded successfully.",
+		Text: l.T("info.loaded"),
 	})
 
 	_, _, _ = msg.EditText(b, response, &gotgbot.EditMessageTextOpts{
@@ -482,67 +667,41 @@ func infoCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	return nil
 }
-func walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+
+// walletCallback shows the wallet of whoever pressed the button. The user ID
+// in the callback data is ignored, so forged data can't open another wallet.
+func (a *App) walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	query := ctx.CallbackQuery
-	callbackData := query.Data
+	l := tr(ctx)
 
-	splitData := strings.Split(callbackData, ".")
-	if len(splitData) < 2 {
-		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid callback data.",
-			ShowAlert: true,
-		})
-		return nil
+	userId := ctx.EffectiveUser.Id
+	userInfo, err := a.store.GetUser(requestContext(ctx), userId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", userId, err)
 	}
-	userId := stringToInt64(splitData[1])
-	userInfo, err := getUser(userId)
-
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ User not found.",
+			Text:      l.T("error.user_not_found"),
 			ShowAlert: true,
 		})
 
-		_, _, _ = msg.EditText(b, "❌ <b>User not found.</b>", &gotgbot.EditMessageTextOpts{
+		_, _, _ = msg.EditText(b, l.T("error.user_not_found_html"), &gotgbot.EditMessageTextOpts{
 			ParseMode: "HTML",
 		})
 
 		return nil
 	}
 
-	button := gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text:         "🆔 Set Account Number",
-					CallbackData: fmt.Sprintf("setAccNo.%d", userInfo.ID),
-				},
-			},
-			{
-				{
-					Text:         "💸 Withdraw",
-					CallbackData: fmt.Sprintf("withdraw.%d", userInfo.ID),
-				},
-				{
-					Text:         " Home",
-					CallbackData: "home",
-				},
-			},
-		},
-	}
+	button := menuMarkup(b, l, "wallet", ctx.EffectiveUser.Id)
 
 	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-		Text: "Wallet information loaded.",
+		Text: l.T("wallet.loaded"),
 	})
 
-	response := fmt.Sprintf(
-		"💰 <b>Wallet Information</b>\n\n"+
-			"🔹 <b>User ID:</b> %d\n"+
-			"🔗 <b>Referrer ID:</b> %d\n"+
-			"🤝 <b>Referred Users:</b> %d\n"+
-			"💵 <b>Account Balance:</b> %.2f",
-		userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), userInfo.Balance)
+	response := l.T("wallet.card",
+		"id", fmt.Sprint(userInfo.ID), "referrer", fmt.Sprint(userInfo.Referrer),
+		"referrals", userInfo.ReferralCount, "balance", userInfo.Balance)
 
 	_, _, _ = msg.EditText(b, response, &gotgbot.EditMessageTextOpts{
 		ReplyMarkup: button,
@@ -552,17 +711,18 @@ func walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	if user.Id != OwnerID {
-		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		_, _ = msg.Reply(b, l.T("error.unauthorized"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
 	args := ctx.Args()[1:]
 	if len(args) < 2 {
-		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/add &lt;user_id&gt; &lt;amount&gt;</code>", &gotgbot.SendMessageOpts{
+		_, _ = msg.Reply(b, l.T("balance.add_usage"), &gotgbot.SendMessageOpts{
 			ParseMode: "HTML",
 		})
 		return nil
@@ -570,34 +730,29 @@ func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	userId := stringToInt64(args[0])
 	if userId <= 0 {
-		_, _ = msg.Reply(b, "❌ Invalid user ID. Please enter a valid numeric user ID.", nil)
+		_, _ = msg.Reply(b, l.T("balance.invalid_user"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
 	amount, err := strconv.ParseFloat(args[1], 64)
 	if err != nil || amount <= 0 {
-		_, _ = msg.Reply(b, "❌ Invalid amount. Please enter a positive number.", nil)
+		_, _ = msg.Reply(b, l.T("balance.invalid_amount"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	err = updateUserBalance(userId, amount)
+	err = a.store.ApplyLedgerEntry(requestContext(ctx), LedgerEntry{UserID: userId, Amount: amount, Kind: LedgerAdjustment, Actor: user.Id})
 	if err != nil {
-		_, _ = msg.Reply(b, fmt.Sprintf("❌ Failed to update balance: %v", err), nil)
+		_, _ = msg.Reply(b, l.T("balance.update_failed", "error", err), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(requestContext(ctx), userId)
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Failed to retrieve updated user information.", nil)
+		_, _ = msg.Reply(b, l.T("balance.fetch_failed"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	text := fmt.Sprintf(
-		"✅ Successfully updated balance for user <b>%d</b>.\n\n"+
-			"🔹 <b>Amount Added:</b> %.2f\n"+
-			"💵 <b>New Balance:</b> %.2f",
-		userId, amount, userInfo.Balance,
-	)
+	text := l.T("balance.added", "id", fmt.Sprint(userId), "amount", amount, "balance", userInfo.Balance)
 	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
 		ParseMode: "HTML",
 	})
@@ -605,18 +760,19 @@ func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 
 	if user.Id != OwnerID {
-		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		_, _ = msg.Reply(b, l.T("error.unauthorized"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
 	args := ctx.Args()[1:]
 	if len(args) < 2 {
-		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/remove &lt;user_id&gt; &lt;amount&gt;</code>", &gotgbot.SendMessageOpts{
+		_, _ = msg.Reply(b, l.T("balance.remove_usage"), &gotgbot.SendMessageOpts{
 			ParseMode: "HTML",
 		})
 		return nil
@@ -624,34 +780,29 @@ func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	userId := stringToInt64(args[0])
 	if userId <= 0 {
-		_, _ = msg.Reply(b, "❌ Invalid user ID. Please enter a valid numeric user ID.", nil)
+		_, _ = msg.Reply(b, l.T("balance.invalid_user"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
 	amount, err := strconv.ParseFloat(args[1], 64)
 	if err != nil || amount <= 0 {
-		_, _ = msg.Reply(b, "❌ Invalid amount. Please enter a positive number.", nil)
+		_, _ = msg.Reply(b, l.T("balance.invalid_amount"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	_, err = removeBalance(userId, amount)
+	err = a.store.ApplyLedgerEntry(requestContext(ctx), LedgerEntry{UserID: userId, Amount: -amount, Kind: LedgerAdjustment, Actor: user.Id})
 	if err != nil {
-		_, _ = msg.Reply(b, fmt.Sprintf("❌ Failed to update balance: %v", err), nil)
+		_, _ = msg.Reply(b, l.T("balance.update_failed", "error", err), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(requestContext(ctx), userId)
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Failed to retrieve updated user information.", nil)
+		_, _ = msg.Reply(b, l.T("balance.fetch_failed"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	text := fmt.Sprintf(
-		"✅ Successfully updated balance for user <b>%d</b>.\n\n"+
-			"🔹 <b>Amount Deducted:</b> %.2f\n"+
-			"💵 <b>New Balance:</b> %.2f",
-		userId, amount, userInfo.Balance,
-	)
+	text := l.T("balance.removed", "id", fmt.Sprint(userId), "amount", amount, "balance", userInfo.Balance)
 	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
 		ParseMode: "HTML",
 	})
@@ -659,39 +810,36 @@ func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func updateAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) updateAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	args := ctx.Args()[1:]
 
 	if len(args) < 1 {
-		_, _ = msg.Reply(b, "❌ Please provide an account number.\n\nUsage: /accno <account_number>", nil)
+		_, _ = msg.Reply(b, l.T("accno.usage"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
 	accNo := stringToInt64(args[0])
 	if accNo <= 0 {
-		_, _ = msg.Reply(b, "❌ Invalid account number. Please enter a valid positive number.", nil)
+		_, _ = msg.Reply(b, l.T("accno.invalid"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	err := updateUserAccNo(user.Id, accNo)
+	err := a.store.UpdateUserAccNo(requestContext(ctx), user.Id, accNo)
 	if err != nil {
-		_, _ = msg.Reply(b, fmt.Sprintf("❌ Failed to update account number: %v", err), nil)
+		_, _ = msg.Reply(b, l.T("accno.update_failed", "error", err), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	userInfo, err := getUser(user.Id)
+	userInfo, err := a.store.GetUser(requestContext(ctx), user.Id)
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Failed to retrieve updated user information.", nil)
+		_, _ = msg.Reply(b, l.T("balance.fetch_failed"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	text := fmt.Sprintf(
-		"✅ Account number successfully updated for user <b>%d</b>.\n\n"+
-			"🔹 <b>New Account Number:</b> %d",
-		user.Id, userInfo.AccNo,
-	)
+	text := l.T("accno.updated", "id", fmt.Sprint(user.Id), "acc_no", fmt.Sprint(userInfo.AccNo))
 	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
 		ParseMode: "HTML",
 	})
@@ -699,84 +847,84 @@ func updateAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func stats(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) stats(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
-	if user.Id != OwnerID {
-		_, _ = msg.Reply(b, "You are not authorized to use this command.", nil)
+	if !can(user.Id, PermViewUsers) {
+		_, _ = msg.Reply(b, l.T("error.unauthorized"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	allUser, _ := getAllUsers()
-	text := fmt.Sprintf("Total Users: %d\n\n", len(allUser))
-	_, _ = msg.Reply(b, text, nil)
+	_, _ = msg.Reply(b, a.statsText(requestContext(ctx), l), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
+			IsDisabled: true,
+		},
+	})
 	return nil
 }
 
-func broadcast(b *gotgbot.Bot, ctx *ext.Context) error {
-	msg := ctx.EffectiveMessage
-	if msg.Chat.Type != "private" {
-		return nil
-	}
-
-	if msg.From.Id != OwnerID {
-		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+// statsCallback shows the statistics from the owner's Stats button.
+func (a *App) statsCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	query := ctx.CallbackQuery
+	l := tr(ctx)
+	if !can(ctx.EffectiveUser.Id, PermViewUsers) {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.unauthorized"),
+			ShowAlert: true,
+		})
 		return nil
 	}
 
-	reply := ctx.EffectiveMessage.ReplyToMessage
-	if reply == nil {
-		_, err := ctx.EffectiveMessage.Reply(b, "❌ <b>Reply to a message to broadcast</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
-		if err != nil {
-			return fmt.Errorf("error while replying to user: %v", err)
-		}
-		return ext.EndGroups
-	}
+	_, _ = query.Answer(b, nil)
+	_, _, _ = ctx.EffectiveMessage.EditText(b, a.statsText(requestContext(ctx), l), &gotgbot.EditMessageTextOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: menuMarkup(b, l, "stats", ctx.EffectiveUser.Id),
+		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
+			IsDisabled: true,
+		},
+	})
+	return nil
+}
 
-	button := &gotgbot.InlineKeyboardMarkup{}
-	if reply.ReplyMarkup != nil {
-		button.InlineKeyboard = reply.ReplyMarkup.InlineKeyboard
-	}
+// statsText renders the user counts and top referrers shown by /stats.
+func (a *App) statsText(c context.Context, l *Locale) string {
+	total, _ := a.store.CountUsers(c)
+	active, _ := a.store.CountActiveUsers(c, time.Now().Add(-24*time.Hour))
+	text := l.T("stats.users", "total", total, "active", active)
 
-	users, err := getAllUsers()
+	inactive, err := a.store.CountInactiveUsers(c)
 	if err != nil {
-		_, _ = msg.Reply(b, "Error getting users.\n\n"+CustomError(err).Error(), nil)
-		return err
+		log.Printf("Failed to count inactive users: %v", err)
 	}
 
-	successfulBroadcasts := 0
-	for _, u := range users {
-		userId := u.ID
-		_, err = b.CopyMessage(userId, ctx.EffectiveMessage.Chat.Id, reply.MessageId, &gotgbot.CopyMessageOpts{ReplyMarkup: button})
-
-		if err == nil {
-			successfulBroadcasts++
-		}
-
-		time.Sleep(33 * time.Millisecond)
+	var inactiveTotal int64
+	for _, n := range inactive {
+		inactiveTotal += n
 	}
+	text += l.T("stats.inactive", "total", inactiveTotal, "blocked", inactive[ErrKindBlocked],
+		"deactivated", inactive[ErrKindDeactivated], "not_found", inactive[ErrKindChatNotFound])
 
-	_, err = ctx.EffectiveMessage.Reply(b, fmt.Sprintf("✅ <b>Broadcast successfully to %d users</b>", successfulBroadcasts), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	topReferrers, err := a.store.GetTopReferrers(c, 5)
 	if err != nil {
-		return err
+		log.Printf("Failed to fetch top referrers: %v", err)
 	}
 
-	return nil
+	if len(topReferrers) > 0 {
+		text += l.T("stats.top_referrers")
+		for i, u := range topReferrers {
+			text += fmt.Sprintf("%d. %s — %s\n", i+1, mention(&u), l.Number(u.ReferralCount))
+		}
+	}
+	return text
 }
 
 func cancel(b *gotgbot.Bot, ctx *ext.Context) error {
-	button := &gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text:         " Home",
-					CallbackData: "home",
-				},
-			},
-		},
-	}
+	l := tr(ctx)
+	button := menuMarkup(b, l, "back", ctx.EffectiveUser.Id)
 
-	_, err := ctx.EffectiveMessage.Reply(b, "❌ <b>Conversation cancelled</b>", &gotgbot.SendMessageOpts{
+	_, err := ctx.EffectiveMessage.Reply(b, l.T("conversation.cancelled"), &gotgbot.SendMessageOpts{
 		ParseMode:   "html",
 		ReplyMarkup: button,
 	})
@@ -788,80 +936,92 @@ func cancel(b *gotgbot.Bot, ctx *ext.Context) error {
 	return handlers.EndConversation()
 }
 
-func setAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) setAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	query := ctx.CallbackQuery
 
-	_, err := getUser(user.Id)
+	_, err := a.store.GetUser(requestContext(ctx), user.Id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", user.Id, err)
+	}
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ User not found.",
+			Text:      l.T("error.user_not_found"),
 			ShowAlert: true,
 		})
-		_, _, _ = msg.EditText(b, "❌ <b>User not found.</b>", &gotgbot.EditMessageTextOpts{
+		_, _, _ = msg.EditText(b, l.T("error.user_not_found_html"), &gotgbot.EditMessageTextOpts{
 			ParseMode: "HTML",
 		})
 		return nil
 	}
 
 	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-		Text:      "✅ To set the account number, please enter the account number.",
+		Text:      l.T("accno.prompt_alert"),
 		ShowAlert: true,
 	})
 
-	_, _, err = msg.EditText(b, "✅ To set the account number, please enter the account number.\nTo cancel, click /cancel .", &gotgbot.EditMessageTextOpts{
+	_, _, err = msg.EditText(b, l.T("accno.prompt"), &gotgbot.EditMessageTextOpts{
 		ParseMode: "html",
 	})
 
 	if err != nil {
 		log.Printf("Error while editing message: %v", err)
-		_, _ = msg.Reply(b, "❌ Something went wrong while processing your request. Please try again.", nil)
+		_, _ = msg.Reply(b, l.T("error.processing"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.EndConversation()
 	}
 
 	return handlers.NextConversationState(SetAcc)
 }
 
-func setAccAsk(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) setAccAsk(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 
-	_, err := getUser(user.Id)
+	_, err := a.store.GetUser(requestContext(ctx), user.Id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", user.Id, err)
+	}
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ User not found.", nil)
+		_, _ = msg.Reply(b, l.T("error.user_not_found"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
 	accNoInt64 := stringToInt64(msg.Text)
 	if accNoInt64 <= 0 {
-		_, _ = msg.Reply(b, "❌ Invalid account number. Please enter a valid positive number.", nil)
+		_, _ = msg.Reply(b, l.T("accno.invalid"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return nil
 	}
 
-	err = updateUserAccNo(user.Id, accNoInt64)
+	err = a.store.UpdateUserAccNo(requestContext(ctx), user.Id, accNoInt64)
 	if err != nil {
 		log.Printf("Error while setting account number for user %d: %v", user.Id, err)
-		_, _ = msg.Reply(b, "❌ Something went wrong while processing your request. Please try again.", nil)
+		_, _ = msg.Reply(b, l.T("error.processing"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.EndConversation()
 	}
 
-	_, _ = msg.Reply(b, "✅ Account number set successfully.", nil)
+	_, _ = msg.Reply(b, l.T("accno.set"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 	return handlers.EndConversation()
 }
 
-func withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	query := ctx.Update.CallbackQuery
 	user := ctx.EffectiveUser
 
-	userInfo, err := getUser(user.Id)
+	userInfo, err := a.store.GetUser(requestContext(ctx), user.Id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", user.Id, err)
+	}
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ User not found.",
+			Text:      l.T("error.user_not_found"),
 			ShowAlert: true,
 		})
-		_, _, _ = msg.EditText(b, "❌ <b>User not found.</b>", &gotgbot.EditMessageTextOpts{
+		_, _, _ = msg.EditText(b, l.T("error.user_not_found_html"), &gotgbot.EditMessageTextOpts{
 			ParseMode: "HTML",
 		})
 		return nil
@@ -869,10 +1029,10 @@ func withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	if userInfo.Balance <= 0 {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ You have no balance to withdraw.",
+			Text:      l.T("withdraw.no_balance"),
 			ShowAlert: true,
 		})
-		_, _, _ = msg.EditText(b, "❌ <b>You have no balance to withdraw.</b>", &gotgbot.EditMessageTextOpts{
+		_, _, _ = msg.EditText(b, l.T("withdraw.no_balance_html"), &gotgbot.EditMessageTextOpts{
 			ParseMode: "HTML",
 		})
 		return nil
@@ -880,27 +1040,27 @@ func withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	if userInfo.AccNo == 0 {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ You have no account number to withdraw to.",
+			Text:      l.T("withdraw.no_acc_no"),
 			ShowAlert: true,
 		})
-		_, _, _ = msg.EditText(b, "❌ <b>You have no account number to withdraw to.</b>", &gotgbot.EditMessageTextOpts{
+		_, _, _ = msg.EditText(b, l.T("withdraw.no_acc_no_html"), &gotgbot.EditMessageTextOpts{
 			ParseMode: "HTML",
 		})
 		return nil
 	}
 
 	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-		Text:      "💸 Please enter the amount you'd like to withdraw.",
+		Text:      l.T("withdraw.prompt_alert"),
 		ShowAlert: true,
 	})
 
-	_, _, err = msg.EditText(b, "💸 Please send the amount you wish to withdraw.\nFor cancel use /cancel", &gotgbot.EditMessageTextOpts{
+	_, _, err = msg.EditText(b, a.message(requestContext(ctx), l, "withdraw.prompt"), &gotgbot.EditMessageTextOpts{
 		ParseMode: "html",
 	})
 
 	if err != nil {
 		log.Printf("❌ Error while editing message: %v", err)
-		_, _ = msg.Reply(b, "❌ Something went wrong while processing your request. Please try again.", nil)
+		_, _ = msg.Reply(b, l.T("error.processing"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.EndConversation()
 	}
 
@@ -908,167 +1068,175 @@ func withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
 	return handlers.NextConversationState(WITHDRAWAL)
 }
 
-func withdrawalAsk(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) withdrawalAsk(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	text := msg.GetText()
 
 	// Parse the withdrawal amount
 	amount, err := strconv.ParseFloat(text, 64)
-	if err != nil {
-		_, _ = msg.Reply(b, "❌ Oops! Invalid amount. Please enter a valid number to withdraw. 💸", nil)
+	if err != nil || amount <= 0 {
+		_, _ = msg.Reply(b, l.T("withdraw.invalid_amount"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.NextConversationState(WITHDRAWAL)
 	}
 
 	// Get user data
-	userInfo, err := getUser(user.Id)
+	userInfo, err := a.store.GetUser(requestContext(ctx), user.Id)
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Something went wrong. "+CustomError(err).Error()+" Please try again later.", nil)
+		_, _ = msg.Reply(b, l.T("withdraw.lookup_failed", "error", CustomError(err).Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.EndConversation()
 	}
 
 	// Check if the user has sufficient balance
 	if amount > userInfo.Balance {
-		_, _ = msg.Reply(b, "❌ Insufficient balance. 💳 Please try again with a valid amount.", nil)
+		_, _ = msg.Reply(b, l.T("withdraw.insufficient"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.NextConversationState(WITHDRAWAL)
 	}
 
 	// Remove balance from user account
-	_, err = removeBalance(msg.From.Id, amount)
+	err = a.store.ApplyLedgerEntry(requestContext(ctx), LedgerEntry{UserID: user.Id, Amount: -amount, Kind: LedgerWithdrawal, Actor: user.Id})
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Failed to process your withdrawal request. "+err.Error(), nil)
+		_, _ = msg.Reply(b, l.T("withdraw.failed", "error", err.Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.EndConversation()
 	}
 
+	withdrawalID, err := a.store.AddWithdrawal(requestContext(ctx), Withdrawal{UserID: user.Id, Amount: amount, AccNo: userInfo.AccNo})
+	if err != nil {
+		log.Printf("Failed to store withdrawal request: %v", err)
+	}
+
 	// Send confirmation button
+	callbackData := fmt.Sprintf("confirm_withdrawal.%s", withdrawalID.Hex())
+	if withdrawalID.IsZero() {
+		callbackData = fmt.Sprintf("confirm_withdrawal.%d.%f", user.Id, amount)
+	}
+
 	button := gotgbot.InlineKeyboardMarkup{
 		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
 			{
 				{
-					Text:         "✅ Confirm Withdrawal",
-					CallbackData: fmt.Sprintf("confirm_withdrawal.%d.%f", user.Id, amount),
+					Text:         l.T("withdraw.confirm"),
+					CallbackData: callbackData,
 				},
 			},
 		},
 	}
 
 	// Log the withdrawal request
-	loggerMsg := fmt.Sprintf("💰 <b>%s</b> requested a withdrawal of %.2f\n\nUser AccNo: <code>%d</code>", user.FirstName, amount, userInfo.AccNo)
+	loggerMsg := localeFor().T("withdraw.request",
+		"user", mention(userInfo), "amount", amount, "id", fmt.Sprint(userInfo.ID), "acc_no", fmt.Sprint(userInfo.AccNo))
 
 	// Send to logger
 	_, err = b.SendMessage(LoggerID, loggerMsg, &gotgbot.SendMessageOpts{ReplyMarkup: button, ParseMode: "html"})
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Failed to send withdrawal request to the logger. "+CustomError(err).Error(), nil)
+		_, _ = msg.Reply(b, l.T("withdraw.logger_failed", "error", CustomError(err).Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 		return handlers.EndConversation()
 	}
 
-	_, _ = msg.Reply(b, "🎉 Withdrawal Request Submitted! 🎉\n\n- 🕒 Processing Time: Please allow a few hours for our team to review and approve your request.", nil)
+	_, _ = msg.Reply(b, a.message(requestContext(ctx), l, "withdraw.submitted"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 
 	return handlers.EndConversation()
 }
 
-func confirmWithdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) confirmWithdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+	l := tr(ctx)
 	msg := ctx.EffectiveMessage
 	query := ctx.Update.CallbackQuery
 	data := query.Data
 
-	splitData := strings.Split(data, ".")
-	if len(splitData) < 3 {
-		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid callback data.",
-			ShowAlert: true,
-		})
-		return nil
-	}
+	var userID int64
+	var amount float64
+	splitData := strings.SplitN(data, ".", 3)
+	switch len(splitData) {
+	case 2:
+		withdrawalID, err := primitive.ObjectIDFromHex(splitData[1])
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+				Text:      l.T("withdraw.invalid_id"),
+				ShowAlert: true,
+			})
+			return nil
+		}
 
-	userID, err := strconv.ParseInt(splitData[1], 10, 64)
-	if err != nil {
-		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid user ID.",
-			ShowAlert: true,
-		})
-		return nil
-	}
+		w, err := a.store.ApproveWithdrawal(requestContext(ctx), withdrawalID)
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+				Text:      "❌ " + err.Error(),
+				ShowAlert: true,
+			})
+			return nil
+		}
+		userID, amount = w.UserID, w.Amount
+	case 3:
+		// Requests made before withdrawals were stored carry the user and amount.
+		var err error
+		userID, err = strconv.ParseInt(splitData[1], 10, 64)
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+				Text:      l.T("withdraw.invalid_user"),
+				ShowAlert: true,
+			})
+			return nil
+		}
 
-	amount, err := strconv.ParseFloat(splitData[2], 64)
-	if err != nil {
+		amount, err = strconv.ParseFloat(splitData[2], 64)
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+				Text:      l.T("withdraw.invalid_value"),
+				ShowAlert: true,
+			})
+			return nil
+		}
+	default:
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid amount.",
+			Text:      l.T("error.invalid_callback"),
 			ShowAlert: true,
 		})
 		return nil
 	}
 
 	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-		Text: "✅ Processing withdrawal request...",
+		Text: l.T("withdraw.processing"),
 	})
 
-	_, _, _ = msg.EditText(b, fmt.Sprintf("✅ Done! Amount of %.2f successfully withdrawn.", amount), nil)
+	_, _, _ = msg.EditText(b, l.T("withdraw.done", "amount", amount), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
 
-	text := fmt.Sprintf(`🎉 Withdrawal Approved! 🎉
+	text := a.message(requestContext(ctx), userLocale(requestContext(ctx), a.store, userID), "withdraw.approved", "amount", amount)
 
-✅ Your withdrawal request has been successfully approved!
-
-💸 Amount: %.2f
-
-Thank you for trusting us! 🚀`, amount)
-
-	_, err = b.SendMessage(userID, text, nil)
+	_, err := b.SendMessage(userID, text, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Failed to send the approved withdrawal message. "+CustomError(err).Error(), nil)
+		_, _ = msg.Reply(b, l.T("withdraw.notify_failed", "error", CustomError(err).Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
 	}
 
 	return nil
 }
 
-func home(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *App) home(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	quary := ctx.CallbackQuery
+	l := tr(ctx)
 
-	referUrl := fmt.Sprintf("https://t.me/%s?start=%d", b.User.Username, user.Id)
-
-	button := gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text: "👤 Owner",
-					Url:  fmt.Sprintf("tg://user?id=%d", OwnerID),
-				},
-			},
-			{
-				{
-					Text: "🔗 Refer & Earn",
-					Url:  fmt.Sprintf("https://t.me/share/url?url=%s", referUrl),
-				},
-				{
-					Text:         "ℹ️ Info",
-					CallbackData: fmt.Sprintf("info.%d", user.Id),
-				},
-			},
-			{
-				{
-					Text:         "💼 Wallet",
-					CallbackData: fmt.Sprintf("wallet.%d", user.Id),
-				},
-				{
-					Text:         "💸 Withdraw",
-					CallbackData: fmt.Sprintf("withdraw.%d", user.Id),
-				},
-			},
-		},
+	existingUser, err := a.store.GetUser(requestContext(ctx), user.Id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve user %d: %w", user.Id, err)
+	}
+	if err != nil {
+		_, _ = quary.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.user_not_found"),
+			ShowAlert: true,
+		})
+		return nil
 	}
+
+	button := menuMarkup(b, l, "home", user.Id)
 	_, _ = quary.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-		Text: "🔙 Back to Main Menu",
+		Text: l.T("menu.back"),
 	})
 
-	existingUser, _ := getUser(user.Id)
-	response := fmt.Sprintf(
-		"👋 <b>Welcome back, %s!</b>\n\n"+
-			"💰 <b>Balance:</b> %.2f\n"+
-			"🤝 <b>Referred Users:</b> %d\n\n"+
-			"🚀 Keep earning rewards by referring your friends!",
-		user.FirstName, existingUser.Balance, len(existingUser.ReferredUsers))
+	response := a.message(requestContext(ctx), l, "start.welcome_back",
+		"name", user.FirstName, "balance", existingUser.Balance, "referrals", existingUser.ReferralCount)
 
 	_, _, _ = msg.EditText(b, response, &gotgbot.EditMessageTextOpts{
 		ParseMode:   "HTML",
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFormatUserInfoEscapesNames(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range hostileNames {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			if err := store.AddUser(ctx, User{ID: 1, FirstName: tc.name, Username: tc.name}); err != nil {
+				t.Fatal(err)
+			}
+			user := User{ID: 2, FirstName: tc.name, Referrer: 1}
+			if err := store.AddUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			a := &App{store: store, base: ctx}
+
+			got := a.formatUserInfo(ctx, locales["en"], &user)
+			for _, want := range []string{
+				`<a href="tg://user?id=2">` + tc.escaped + `</a>`,
+				`<a href="tg://user?id=1">` + tc.escaped + `</a> (@` + tc.escaped + `)`,
+			} {
+				if !strings.Contains(got, want) {
+					t.Errorf("formatUserInfo() = %q, want it to contain %q", got, want)
+				}
+			}
+			if strings.Contains(got, tc.name) {
+				t.Errorf("formatUserInfo() = %q, contains the unescaped name", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,1209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is a Store that keeps everything in process memory. Data is
+// lost on restart, so it is meant for local runs and tests.
+type MemoryStore struct {
+	mu            sync.Mutex
+	users         map[int64]*User
+	referrals     map[int64]Referral // keyed by referee
+	ledger        []LedgerEntry
+	withdrawals   []*Withdrawal
+	broadcasts    []*Broadcast // in creation order
+	failures      []BroadcastFailure
+	deliveries    []BroadcastDelivery
+	schedules     []*Schedule
+	batches       []*BalanceBatch
+	templates     map[string]MessageTemplate
+	conversations map[string]Conversation
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:         map[int64]*User{},
+		referrals:     map[int64]Referral{},
+		templates:     map[string]MessageTemplate{},
+		conversations: map[string]Conversation{},
+	}
+}
+
+func (s *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// sortedUsers returns the users ordered by ID. The caller holds s.mu.
+func (s *MemoryStore) sortedUsers() []*User {
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+func (s *MemoryStore) addUser(user User) error {
+	if _, ok := s.users[user.ID]; ok {
+		return fmt.Errorf("user with ID %d already exists", user.ID)
+	}
+
+	if user.JoinedAt.IsZero() {
+		user.JoinedAt = time.Now().UTC()
+	}
+	if user.LastSeen.IsZero() {
+		user.LastSeen = user.JoinedAt
+	}
+	s.users[user.ID] = &user
+	return nil
+}
+
+func (s *MemoryStore) AddUser(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addUser(user)
+}
+
+func (s *MemoryStore) ReferUser(ctx context.Context, referrerID int64, newUser User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referrer, ok := s.users[referrerID]
+	if !ok {
+		return fmt.Errorf("referrer with ID %d does not exist", referrerID)
+	}
+
+	newUser.Referrer = referrerID
+	newUser.RewardPending = true
+	if err := s.addUser(newUser); err != nil {
+		return err
+	}
+
+	s.referrals[newUser.ID] = Referral{Referrer: referrerID, Referee: newUser.ID, CreatedAt: time.Now().UTC()}
+	referrer.ReferralCount++
+	return nil
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, userID int64) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user := *u
+	return &user, nil
+}
+
+func (s *MemoryStore) GetReferredUsers(ctx context.Context, referrerID, cursor int64, backward bool, limit int64) ([]User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var referrals []Referral
+	for _, r := range s.referrals {
+		if r.Referrer != referrerID {
+			continue
+		}
+		if backward && r.Referee >= cursor || !backward && cursor != 0 && r.Referee <= cursor {
+			continue
+		}
+		referrals = append(referrals, r)
+	}
+
+	sort.Slice(referrals, func(i, j int) bool {
+		if backward {
+			return referrals[i].Referee > referrals[j].Referee
+		}
+		return referrals[i].Referee < referrals[j].Referee
+	})
+
+	hasMore := int64(len(referrals)) > limit
+	if hasMore {
+		referrals = referrals[:limit]
+	}
+
+	if backward {
+		for i, j := 0, len(referrals)-1; i < j; i, j = i+1, j-1 {
+			referrals[i], referrals[j] = referrals[j], referrals[i]
+		}
+	}
+
+	referredUsers := make([]User, 0, len(referrals))
+	for _, r := range referrals {
+		u := User{ID: r.Referee, Referrer: referrerID}
+		if found, ok := s.users[r.Referee]; ok {
+			u = *found
+		}
+		if u.JoinedAt.IsZero() {
+			u.JoinedAt = r.CreatedAt
+		}
+		referredUsers = append(referredUsers, u)
+	}
+	return referredUsers, hasMore, nil
+}
+
+func (s *MemoryStore) CountReferredUsers(ctx context.Context, referrerID int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int64
+	for _, r := range s.referrals {
+		if r.Referrer == referrerID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) MarkReferralRewarded(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.RewardPending = false
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateUserProfile(ctx context.Context, profile User) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[profile.ID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	u.FirstName = profile.FirstName
+	u.Username = profile.Username
+	u.LanguageCode = profile.LanguageCode
+	u.IsPremium = profile.IsPremium
+	u.LastSeen = time.Now().UTC()
+	u.Inactive = false
+	u.InactiveSince = time.Time{}
+	u.InactiveReason = ""
+
+	user := *u
+	return &user, nil
+}
+
+func (s *MemoryStore) SearchUsers(ctx context.Context, query string, limit int64) ([]User, error) {
+	query = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(query), "@"))
+	if query == "" {
+		return nil, nil
+	}
+
+	id, idErr := strconv.ParseInt(query, 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []User
+	for _, u := range s.sortedUsers() {
+		if int64(len(users)) >= limit {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(u.Username), query) ||
+			strings.HasPrefix(strings.ToLower(u.FirstName), query) ||
+			idErr == nil && u.ID == id {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) SetUserBanned(ctx context.Context, userID int64, banned bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.Banned = banned
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateUserAccNo(ctx context.Context, userID int64, accNo int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.AccNo = accNo
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetUserLanguage(ctx context.Context, userID int64, language string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.Language = language
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateUserBalance(ctx context.Context, userID int64, amount float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Balance += amount
+	return nil
+}
+
+func (s *MemoryStore) RemoveBalance(ctx context.Context, userID int64, amount float64) (float64, error) {
+	if amount <= 0 {
+		return 0, fmt.Errorf("amount to remove must be greater than zero")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return 0, fmt.Errorf("user with ID %d does not exist", userID)
+	}
+	if u.Balance-amount < 0 {
+		return 0, fmt.Errorf("insufficient balance for user %d", userID)
+	}
+
+	u.Balance -= amount
+	return u.Balance, nil
+}
+
+func (s *MemoryStore) MarkUserInactive(ctx context.Context, userID int64, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.Inactive = true
+		u.InactiveSince = time.Now().UTC()
+		u.InactiveReason = reason
+	}
+	return nil
+}
+
+func (s *MemoryStore) CountUsers(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.users)), nil
+}
+
+func (s *MemoryStore) CountActiveUsers(ctx context.Context, since time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int64
+	for _, u := range s.users {
+		if !u.LastSeen.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) CountInactiveUsers(ctx context.Context) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := map[string]int64{}
+	for _, u := range s.users {
+		if u.Inactive {
+			counts[u.InactiveReason]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *MemoryStore) GetTopReferrers(ctx context.Context, limit int64) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []User
+	for _, u := range s.sortedUsers() {
+		if u.ReferralCount > 0 {
+			users = append(users, *u)
+		}
+	}
+
+	sort.SliceStable(users, func(i, j int) bool { return users[i].ReferralCount > users[j].ReferralCount })
+	if int64(len(users)) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) CountReachableUsers(ctx context.Context, segment *Segment) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int64
+	for _, u := range s.users {
+		if !u.Inactive && !u.Banned && segment.Match(u) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) GetUserIDsAfter(ctx context.Context, after int64, limit int64, segment *Segment) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []int64
+	for _, u := range s.sortedUsers() {
+		if int64(len(ids)) >= limit {
+			break
+		}
+		if u.ID > after && !u.Inactive && !u.Banned && segment.Match(u) {
+			ids = append(ids, u.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) EachUser(ctx context.Context, from, before time.Time, fn func(User) error) error {
+	s.mu.Lock()
+	var users []User
+	for _, u := range s.sortedUsers() {
+		if inRange(u.JoinedAt, from, before) {
+			users = append(users, *u)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, u := range users {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inRange reports whether t is in [from, before), where zero ends are open.
+func inRange(t, from, before time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (before.IsZero() || t.Before(before))
+}
+
+func (s *MemoryStore) AddLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = primitive.NewObjectID()
+	entry.CreatedAt = time.Now().UTC()
+	s.ledger = append(s.ledger, entry)
+	return nil
+}
+
+func (s *MemoryStore) ApplyLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[entry.UserID]
+	if !ok {
+		return ErrNotFound
+	}
+	if u.Balance+entry.Amount < 0 {
+		return fmt.Errorf("insufficient balance for user %d", entry.UserID)
+	}
+
+	u.Balance += entry.Amount
+	entry.ID = primitive.NewObjectID()
+	entry.CreatedAt = time.Now().UTC()
+	s.ledger = append(s.ledger, entry)
+	return nil
+}
+
+func (s *MemoryStore) ApplyBatchEntry(ctx context.Context, entry LedgerEntry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.ledger {
+		if e.Batch == entry.Batch && e.Row == entry.Row && e.Kind == entry.Kind {
+			return false, nil
+		}
+	}
+
+	u, ok := s.users[entry.UserID]
+	if !ok {
+		return false, fmt.Errorf("user with ID %d does not exist", entry.UserID)
+	}
+	if u.Balance+entry.Amount < 0 {
+		return false, fmt.Errorf("insufficient balance for user %d", entry.UserID)
+	}
+
+	u.Balance += entry.Amount
+	entry.ID = primitive.NewObjectID()
+	entry.CreatedAt = time.Now().UTC()
+	s.ledger = append(s.ledger, entry)
+	return true, nil
+}
+
+func (s *MemoryStore) GetLedgerEntries(ctx context.Context, userID int64, limit int64) ([]LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []LedgerEntry
+	for i := len(s.ledger) - 1; i >= 0 && int64(len(entries)) < limit; i-- {
+		if s.ledger[i].UserID == userID {
+			entries = append(entries, s.ledger[i])
+		}
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) GetLedgerSummary(ctx context.Context, userID int64) (*LedgerSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := LedgerSummary{}
+	for _, e := range s.ledger {
+		if e.UserID != userID {
+			continue
+		}
+		if e.Amount > 0 {
+			summary.Credits += e.Amount
+		} else {
+			summary.Debits += e.Amount
+		}
+		summary.Entries++
+	}
+	return &summary, nil
+}
+
+func (s *MemoryStore) EachLedgerEntry(ctx context.Context, from, before time.Time, fn func(LedgerEntry) error) error {
+	s.mu.Lock()
+	var entries []LedgerEntry
+	for _, e := range s.ledger {
+		if inRange(e.CreatedAt, from, before) {
+			entries = append(entries, e)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) EachBatchLedgerEntry(ctx context.Context, batch primitive.ObjectID, fn func(LedgerEntry) error) error {
+	s.mu.Lock()
+	var entries []LedgerEntry
+	for _, e := range s.ledger {
+		if e.Batch == batch {
+			entries = append(entries, e)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddWithdrawal(ctx context.Context, w Withdrawal) (primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.ID = primitive.NewObjectID()
+	w.Status = WithdrawalPending
+	w.RequestedAt = time.Now().UTC()
+	s.withdrawals = append(s.withdrawals, &w)
+	return w.ID, nil
+}
+
+func (s *MemoryStore) ApproveWithdrawal(ctx context.Context, id primitive.ObjectID) (*Withdrawal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.withdrawals {
+		if w.ID == id && w.Status == WithdrawalPending {
+			w.Status = WithdrawalApproved
+			w.ApprovedAt = time.Now().UTC()
+			approved := *w
+			return &approved, nil
+		}
+	}
+	return nil, fmt.Errorf("withdrawal %s not found or already approved", id.Hex())
+}
+
+func (s *MemoryStore) GetWithdrawals(ctx context.Context, userID int64, limit int64) ([]Withdrawal, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		withdrawals []Withdrawal
+		count       int64
+	)
+	for i := len(s.withdrawals) - 1; i >= 0; i-- {
+		if s.withdrawals[i].UserID != userID {
+			continue
+		}
+		count++
+		if int64(len(withdrawals)) < limit {
+			withdrawals = append(withdrawals, *s.withdrawals[i])
+		}
+	}
+	return withdrawals, count, nil
+}
+
+func (s *MemoryStore) EachWithdrawal(ctx context.Context, from, before time.Time, fn func(Withdrawal) error) error {
+	s.mu.Lock()
+	var withdrawals []Withdrawal
+	for _, w := range s.withdrawals {
+		if inRange(w.RequestedAt, from, before) {
+			withdrawals = append(withdrawals, *w)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.SliceStable(withdrawals, func(i, j int) bool { return withdrawals[i].RequestedAt.Before(withdrawals[j].RequestedAt) })
+	for _, w := range withdrawals {
+		if err := fn(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBroadcast returns a copy of job that shares no maps with it.
+func copyBroadcast(job *Broadcast) *Broadcast {
+	c := *job
+	if job.Errors != nil {
+		c.Errors = make(map[string]int64, len(job.Errors))
+		for k, v := range job.Errors {
+			c.Errors[k] = v
+		}
+	}
+	return &c
+}
+
+// broadcast returns the stored job with id. The caller holds s.mu.
+func (s *MemoryStore) broadcast(id primitive.ObjectID) *Broadcast {
+	for _, job := range s.broadcasts {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddBroadcast(ctx context.Context, job Broadcast) (primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !job.ScheduleID.IsZero() {
+		for _, queued := range s.broadcasts {
+			if queued.ScheduleID == job.ScheduleID && queued.ScheduleRun.Equal(job.ScheduleRun) {
+				return primitive.NilObjectID, ErrAlreadyQueued
+			}
+		}
+	}
+
+	job.ID = primitive.NewObjectID()
+	if job.Status == "" {
+		job.Status = BroadcastQueued
+	}
+	job.CreatedAt = time.Now().UTC()
+	s.broadcasts = append(s.broadcasts, copyBroadcast(&job))
+	return job.ID, nil
+}
+
+func (s *MemoryStore) GetBroadcast(ctx context.Context, id primitive.ObjectID) (*Broadcast, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.broadcast(id)
+	if job == nil {
+		return nil, ErrNotFound
+	}
+	return copyBroadcast(job), nil
+}
+
+func (s *MemoryStore) ClaimBroadcast(ctx context.Context, worker string, lease time.Duration) (*Broadcast, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, job := range s.broadcasts {
+		if (job.Status == BroadcastQueued || job.Status == BroadcastRunning) && job.LeaseUntil.Before(now) {
+			job.Status = BroadcastRunning
+			job.Worker = worker
+			job.LeaseUntil = now.Add(lease)
+			return copyBroadcast(job), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) CheckpointBroadcast(ctx context.Context, job *Broadcast, worker string, lease time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.broadcast(job.ID)
+	if current == nil || current.Worker != worker {
+		return "", nil
+	}
+
+	saved := copyBroadcast(job)
+	current.Cursor = saved.Cursor
+	current.Sent = saved.Sent
+	current.Failed = saved.Failed
+	current.Errors = saved.Errors
+	current.LeaseUntil = time.Now().UTC().Add(lease)
+	return current.Status, nil
+}
+
+func (s *MemoryStore) FinishBroadcast(ctx context.Context, job *Broadcast, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.Status = status
+	job.FinishedAt = time.Now().UTC()
+	if current := s.broadcast(job.ID); current != nil {
+		saved := copyBroadcast(job)
+		current.Status = saved.Status
+		current.Cursor = saved.Cursor
+		current.Sent = saved.Sent
+		current.Failed = saved.Failed
+		current.Errors = saved.Errors
+		current.FinishedAt = saved.FinishedAt
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetBroadcastStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*Broadcast, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.broadcast(id)
+	if job != nil {
+		for _, f := range from {
+			if job.Status != f {
+				continue
+			}
+
+			before := copyBroadcast(job)
+			job.Status = status
+			if status == BroadcastQueued {
+				// Let any worker claim the resumed job straight away.
+				job.LeaseUntil = time.Time{}
+			}
+			return before, nil
+		}
+	}
+	return nil, fmt.Errorf("broadcast can no longer be changed")
+}
+
+func (s *MemoryStore) SetBroadcastOptions(ctx context.Context, id primitive.ObjectID, opts BroadcastOptions) (*Broadcast, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.broadcast(id)
+	if job == nil || job.Status != BroadcastDraft {
+		return nil, fmt.Errorf("broadcast can no longer be changed")
+	}
+	job.BroadcastOptions = opts
+	return copyBroadcast(job), nil
+}
+
+func (s *MemoryStore) AddBroadcastFailure(ctx context.Context, f BroadcastFailure) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f.At = time.Now().UTC()
+	s.failures = append(s.failures, f)
+	return nil
+}
+
+// EachBroadcastFailure calls fn on a snapshot, so fn may use the store.
+func (s *MemoryStore) EachBroadcastFailure(ctx context.Context, id primitive.ObjectID, fn func(BroadcastFailure) error) error {
+	s.mu.Lock()
+	var failures []BroadcastFailure
+	for _, f := range s.failures {
+		if f.BroadcastID == id {
+			failures = append(failures, f)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.SliceStable(failures, func(i, j int) bool { return failures[i].UserID < failures[j].UserID })
+	for _, f := range failures {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddBroadcastDeliveries(ctx context.Context, deliveries []BroadcastDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deliveries = append(s.deliveries, deliveries...)
+	return nil
+}
+
+// EachBroadcastDelivery calls fn on a snapshot, so fn may use the store.
+func (s *MemoryStore) EachBroadcastDelivery(ctx context.Context, id primitive.ObjectID, fn func(BroadcastDelivery) error) error {
+	s.mu.Lock()
+	var deliveries []BroadcastDelivery
+	for _, d := range s.deliveries {
+		if d.BroadcastID == id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range deliveries {
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteBroadcastDeliveries(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.deliveries[:0]
+	for _, d := range s.deliveries {
+		if d.BroadcastID != id {
+			kept = append(kept, d)
+		}
+	}
+	s.deliveries = kept
+	return nil
+}
+
+// activeSchedule returns the active schedule with id. The caller holds s.mu.
+func (s *MemoryStore) activeSchedule(id primitive.ObjectID) *Schedule {
+	for _, sch := range s.schedules {
+		if sch.ID == id && sch.Active {
+			return sch
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddSchedule(ctx context.Context, sch Schedule) (primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch.ID = primitive.NewObjectID()
+	sch.Active = true
+	sch.CreatedAt = time.Now().UTC()
+	s.schedules = append(s.schedules, &sch)
+	return sch.ID, nil
+}
+
+func (s *MemoryStore) GetActiveSchedules(ctx context.Context) ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var schedules []Schedule
+	for _, sch := range s.schedules {
+		if sch.Active {
+			schedules = append(schedules, *sch)
+		}
+	}
+	sort.SliceStable(schedules, func(i, j int) bool { return schedules[i].NextRun.Before(schedules[j].NextRun) })
+	return schedules, nil
+}
+
+func (s *MemoryStore) GetDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var schedules []Schedule
+	for _, sch := range s.schedules {
+		if sch.Active && !sch.NextRun.After(now) {
+			schedules = append(schedules, *sch)
+		}
+	}
+	return schedules, nil
+}
+
+func (s *MemoryStore) GetSchedule(ctx context.Context, id primitive.ObjectID) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch := s.activeSchedule(id)
+	if sch == nil {
+		return nil, ErrNotFound
+	}
+	found := *sch
+	return &found, nil
+}
+
+func (s *MemoryStore) AdvanceSchedule(ctx context.Context, sch *Schedule, next time.Time, failures int, lastError string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.activeSchedule(sch.ID)
+	if current == nil || !current.NextRun.Equal(sch.NextRun) {
+		return false, nil
+	}
+
+	current.LastRun = time.Now().UTC()
+	current.CurrentRun = sch.CurrentRun
+	current.Failures = failures
+	current.LastError = lastError
+	if next.IsZero() {
+		current.Active = false
+	} else {
+		current.NextRun = next
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) SetScheduleOptions(ctx context.Context, id primitive.ObjectID, opts BroadcastOptions) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch := s.activeSchedule(id)
+	if sch == nil {
+		return nil, ErrNotFound
+	}
+	sch.BroadcastOptions = opts
+	updated := *sch
+	return &updated, nil
+}
+
+func (s *MemoryStore) UpdateSchedule(ctx context.Context, id primitive.ObjectID, cron string, next time.Time, segment string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch := s.activeSchedule(id)
+	if sch == nil {
+		return fmt.Errorf("schedule %s not found", id.Hex())
+	}
+	sch.Cron = cron
+	sch.NextRun = next
+	sch.CurrentRun = time.Time{}
+	sch.Segment = segment
+	return nil
+}
+
+func (s *MemoryStore) CancelSchedule(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch := s.activeSchedule(id)
+	if sch == nil {
+		return fmt.Errorf("schedule %s not found", id.Hex())
+	}
+	sch.Active = false
+	return nil
+}
+
+func copyBatch(batch *BalanceBatch) *BalanceBatch {
+	c := *batch
+	c.Rows = append([]BatchRow(nil), batch.Rows...)
+	return &c
+}
+
+// batch returns the stored batch with id. The caller holds s.mu.
+func (s *MemoryStore) batch(id primitive.ObjectID) *BalanceBatch {
+	for _, batch := range s.batches {
+		if batch.ID == id {
+			return batch
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddBalanceBatch(ctx context.Context, batch BalanceBatch) (primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch.ID = primitive.NewObjectID()
+	batch.Status = BatchPending
+	batch.CreatedAt = time.Now().UTC()
+	s.batches = append(s.batches, copyBatch(&batch))
+	return batch.ID, nil
+}
+
+func (s *MemoryStore) GetBalanceBatch(ctx context.Context, id primitive.ObjectID) (*BalanceBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := s.batch(id)
+	if batch == nil {
+		return nil, ErrNotFound
+	}
+	return copyBatch(batch), nil
+}
+
+func (s *MemoryStore) SetBalanceBatchStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*BalanceBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := s.batch(id)
+	if batch == nil || !contains(from, batch.Status) {
+		return nil, ErrBatchChanged
+	}
+	before := copyBatch(batch)
+	batch.Status = status
+	return before, nil
+}
+
+func (s *MemoryStore) GetBalanceBatchesByStatus(ctx context.Context, statuses []string) ([]BalanceBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var batches []BalanceBatch
+	for _, batch := range s.batches {
+		if contains(statuses, batch.Status) {
+			batches = append(batches, *copyBatch(batch))
+		}
+	}
+	return batches, nil
+}
+
+func (s *MemoryStore) GetConversation(ctx context.Context, key string) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conv, ok := s.conversations[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &conv, nil
+}
+
+func (s *MemoryStore) SaveConversation(ctx context.Context, conv Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.conversations[conv.Key]; ok && conv.PromptMessageID == 0 {
+		conv.PromptChatID = old.PromptChatID
+		conv.PromptMessageID = old.PromptMessageID
+	}
+	s.conversations[conv.Key] = conv
+	return nil
+}
+
+func (s *MemoryStore) DeleteConversation(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conversations, key)
+	return nil
+}
+
+func (s *MemoryStore) TakeExpiredConversation(ctx context.Context, now time.Time) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, conv := range s.conversations {
+		if !conv.ExpiresAt.IsZero() && !conv.ExpiresAt.After(now) {
+			delete(s.conversations, key)
+			return &conv, nil
+		}
+	}
+	return nil, nil
+}
+
+// sortedTemplates returns the edited messages ordered by ID. The caller holds s.mu.
+func (s *MemoryStore) sortedTemplates() []MessageTemplate {
+	templates := make([]MessageTemplate, 0, len(s.templates))
+	for _, tmpl := range s.templates {
+		templates = append(templates, tmpl)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].ID < templates[j].ID })
+	return templates
+}
+
+func (s *MemoryStore) GetMessageTemplate(ctx context.Context, message, language string) (*MessageTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpl, ok := s.templates[messageTemplateID(message, language)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &tmpl, nil
+}
+
+func (s *MemoryStore) GetMessageTemplates(ctx context.Context) ([]MessageTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedTemplates(), nil
+}
+
+func (s *MemoryStore) SetMessageTemplate(ctx context.Context, tmpl MessageTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpl.ID = messageTemplateID(tmpl.Message, tmpl.Language)
+	s.templates[tmpl.ID] = tmpl
+	return nil
+}
+
+func (s *MemoryStore) DeleteMessageTemplate(ctx context.Context, message, language string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := messageTemplateID(message, language)
+	if _, ok := s.templates[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.templates, id)
+	return nil
+}
+
+func (s *MemoryStore) ExportRecords(ctx context.Context, collection string, fn func(record any) error) error {
+	s.mu.Lock()
+	var records []any
+	switch collection {
+	case "users":
+		for _, u := range s.sortedUsers() {
+			u := *u
+			records = append(records, &u)
+		}
+	case "referrals":
+		for _, r := range s.referrals {
+			records = append(records, &r)
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].(*Referral).Referee < records[j].(*Referral).Referee })
+	case "ledger":
+		for _, e := range s.ledger {
+			records = append(records, &e)
+		}
+	case "withdrawals":
+		for _, w := range s.withdrawals {
+			w := *w
+			records = append(records, &w)
+		}
+	case "broadcasts":
+		for _, job := range s.broadcasts {
+			records = append(records, copyBroadcast(job))
+		}
+	case "broadcast_failures":
+		for _, f := range s.failures {
+			records = append(records, &f)
+		}
+	case "broadcast_deliveries":
+		for _, d := range s.deliveries {
+			records = append(records, &d)
+		}
+	case "schedules":
+		for _, sch := range s.schedules {
+			sch := *sch
+			records = append(records, &sch)
+		}
+	case "balance_batches":
+		for _, batch := range s.batches {
+			records = append(records, copyBatch(batch))
+		}
+	case "message_templates":
+		for _, tmpl := range s.sortedTemplates() {
+			records = append(records, &tmpl)
+		}
+	default:
+		s.mu.Unlock()
+		return fmt.Errorf("unknown collection %q", collection)
+	}
+	s.mu.Unlock()
+
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ImportRecords(ctx context.Context, next func() (string, any, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Restored records are older than most, so keep the slices in ID order,
+	// which is creation order.
+	defer func() {
+		sort.SliceStable(s.ledger, func(i, j int) bool { return s.ledger[i].ID.Hex() < s.ledger[j].ID.Hex() })
+		sort.SliceStable(s.withdrawals, func(i, j int) bool { return s.withdrawals[i].ID.Hex() < s.withdrawals[j].ID.Hex() })
+		sort.SliceStable(s.broadcasts, func(i, j int) bool { return s.broadcasts[i].ID.Hex() < s.broadcasts[j].ID.Hex() })
+		sort.SliceStable(s.batches, func(i, j int) bool { return s.batches[i].ID.Hex() < s.batches[j].ID.Hex() })
+	}()
+
+	for {
+		_, record, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch r := record.(type) {
+		case *User:
+			u := *r
+			s.users[u.ID] = &u
+		case *Referral:
+			s.referrals[r.Referee] = *r
+		case *LedgerEntry:
+			s.ledger = replaceOrAppend(s.ledger, *r, func(e LedgerEntry) bool { return e.ID == r.ID })
+		case *Withdrawal:
+			w := *r
+			s.withdrawals = replaceOrAppend(s.withdrawals, &w, func(o *Withdrawal) bool { return o.ID == r.ID })
+		case *Broadcast:
+			s.broadcasts = replaceOrAppend(s.broadcasts, copyBroadcast(r), func(o *Broadcast) bool { return o.ID == r.ID })
+		case *BroadcastFailure:
+			s.failures = replaceOrAppend(s.failures, *r, func(o BroadcastFailure) bool {
+				return o.BroadcastID == r.BroadcastID && o.UserID == r.UserID
+			})
+		case *BroadcastDelivery:
+			s.deliveries = replaceOrAppend(s.deliveries, *r, func(o BroadcastDelivery) bool {
+				return o.BroadcastID == r.BroadcastID && o.UserID == r.UserID
+			})
+		case *Schedule:
+			sch := *r
+			s.schedules = replaceOrAppend(s.schedules, &sch, func(o *Schedule) bool { return o.ID == r.ID })
+		case *BalanceBatch:
+			s.batches = replaceOrAppend(s.batches, copyBatch(r), func(o *BalanceBatch) bool { return o.ID == r.ID })
+		case *MessageTemplate:
+			s.templates[r.ID] = *r
+		default:
+			return fmt.Errorf("unknown record type %T", record)
+		}
+	}
+}
+
+// replaceOrAppend replaces the first element of list that same matches with v,
+// or appends v if there is none.
+func replaceOrAppend[T any](list []T, v T, same func(T) bool) []T {
+	for i := range list {
+		if same(list[i]) {
+			list[i] = v
+			return list
+		}
+	}
+	return append(list, v)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryStoreRemoveBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		userID  int64
+		amount  float64
+		want    float64
+		wantErr bool
+	}{
+		{name: "sufficient", userID: 1, amount: 4, want: 6},
+		{name: "whole balance", userID: 1, amount: 10, want: 0},
+		{name: "insufficient", userID: 1, amount: 10.01, want: 10, wantErr: true},
+		{name: "zero amount", userID: 1, amount: 0, want: 10, wantErr: true},
+		{name: "negative amount", userID: 1, amount: -5, want: 10, wantErr: true},
+		{name: "unknown user", userID: 2, amount: 1, want: 10, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryStore()
+			if err := store.AddUser(ctx, User{ID: 1, Balance: 10}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.RemoveBalance(ctx, tc.userID, tc.amount)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("RemoveBalance() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && got != tc.want {
+				t.Errorf("RemoveBalance() = %v, want %v", got, tc.want)
+			}
+
+			u, err := store.GetUser(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Balance != tc.want {
+				t.Errorf("balance = %v, want %v", u.Balance, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreAdvanceSchedule(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	first := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	id, err := store.AddSchedule(ctx, Schedule{Cron: "0 9 * * *", NextRun: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two instances read the same due run; only the first to advance it wins.
+	a, err := store.GetSchedule(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := *a
+
+	second := first.AddDate(0, 0, 1)
+	steps := []struct {
+		name     string
+		sch      *Schedule
+		next     time.Time
+		want     bool
+		wantNext time.Time
+	}{
+		{name: "first instance", sch: a, next: second, want: true, wantNext: second},
+		{name: "stale instance", sch: &b, next: second, want: false, wantNext: second},
+		{name: "stale deactivation", sch: &b, next: time.Time{}, want: false, wantNext: second},
+	}
+	for _, step := range steps {
+		ok, err := store.AdvanceSchedule(ctx, step.sch, step.next, 0, "")
+		if err != nil {
+			t.Fatalf("%s: AdvanceSchedule() error = %v", step.name, err)
+		}
+		if ok != step.want {
+			t.Errorf("%s: AdvanceSchedule() = %v, want %v", step.name, ok, step.want)
+		}
+
+		current, err := store.GetSchedule(ctx, id)
+		if err != nil {
+			t.Fatalf("%s: GetSchedule() error = %v", step.name, err)
+		}
+		if !current.NextRun.Equal(step.wantNext) {
+			t.Errorf("%s: NextRun = %v, want %v", step.name, current.NextRun, step.wantNext)
+		}
+	}
+
+	// Advancing the current run to no next run deactivates the schedule.
+	current, err := store.GetSchedule(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.AdvanceSchedule(ctx, current, time.Time{}, 0, ""); err != nil || !ok {
+		t.Fatalf("AdvanceSchedule() = %v, %v, want true", ok, err)
+	}
+	if _, err := store.GetSchedule(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSchedule() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStoreAdvanceScheduleKeepsCurrentRun(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	run := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	id, err := store.AddSchedule(ctx, Schedule{NextRun: run})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A claimed run keeps its occurrence while NextRun holds the lease.
+	sch, err := store.GetSchedule(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch.CurrentRun = sch.NextRun
+	claim := run.Add(scheduleLease)
+	if ok, err := store.AdvanceSchedule(ctx, sch, claim, 0, ""); err != nil || !ok {
+		t.Fatalf("AdvanceSchedule() = %v, %v, want true", ok, err)
+	}
+	current, err := store.GetSchedule(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.CurrentRun.Equal(run) {
+		t.Errorf("CurrentRun = %v, want %v", current.CurrentRun, run)
+	}
+}
+
+func TestMemoryStoreApplyBatchEntry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if err := store.AddUser(ctx, User{ID: 1, Balance: 10}); err != nil {
+		t.Fatal(err)
+	}
+	batch := primitive.NewObjectID()
+
+	steps := []struct {
+		name        string
+		entry       LedgerEntry
+		want        bool
+		wantErr     bool
+		wantBalance float64
+	}{
+		{name: "apply row", entry: LedgerEntry{UserID: 1, Amount: 5, Kind: LedgerAdjustment, Batch: batch, Row: 1}, want: true, wantBalance: 15},
+		{name: "apply row again", entry: LedgerEntry{UserID: 1, Amount: 5, Kind: LedgerAdjustment, Batch: batch, Row: 1}, want: false, wantBalance: 15},
+		{name: "overdraw", entry: LedgerEntry{UserID: 1, Amount: -20, Kind: LedgerAdjustment, Batch: batch, Row: 2}, wantErr: true, wantBalance: 15},
+		{name: "unknown user", entry: LedgerEntry{UserID: 2, Amount: 1, Kind: LedgerAdjustment, Batch: batch, Row: 3}, wantErr: true, wantBalance: 15},
+		{name: "reverse row", entry: LedgerEntry{UserID: 1, Amount: -5, Kind: LedgerReversal, Batch: batch, Row: 1}, want: true, wantBalance: 10},
+		{name: "reverse row again", entry: LedgerEntry{UserID: 1, Amount: -5, Kind: LedgerReversal, Batch: batch, Row: 1}, want: false, wantBalance: 10},
+		{name: "same row of another batch", entry: LedgerEntry{UserID: 1, Amount: 2, Kind: LedgerAdjustment, Batch: primitive.NewObjectID(), Row: 1}, want: true, wantBalance: 12},
+	}
+	for _, step := range steps {
+		applied, err := store.ApplyBatchEntry(ctx, step.entry)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: ApplyBatchEntry() error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+		if applied != step.want {
+			t.Errorf("%s: ApplyBatchEntry() = %v, want %v", step.name, applied, step.want)
+		}
+
+		u, err := store.GetUser(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Balance != step.wantBalance {
+			t.Errorf("%s: balance = %v, want %v", step.name, u.Balance, step.wantBalance)
+		}
+	}
+
+	var rows []int
+	err := store.EachBatchLedgerEntry(ctx, batch, func(e LedgerEntry) error {
+		rows = append(rows, e.Row)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 1}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("batch ledger rows = %v, want %v", rows, want)
+	}
+}
+
+func TestMemoryStoreClaimBroadcast(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	id, err := store.AddBroadcast(ctx, Broadcast{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddBroadcast(ctx, Broadcast{Status: BroadcastDraft}); err != nil {
+		t.Fatal(err)
+	}
+
+	claim := func(worker string, lease time.Duration) *Broadcast {
+		t.Helper()
+		job, err := store.ClaimBroadcast(ctx, worker, lease)
+		if err != nil {
+			t.Fatalf("ClaimBroadcast(%s) error = %v", worker, err)
+		}
+		return job
+	}
+
+	job := claim("a", 20*time.Millisecond)
+	if job == nil || job.ID != id || job.Worker != "a" || job.Status != BroadcastRunning {
+		t.Fatalf("ClaimBroadcast(a) = %+v, want job %s running on a", job, id.Hex())
+	}
+	if job := claim("b", time.Minute); job != nil {
+		t.Fatalf("ClaimBroadcast(b) = %s while leased to a, want nil", job.ID.Hex())
+	}
+
+	// A worker that stops renewing its lease loses the job once it expires.
+	time.Sleep(40 * time.Millisecond)
+	job = claim("b", time.Minute)
+	if job == nil || job.ID != id || job.Worker != "b" {
+		t.Fatalf("ClaimBroadcast(b) = %+v after the lease expired, want job %s on b", job, id.Hex())
+	}
+	if status, err := store.CheckpointBroadcast(ctx, job, "a", time.Minute); err != nil || status != "" {
+		t.Errorf("CheckpointBroadcast(a) = %q, %v, want the lease lost", status, err)
+	}
+
+	if err := store.FinishBroadcast(ctx, job, BroadcastDone); err != nil {
+		t.Fatal(err)
+	}
+	if job := claim("c", time.Minute); job != nil {
+		t.Errorf("ClaimBroadcast(c) = %s, want nil once finished or drafted", job.ID.Hex())
+	}
+}
+
+func TestMemoryStoreGetReferredUsers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, id := range []int64{1, 2} {
+		if err := store.AddUser(ctx, User{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := int64(10); id <= 16; id++ {
+		if err := store.ReferUser(ctx, 1, User{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.ReferUser(ctx, 2, User{ID: 17}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		cursor   int64
+		backward bool
+		want     []int64
+		wantMore bool
+	}{
+		{name: "first page", cursor: 0, want: []int64{10, 11, 12}, wantMore: true},
+		{name: "middle page", cursor: 12, want: []int64{13, 14, 15}, wantMore: true},
+		{name: "last page", cursor: 15, want: []int64{16}, wantMore: false},
+		{name: "past the end", cursor: 16, want: nil, wantMore: false},
+		{name: "back from last page", cursor: 16, backward: true, want: []int64{13, 14, 15}, wantMore: true},
+		{name: "back to first page", cursor: 13, backward: true, want: []int64{10, 11, 12}, wantMore: false},
+		{name: "back from a short first page", cursor: 12, backward: true, want: []int64{10, 11}, wantMore: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			users, more, err := store.GetReferredUsers(ctx, 1, tc.cursor, tc.backward, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int64
+			for _, u := range users {
+				got = append(got, u.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) || more != tc.wantMore {
+				t.Errorf("GetReferredUsers(%d, %v) = %v, %v, want %v, %v", tc.cursor, tc.backward, got, more, tc.want, tc.wantMore)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreApplyLedgerEntry(t *testing.T) {
+	tests := []struct {
+		name        string
+		entry       LedgerEntry
+		wantErr     bool
+		notFound    bool
+		wantBalance float64
+		wantEntries int
+	}{
+		{name: "credit", entry: LedgerEntry{UserID: 1, Amount: 5, Kind: LedgerAdjustment}, wantBalance: 15, wantEntries: 1},
+		{name: "debit", entry: LedgerEntry{UserID: 1, Amount: -10, Kind: LedgerWithdrawal}, wantBalance: 0, wantEntries: 1},
+		{name: "overdraw", entry: LedgerEntry{UserID: 1, Amount: -10.01, Kind: LedgerAdjustment}, wantErr: true, wantBalance: 10},
+		{name: "unknown user", entry: LedgerEntry{UserID: 2, Amount: 5, Kind: LedgerAdjustment}, wantErr: true, notFound: true, wantBalance: 10},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryStore()
+			if err := store.AddUser(ctx, User{ID: 1, Balance: 10}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := store.ApplyLedgerEntry(ctx, tc.entry)
+			if (err != nil) != tc.wantErr || tc.notFound != errors.Is(err, ErrNotFound) {
+				t.Fatalf("ApplyLedgerEntry() error = %v, wantErr %v", err, tc.wantErr)
+			}
+
+			u, err := store.GetUser(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Balance != tc.wantBalance {
+				t.Errorf("balance = %v, want %v", u.Balance, tc.wantBalance)
+			}
+			entries, err := store.GetLedgerEntries(ctx, tc.entry.UserID, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tc.wantEntries {
+				t.Errorf("ledger has %d entries, want %d", len(entries), tc.wantEntries)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreUpdateUserBalanceUnknownUser(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.UpdateUserBalance(context.Background(), 1, 5); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateUserBalance() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStoreAddBroadcastScheduledRun(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	schedule := primitive.NewObjectID()
+	run := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		job     Broadcast
+		wantErr error
+	}{
+		{name: "manual", job: Broadcast{}},
+		{name: "manual again", job: Broadcast{}},
+		{name: "scheduled run", job: Broadcast{ScheduleID: schedule, ScheduleRun: run}},
+		{name: "same run again", job: Broadcast{ScheduleID: schedule, ScheduleRun: run}, wantErr: ErrAlreadyQueued},
+		{name: "next run", job: Broadcast{ScheduleID: schedule, ScheduleRun: run.AddDate(0, 0, 1)}},
+		{name: "other schedule", job: Broadcast{ScheduleID: primitive.NewObjectID(), ScheduleRun: run}},
+	}
+	for _, tc := range tests {
+		if _, err := store.AddBroadcast(ctx, tc.job); !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: AddBroadcast() error = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// menuView is what a menu button needs to know to build its target.
+type menuView struct {
+	bot    *gotgbot.Bot
+	userID int64
+}
+
+// menuButton is one button of a screen. Label is a message ID; the target is
+// built from the view by Data for callback buttons or by URL for links.
+type menuButton struct {
+	Label string
+	Data  func(v menuView) string
+	URL   func(v menuView) string
+	// Perms hides the button from users who lack any of them.
+	Perms []Permission
+}
+
+// visibleTo reports whether userID has every permission the button needs.
+func (m menuButton) visibleTo(userID int64) bool {
+	for _, perm := range m.Perms {
+		if !can(userID, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// menuScreen is the keyboard of one screen, as rows of buttons.
+type menuScreen [][]menuButton
+
+// homeButton returns to the home screen.
+var homeButton = menuButton{Label: "menu.home", Data: static("home")}
+
+// menuScreens defines the keyboard of every screen. Add a screen here and
+// render it with menuMarkup.
+var menuScreens = map[string]menuScreen{
+	"home": {
+		{{Label: "menu.owner", URL: func(v menuView) string { return fmt.Sprintf("tg://user?id=%d", OwnerID) }}},
+		{
+			{Label: "menu.refer", URL: func(v menuView) string {
+				return fmt.Sprintf("https://t.me/share/url?url=https://t.me/%s?start=%d", v.bot.Username, v.userID)
+			}},
+			{Label: "menu.info", Data: withUser("info")},
+		},
+		{
+			{Label: "menu.wallet", Data: withUser("wallet")},
+			{Label: "menu.withdraw", Data: withUser("withdraw")},
+		},
+		{{Label: "menu.referrals", Data: static("referrals.n.0")}},
+		{{Label: "menu.stats", Data: static("stats"), Perms: []Permission{PermViewUsers}}},
+	},
+	"wallet": {
+		{{Label: "menu.set_acc_no", Data: withUser("setAccNo")}},
+		{
+			{Label: "menu.withdraw", Data: withUser("withdraw")},
+			homeButton,
+		},
+	},
+	"info":      {{homeButton}},
+	"help":      {{homeButton}},
+	"referrals": {{homeButton}},
+	"stats":     {{homeButton}},
+	// back ends a conversation and leads back home.
+	"back": {{homeButton}},
+}
+
+// static is callback data that does not depend on the view.
+func static(data string) func(menuView) string {
+	return func(menuView) string { return data }
+}
+
+// withUser is callback data of the form "<prefix>.<user ID>".
+func withUser(prefix string) func(menuView) string {
+	return func(v menuView) string { return fmt.Sprintf("%s.%d", prefix, v.userID) }
+}
+
+// menuMarkup builds the keyboard of screen for userID in l, leaving out
+// buttons the user lacks the permissions for. Rows in extra, such as page
+// navigation, come before the screen's own rows. An undefined screen gets
+// the home keyboard.
+func menuMarkup(b *gotgbot.Bot, l *Locale, screen string, userID int64, extra ...[]gotgbot.InlineKeyboardButton) gotgbot.InlineKeyboardMarkup {
+	rows, ok := menuScreens[screen]
+	if !ok {
+		log.Printf("Menu screen %q is not defined, showing home instead", screen)
+		rows = menuScreens["home"]
+	}
+
+	view := menuView{bot: b, userID: userID}
+	markup := gotgbot.InlineKeyboardMarkup{InlineKeyboard: append([][]gotgbot.InlineKeyboardButton(nil), extra...)}
+	for _, row := range rows {
+		var buttons []gotgbot.InlineKeyboardButton
+		for _, button := range row {
+			if !button.visibleTo(userID) {
+				continue
+			}
+
+			btn := gotgbot.InlineKeyboardButton{Text: l.T(button.Label)}
+			if button.URL != nil {
+				btn.Url = button.URL(view)
+			} else {
+				btn.CallbackData = button.Data(view)
+			}
+			buttons = append(buttons, btn)
+		}
+		if len(buttons) > 0 {
+			markup.InlineKeyboard = append(markup.InlineKeyboard, buttons)
+		}
+	}
+	return markup
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoIndex declares an index a query relies on.
+type mongoIndex struct {
+	Collection string
+	Keys       bson.D
+	Unique     bool
+	// Partial limits the index to the documents matching it.
+	Partial bson.M
+}
+
+// Name is the name Mongo gives the index by default, such as "user_id_1__id_-1".
+func (ix mongoIndex) Name() string {
+	parts := make([]string, 0, len(ix.Keys))
+	for _, k := range ix.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// mongoIndexes are the indexes EnsureIndexes keeps in place. Add one here
+// alongside any new query that filters or sorts on an unindexed field.
+var mongoIndexes = []mongoIndex{
+	// Referral trees, leaderboards, activity stats and segments.
+	{Collection: "users", Keys: bson.D{{Key: "referrer", Value: 1}}},
+	{Collection: "users", Keys: bson.D{{Key: "referral_count", Value: -1}}},
+	{Collection: "users", Keys: bson.D{{Key: "balance", Value: 1}}},
+	{Collection: "users", Keys: bson.D{{Key: "last_seen", Value: 1}}},
+	{Collection: "users", Keys: bson.D{{Key: "joined_at", Value: 1}}},
+	{Collection: "users", Keys: bson.D{{Key: "inactive", Value: 1}, {Key: "inactive_reason", Value: 1}}},
+
+	// Each user is referred at most once; pages of referrals are keyed by referee.
+	{Collection: "referrals", Keys: bson.D{{Key: "referee", Value: 1}}, Unique: true},
+	{Collection: "referrals", Keys: bson.D{{Key: "referrer", Value: 1}, {Key: "referee", Value: 1}}},
+
+	// Per-user history, newest first.
+	{Collection: "ledger", Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}}},
+	{Collection: "withdrawals", Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}}},
+
+	// Date range exports.
+	{Collection: "ledger", Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+	{Collection: "withdrawals", Keys: bson.D{{Key: "requested_at", Value: 1}, {Key: "_id", Value: 1}}},
+
+	// Balance batch reversals, and each row of a batch applied once.
+	{Collection: "ledger", Keys: bson.D{{Key: "batch", Value: 1}}},
+	{
+		Collection: "ledger",
+		Keys:       bson.D{{Key: "batch", Value: 1}, {Key: "row", Value: 1}, {Key: "kind", Value: 1}},
+		Unique:     true,
+		Partial:    bson.M{"row": bson.M{"$gt": 0}},
+	},
+	{Collection: "balance_batches", Keys: bson.D{{Key: "status", Value: 1}}},
+
+	// Broadcast queue, reports and edits, and each scheduled run queued once.
+	{Collection: "broadcasts", Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	{
+		Collection: "broadcasts",
+		Keys:       bson.D{{Key: "schedule_id", Value: 1}, {Key: "schedule_run", Value: 1}},
+		Unique:     true,
+		Partial:    bson.M{"schedule_id": bson.M{"$exists": true}},
+	},
+	{Collection: "broadcast_failures", Keys: bson.D{{Key: "broadcast_id", Value: 1}, {Key: "user_id", Value: 1}}},
+	{Collection: "broadcast_deliveries", Keys: bson.D{{Key: "broadcast_id", Value: 1}}},
+
+	// Scheduler and conversation sweeper.
+	{Collection: "schedules", Keys: bson.D{{Key: "active", Value: 1}, {Key: "next_run", Value: 1}}},
+	{Collection: "conversations", Keys: bson.D{{Key: "expires_at", Value: 1}}},
+}
+
+// existingIndex is an index as listed by the server.
+type existingIndex struct {
+	Name   string `bson:"name"`
+	Keys   bson.D `bson:"key"`
+	Unique bool   `bson:"unique"`
+}
+
+// EnsureIndexes creates the declared indexes that are missing. An existing
+// index that clashes with a declaration is reported and left alone, since
+// dropping it could stall a busy collection; fix it by hand.
+func (s *MongoStore) EnsureIndexes(ctx context.Context) error {
+	existing := make(map[string][]existingIndex)
+	created, conflicts := 0, 0
+
+	for _, ix := range mongoIndexes {
+		coll := s.db.Collection(ix.Collection)
+		indexes, ok := existing[ix.Collection]
+		if !ok {
+			cursor, err := coll.Indexes().List(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list indexes of %s: %w", ix.Collection, err)
+			}
+			if err := cursor.All(ctx, &indexes); err != nil {
+				return fmt.Errorf("failed to decode indexes of %s: %w", ix.Collection, err)
+			}
+			existing[ix.Collection] = indexes
+		}
+
+		if conflict, found := findIndex(indexes, ix); found {
+			if conflict != "" {
+				log.Printf("Index %s.%s conflicts with the existing index: %s", ix.Collection, ix.Name(), conflict)
+				conflicts++
+			}
+			continue
+		}
+
+		log.Printf("Index %s.%s is missing, creating it", ix.Collection, ix.Name())
+		_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    ix.Keys,
+			Options: indexOptions(ix),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create index %s.%s: %w", ix.Collection, ix.Name(), err)
+		}
+		created++
+	}
+
+	if created > 0 || conflicts > 0 {
+		log.Printf("Indexes checked: %d created, %d conflicting", created, conflicts)
+	}
+	return nil
+}
+
+func indexOptions(ix mongoIndex) *options.IndexOptions {
+	opts := options.Index().SetName(ix.Name()).SetUnique(ix.Unique)
+	if ix.Partial != nil {
+		opts.SetPartialFilterExpression(ix.Partial)
+	}
+	return opts
+}
+
+// findIndex looks for ix among the existing indexes, matching by name or by
+// keys. It reports how a match differs from the declaration, or "" if it
+// does not.
+func findIndex(indexes []existingIndex, ix mongoIndex) (conflict string, found bool) {
+	for _, e := range indexes {
+		sameKeys := keysEqual(e.Keys, ix.Keys)
+		if e.Name != ix.Name() && !sameKeys {
+			continue
+		}
+
+		switch {
+		case !sameKeys:
+			return fmt.Sprintf("%s has keys %v", e.Name, e.Keys), true
+		case e.Unique != ix.Unique:
+			return fmt.Sprintf("%s has unique=%t, want %t", e.Name, e.Unique, ix.Unique), true
+		default:
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// keysEqual compares index keys, treating the numeric types the server
+// returns for directions as equal.
+func keysEqual(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
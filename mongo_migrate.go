@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoMigration is one versioned change to the data in Mongo. Up must be
+// idempotent, because a migration interrupted midway runs again in full.
+type MongoMigration struct {
+	Version int
+	Name    string
+	// Pending counts the documents Up would change, for dry runs.
+	Pending func(s *MongoStore, ctx context.Context) (int64, error)
+	Up      func(s *MongoStore, ctx context.Context) error
+}
+
+// mongoMigrations are applied in order. Append new migrations with the next
+// version; never renumber or edit one that has shipped.
+var mongoMigrations = []MongoMigration{
+	{
+		Version: 1,
+		Name:    "move referred_users into the referrals collection",
+		Pending: func(s *MongoStore, ctx context.Context) (int64, error) {
+			return s.users.CountDocuments(ctx, bson.M{"referred_users": bson.M{"$exists": true}})
+		},
+		Up: (*MongoStore).migrateReferredUsers,
+	},
+}
+
+// migrationLockTTL bounds how long a crashed instance keeps others from migrating.
+const migrationLockTTL = 10 * time.Minute
+
+// appliedMigration is the record of a migration in the migrations collection.
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Migrate applies the pending migrations and records each one in the
+// migrations collection. A lock keeps other instances out while it runs; they
+// wait for it and then find nothing left to do. With dryRun set nothing is
+// changed and the pending migrations are only logged.
+func (s *MongoStore) Migrate(ctx context.Context, dryRun bool) error {
+	if !dryRun {
+		if err := s.acquireLock(ctx, "migrations", migrationLockTTL); err != nil {
+			return err
+		}
+		defer s.releaseLock(ctx, "migrations")
+	}
+
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range mongoMigrations {
+		if applied[m.Version] {
+			continue
+		}
+		pending++
+
+		if dryRun {
+			count, err := m.Pending(s, ctx)
+			if err != nil {
+				return fmt.Errorf("failed to inspect migration %d: %w", m.Version, err)
+			}
+			log.Printf("Would apply migration %d (%s), %d documents to change", m.Version, m.Name, count)
+			continue
+		}
+
+		// Each migration gets a full TTL, and one that outlasted it is not
+		// recorded, since another instance may have taken over meanwhile.
+		if err := s.renewLock(ctx, "migrations", migrationLockTTL); err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := m.Up(s, ctx); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		if err := s.renewLock(ctx, "migrations", migrationLockTTL); err != nil {
+			return fmt.Errorf("migration %d (%s) not recorded: %w", m.Version, m.Name, err)
+		}
+
+		_, err := s.migrations.InsertOne(ctx, appliedMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()})
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+		}
+		log.Printf("Applied migration %d (%s) in %s", m.Version, m.Name, time.Since(start).Round(time.Millisecond))
+	}
+
+	if pending == 0 && dryRun {
+		log.Println("No pending migrations")
+	}
+	return nil
+}
+
+func (s *MongoStore) appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	cursor, err := s.migrations.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve applied migrations: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var records []appliedMigration
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode applied migrations: %w", err)
+	}
+
+	applied := make(map[int]bool, len(records))
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+	return applied, nil
+}
+
+// acquireLock takes the named lock, waiting while another instance holds it.
+// A lock whose holder died is taken over once it expires.
+func (s *MongoStore) acquireLock(ctx context.Context, name string, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl)
+	for {
+		now := time.Now().UTC()
+		_, err := s.locks.UpdateOne(ctx,
+			bson.M{"_id": name, "expires_at": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": workerID, "expires_at": now.Add(ttl)}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			return nil
+		}
+		// The upsert collides with the document of a lock that is still held.
+		if !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("failed to take %s lock: %w", name, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the %s lock", name)
+		}
+
+		log.Printf("Waiting for another instance to release the %s lock", name)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// renewLock extends the named lock by ttl if this instance still holds it
+// and fails if the lock expired and was lost.
+func (s *MongoStore) renewLock(ctx context.Context, name string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	res, err := s.locks.UpdateOne(ctx,
+		bson.M{"_id": name, "owner": workerID, "expires_at": bson.M{"$gte": now}},
+		bson.M{"$set": bson.M{"expires_at": now.Add(ttl)}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to renew %s lock: %w", name, err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("lost the %s lock to another instance", name)
+	}
+	return nil
+}
+
+func (s *MongoStore) releaseLock(ctx context.Context, name string) {
+	if _, err := s.locks.DeleteOne(ctx, bson.M{"_id": name, "owner": workerID}); err != nil {
+		log.Printf("Failed to release %s lock: %v", name, err)
+	}
+}
+
+// migrateReferredUsers moves legacy referred_users arrays out of user documents
+// into the referrals collection and replaces them with a referral_count counter.
+func (s *MongoStore) migrateReferredUsers(ctx context.Context) error {
+	cur, err := s.users.Find(ctx, bson.M{"referred_users": bson.M{"$exists": true}})
+	if err != nil {
+		return fmt.Errorf("failed to find legacy referrals: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	migrated := 0
+	for cur.Next(ctx) {
+		var legacy struct {
+			ID            int64   `bson:"_id"`
+			ReferredUsers []int64 `bson:"referred_users"`
+		}
+		if err := cur.Decode(&legacy); err != nil {
+			return fmt.Errorf("failed to decode legacy user: %w", err)
+		}
+
+		if len(legacy.ReferredUsers) > 0 {
+			// The arrays never kept when a referral happened, so migrated
+			// referrals are left without a time rather than given a made-up one.
+			models := make([]mongo.WriteModel, 0, len(legacy.ReferredUsers))
+			for _, referee := range legacy.ReferredUsers {
+				models = append(models, mongo.NewUpdateOneModel().
+					SetFilter(bson.M{"referee": referee}).
+					SetUpdate(bson.M{"$setOnInsert": Referral{Referrer: legacy.ID, Referee: referee}}).
+					SetUpsert(true))
+			}
+
+			if _, err := s.referrals.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+				return fmt.Errorf("failed to migrate referrals of user %d: %w", legacy.ID, err)
+			}
+		}
+
+		count, err := s.CountReferredUsers(ctx, legacy.ID)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.users.UpdateOne(ctx, bson.M{"_id": legacy.ID}, bson.M{
+			"$set":   bson.M{"referral_count": count},
+			"$unset": bson.M{"referred_users": ""},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to finish migration of user %d: %w", legacy.ID, err)
+		}
+		migrated++
+	}
+
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("failed to iterate legacy referrals: %w", err)
+	}
+
+	if migrated > 0 {
+		log.Printf("Migrated referrals of %d users", migrated)
+	}
+	return nil
+}
@@ -0,0 +1,1321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore is the Store backed by a MongoDB database.
+type MongoStore struct {
+	db            *mongo.Database
+	users         *mongo.Collection
+	referrals     *mongo.Collection
+	ledger        *mongo.Collection
+	withdrawals   *mongo.Collection
+	broadcasts    *mongo.Collection
+	failures      *mongo.Collection
+	deliveries    *mongo.Collection
+	schedules     *mongo.Collection
+	batches       *mongo.Collection
+	templates     *mongo.Collection
+	conversations *mongo.Collection
+	migrations    *mongo.Collection
+	locks         *mongo.Collection
+}
+
+var _ Store = (*MongoStore)(nil)
+
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	return &MongoStore{
+		db:            db,
+		users:         db.Collection("users"),
+		referrals:     db.Collection("referrals"),
+		ledger:        db.Collection("ledger"),
+		withdrawals:   db.Collection("withdrawals"),
+		broadcasts:    db.Collection("broadcasts"),
+		failures:      db.Collection("broadcast_failures"),
+		deliveries:    db.Collection("broadcast_deliveries"),
+		schedules:     db.Collection("schedules"),
+		batches:       db.Collection("balance_batches"),
+		templates:     db.Collection("message_templates"),
+		conversations: db.Collection("conversations"),
+		migrations:    db.Collection("migrations"),
+		locks:         db.Collection("locks"),
+	}
+}
+
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.db.Client().Disconnect(ctx)
+}
+
+func (s *MongoStore) AddUser(ctx context.Context, user User) error {
+	filter := bson.M{"$or": []bson.M{
+		{"_id": user.ID},
+	}}
+
+	count, err := s.users.CountDocuments(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to check user existence: %w", err)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("user with ID %d already exists", user.ID)
+	}
+
+	if user.JoinedAt.IsZero() {
+		user.JoinedAt = time.Now().UTC()
+	}
+	if user.LastSeen.IsZero() {
+		user.LastSeen = user.JoinedAt
+	}
+
+	_, err = s.users.InsertOne(ctx, user)
+	if err != nil {
+		return fmt.Errorf("failed to add user: %w", err)
+	}
+
+	return nil
+}
+
+func (s *MongoStore) ReferUser(ctx context.Context, referrerID int64, newUser User) error {
+	// Check if referrer exists
+	referrer := User{}
+	err := s.users.FindOne(ctx, bson.M{"_id": referrerID}).Decode(&referrer)
+	if err != nil {
+		return fmt.Errorf("referrer with ID %d does not exist", referrerID)
+	}
+
+	newUser.Referrer = referrerID
+	newUser.RewardPending = true
+
+	err = s.AddUser(ctx, newUser)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.referrals.InsertOne(ctx, Referral{
+		Referrer:  referrerID,
+		Referee:   newUser.ID,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record referral: %w", err)
+	}
+
+	_, err = s.users.UpdateOne(ctx, bson.M{"_id": referrerID}, bson.M{"$inc": bson.M{"referral_count": 1}})
+	if err != nil {
+		return fmt.Errorf("failed to update referrer's referral count: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoStore) GetUser(ctx context.Context, userID int64) (*User, error) {
+	user := User{}
+	err := s.users.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve user %d: %w", userID, err)
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) GetReferredUsers(ctx context.Context, referrerID, cursor int64, backward bool, limit int64) ([]User, bool, error) {
+	filter := bson.M{"referrer": referrerID}
+	sort := 1
+	if backward {
+		filter["referee"] = bson.M{"$lt": cursor}
+		sort = -1
+	} else if cursor != 0 {
+		filter["referee"] = bson.M{"$gt": cursor}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "referee", Value: sort}}).SetLimit(limit + 1)
+	cur, err := s.referrals.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to retrieve referrals: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var referrals []Referral
+	if err = cur.All(ctx, &referrals); err != nil {
+		return nil, false, fmt.Errorf("failed to decode referrals: %w", err)
+	}
+
+	hasMore := int64(len(referrals)) > limit
+	if hasMore {
+		referrals = referrals[:limit]
+	}
+
+	if backward {
+		for i, j := 0, len(referrals)-1; i < j; i, j = i+1, j-1 {
+			referrals[i], referrals[j] = referrals[j], referrals[i]
+		}
+	}
+
+	// The $in list is bounded by the page size.
+	ids := make([]int64, len(referrals))
+	for i, r := range referrals {
+		ids[i] = r.Referee
+	}
+
+	userCur, err := s.users.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to retrieve referred users: %w", err)
+	}
+	defer userCur.Close(ctx)
+
+	var found []User
+	if err = userCur.All(ctx, &found); err != nil {
+		return nil, false, fmt.Errorf("failed to decode referred users: %w", err)
+	}
+
+	byID := make(map[int64]User, len(found))
+	for _, u := range found {
+		byID[u.ID] = u
+	}
+
+	referredUsers := make([]User, 0, len(referrals))
+	for _, r := range referrals {
+		u, ok := byID[r.Referee]
+		if !ok {
+			u = User{ID: r.Referee, Referrer: referrerID}
+		}
+		if u.JoinedAt.IsZero() {
+			u.JoinedAt = r.CreatedAt
+		}
+		referredUsers = append(referredUsers, u)
+	}
+	return referredUsers, hasMore, nil
+}
+
+func (s *MongoStore) CountReferredUsers(ctx context.Context, referrerID int64) (int64, error) {
+	count, err := s.referrals.CountDocuments(ctx, bson.M{"referrer": referrerID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count referred users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *MongoStore) MarkReferralRewarded(ctx context.Context, userID int64) error {
+	_, err := s.users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$unset": bson.M{"reward_pending": ""}})
+	if err != nil {
+		return fmt.Errorf("failed to mark referral reward for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) UpdateUserProfile(ctx context.Context, profile User) (*User, error) {
+	// Any interaction proves the user can be reached again.
+	update := bson.M{
+		"$set": bson.M{
+			"first_name":    profile.FirstName,
+			"username":      profile.Username,
+			"language_code": profile.LanguageCode,
+			"is_premium":    profile.IsPremium,
+			"last_seen":     time.Now().UTC(),
+		},
+		"$unset": bson.M{"inactive": "", "inactive_since": "", "inactive_reason": ""},
+	}
+
+	var user User
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.users.FindOneAndUpdate(ctx, bson.M{"_id": profile.ID}, update, opts).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to update profile for user %d: %w", profile.ID, err)
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) SearchUsers(ctx context.Context, query string, limit int64) ([]User, error) {
+	query = strings.TrimPrefix(strings.TrimSpace(query), "@")
+	if query == "" {
+		return nil, nil
+	}
+
+	prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query), Options: "i"}
+	or := []bson.M{
+		{"username": prefix},
+		{"first_name": prefix},
+	}
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		or = append(or, bson.M{"_id": id})
+	}
+
+	opts := options.Find().SetLimit(limit).SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := s.users.Find(ctx, bson.M{"$or": or}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
+
+func (s *MongoStore) SetUserBanned(ctx context.Context, userID int64, banned bool) error {
+	_, err := s.users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"banned": banned}})
+	if err != nil {
+		return fmt.Errorf("failed to update ban status for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) AddLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	entry.CreatedAt = time.Now().UTC()
+	if _, err := s.ledger.InsertOne(ctx, entry); err != nil {
+		return fmt.Errorf("failed to record ledger entry for user %d: %w", entry.UserID, err)
+	}
+	return nil
+}
+
+// ApplyLedgerEntry can't rely on a transaction, which needs a replica set.
+// The balance changes first and is changed back if the entry can't be recorded.
+func (s *MongoStore) ApplyLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	filter := bson.M{"_id": entry.UserID}
+	if entry.Amount < 0 {
+		filter["balance"] = bson.M{"$gte": -entry.Amount}
+	}
+	res, err := s.users.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"balance": entry.Amount}})
+	if err != nil {
+		return fmt.Errorf("failed to update balance for user %d: %w", entry.UserID, err)
+	}
+	if res.MatchedCount == 0 {
+		err := s.users.FindOne(ctx, bson.M{"_id": entry.UserID}).Err()
+		if err == mongo.ErrNoDocuments {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update balance for user %d: %w", entry.UserID, err)
+		}
+		return fmt.Errorf("insufficient balance for user %d", entry.UserID)
+	}
+
+	entry.CreatedAt = time.Now().UTC()
+	if _, err := s.ledger.InsertOne(ctx, entry); err != nil {
+		_, rollbackErr := s.users.UpdateOne(ctx, bson.M{"_id": entry.UserID}, bson.M{"$inc": bson.M{"balance": -entry.Amount}})
+		if rollbackErr != nil {
+			return fmt.Errorf("failed to record ledger entry for user %d, rollback failed: %w", entry.UserID, rollbackErr)
+		}
+		return fmt.Errorf("failed to record ledger entry for user %d: %w", entry.UserID, err)
+	}
+	return nil
+}
+
+// ApplyBatchEntry can't rely on a transaction either. Instead the balance
+// changes together with a marker of the entry on the user, so a retry after a
+// crash before the entry was recorded finds the marker and only records it.
+func (s *MongoStore) ApplyBatchEntry(ctx context.Context, entry LedgerEntry) (bool, error) {
+	key := bson.M{"batch": entry.Batch, "row": entry.Row, "kind": entry.Kind}
+	recorded, err := s.ledger.CountDocuments(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up ledger entry: %w", err)
+	}
+	if recorded > 0 {
+		return false, nil
+	}
+
+	marker := fmt.Sprintf("%s.%d.%s", entry.Batch.Hex(), entry.Row, entry.Kind)
+	filter := bson.M{"_id": entry.UserID, "batch_entries": bson.M{"$ne": marker}}
+	if entry.Amount < 0 {
+		filter["balance"] = bson.M{"$gte": -entry.Amount}
+	}
+	res, err := s.users.UpdateOne(ctx, filter, bson.M{
+		"$inc":  bson.M{"balance": entry.Amount},
+		"$push": bson.M{"batch_entries": marker},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to update balance for user %d: %w", entry.UserID, err)
+	}
+	if res.MatchedCount == 0 {
+		var user struct {
+			Entries []string `bson:"batch_entries"`
+		}
+		err := s.users.FindOne(ctx, bson.M{"_id": entry.UserID}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return false, fmt.Errorf("user with ID %d does not exist", entry.UserID)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to update balance for user %d: %w", entry.UserID, err)
+		}
+		if !contains(user.Entries, marker) {
+			return false, fmt.Errorf("insufficient balance for user %d", entry.UserID)
+		}
+		// The balance changed on an earlier attempt; record it now.
+	}
+
+	entry.CreatedAt = time.Now().UTC()
+	_, err = s.ledger.UpdateOne(ctx, key, bson.M{"$setOnInsert": entry}, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, fmt.Errorf("failed to record ledger entry for user %d: %w", entry.UserID, err)
+	}
+
+	if _, err := s.users.UpdateOne(ctx, bson.M{"_id": entry.UserID}, bson.M{"$pull": bson.M{"batch_entries": marker}}); err != nil {
+		return false, fmt.Errorf("failed to clear applied entry of user %d: %w", entry.UserID, err)
+	}
+	return true, nil
+}
+
+func (s *MongoStore) GetLedgerEntries(ctx context.Context, userID int64, limit int64) ([]LedgerEntry, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit)
+	cursor, err := s.ledger.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve ledger: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var entries []LedgerEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode ledger: %w", err)
+	}
+	return entries, nil
+}
+
+func (s *MongoStore) GetLedgerSummary(ctx context.Context, userID int64) (*LedgerSummary, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     nil,
+			"credits": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$amount", 0}}, "$amount", 0}}},
+			"debits":  bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$lt": bson.A{"$amount", 0}}, "$amount", 0}}},
+			"entries": bson.M{"$sum": 1},
+		}}},
+	}
+
+	cursor, err := s.ledger.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarise ledger: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	summary := LedgerSummary{}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&summary); err != nil {
+			return nil, fmt.Errorf("failed to decode ledger summary: %w", err)
+		}
+	}
+	return &summary, cursor.Err()
+}
+
+func (s *MongoStore) EachLedgerEntry(ctx context.Context, from, before time.Time, fn func(LedgerEntry) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.ledger.Find(ctx, timeRange("created_at", from, before), opts)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve ledger: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var e LedgerEntry
+		if err := cursor.Decode(&e); err != nil {
+			return fmt.Errorf("failed to decode ledger entry: %w", err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) EachBatchLedgerEntry(ctx context.Context, batch primitive.ObjectID, fn func(LedgerEntry) error) error {
+	cursor, err := s.ledger.Find(ctx, bson.M{"batch": batch}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve ledger: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var e LedgerEntry
+		if err := cursor.Decode(&e); err != nil {
+			return fmt.Errorf("failed to decode ledger entry: %w", err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) AddWithdrawal(ctx context.Context, w Withdrawal) (primitive.ObjectID, error) {
+	w.Status = WithdrawalPending
+	w.RequestedAt = time.Now().UTC()
+	res, err := s.withdrawals.InsertOne(ctx, w)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to record withdrawal: %w", err)
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func (s *MongoStore) ApproveWithdrawal(ctx context.Context, id primitive.ObjectID) (*Withdrawal, error) {
+	filter := bson.M{"_id": id, "status": WithdrawalPending}
+	update := bson.M{"$set": bson.M{"status": WithdrawalApproved, "approved_at": time.Now().UTC()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var w Withdrawal
+	if err := s.withdrawals.FindOneAndUpdate(ctx, filter, update, opts).Decode(&w); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("withdrawal %s not found or already approved", id.Hex())
+		}
+		return nil, fmt.Errorf("failed to approve withdrawal: %w", err)
+	}
+	return &w, nil
+}
+
+func (s *MongoStore) GetWithdrawals(ctx context.Context, userID int64, limit int64) ([]Withdrawal, int64, error) {
+	count, err := s.withdrawals.CountDocuments(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count withdrawals: %w", err)
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit)
+	cursor, err := s.withdrawals.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve withdrawals: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var withdrawals []Withdrawal
+	if err = cursor.All(ctx, &withdrawals); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode withdrawals: %w", err)
+	}
+	return withdrawals, count, nil
+}
+
+func (s *MongoStore) EachWithdrawal(ctx context.Context, from, before time.Time, fn func(Withdrawal) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "requested_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.withdrawals.Find(ctx, timeRange("requested_at", from, before), opts)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve withdrawals: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var w Withdrawal
+		if err := cursor.Decode(&w); err != nil {
+			return fmt.Errorf("failed to decode withdrawal: %w", err)
+		}
+		if err := fn(w); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) UpdateUserBalance(ctx context.Context, userID int64, amount float64) error {
+	res, err := s.users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$inc": bson.M{"balance": amount}})
+	if err != nil {
+		return fmt.Errorf("failed to update balance for user %d: %w", userID, err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) RemoveBalance(ctx context.Context, userID int64, amount float64) (float64, error) {
+	if amount <= 0 {
+		return 0, fmt.Errorf("amount to remove must be greater than zero")
+	}
+
+	filter := bson.M{"_id": userID}
+	update := bson.M{"$inc": bson.M{"balance": -amount}}
+	options := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updatedUser User
+	err := s.users.FindOneAndUpdate(ctx, filter, update, options).Decode(&updatedUser)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, fmt.Errorf("user with ID %d does not exist", userID)
+		}
+		return 0, fmt.Errorf("failed to update balance: %w", err)
+	}
+
+	if updatedUser.Balance < 0 {
+		_, rollbackErr := s.users.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"balance": amount}})
+		if rollbackErr != nil {
+			return 0, fmt.Errorf("balance went negative, rollback failed: %w", rollbackErr)
+		}
+		return 0, fmt.Errorf("insufficient balance for user %d", userID)
+	}
+
+	return updatedUser.Balance, nil
+}
+
+func (s *MongoStore) UpdateUserAccNo(ctx context.Context, userID int64, accNo int64) error {
+	_, err := s.users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"acc_no": accNo}})
+	if err != nil {
+		return fmt.Errorf("failed to update acc_no for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) SetUserLanguage(ctx context.Context, userID int64, language string) error {
+	_, err := s.users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"language": language}})
+	if err != nil {
+		return fmt.Errorf("failed to update language for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) GetTopReferrers(ctx context.Context, limit int64) ([]User, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "referral_count", Value: -1}}).SetLimit(limit)
+	cursor, err := s.users.Find(ctx, bson.M{"referral_count": bson.M{"$gt": 0}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve top referrers: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode top referrers: %w", err)
+	}
+	return users, nil
+}
+
+func (s *MongoStore) CountActiveUsers(ctx context.Context, since time.Time) (int64, error) {
+	count, err := s.users.CountDocuments(ctx, bson.M{"last_seen": bson.M{"$gte": since}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count active users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *MongoStore) CountUsers(ctx context.Context) (int64, error) {
+	count, err := s.users.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *MongoStore) MarkUserInactive(ctx context.Context, userID int64, reason string) error {
+	_, err := s.users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{
+		"inactive":        true,
+		"inactive_since":  time.Now().UTC(),
+		"inactive_reason": reason,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to mark user %d inactive: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) CountInactiveUsers(ctx context.Context) (map[string]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"inactive": true}}},
+		{{Key: "$group", Value: bson.M{"_id": "$inactive_reason", "count": bson.M{"$sum": 1}}}},
+	}
+
+	cursor, err := s.users.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count inactive users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		Reason string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	if err = cursor.All(ctx, &rows); err != nil {
+		return nil, fmt.Errorf("failed to decode inactive users: %w", err)
+	}
+
+	counts := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		counts[r.Reason] = r.Count
+	}
+	return counts, nil
+}
+
+func (s *MongoStore) GetUserIDsAfter(ctx context.Context, after int64, limit int64, segment *Segment) ([]int64, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit).
+		SetProjection(bson.M{"_id": 1})
+
+	filter := bson.M{"$and": bson.A{
+		segmentFilter(segment),
+		bson.M{"_id": bson.M{"$gt": after}},
+		bson.M{"inactive": bson.M{"$ne": true}},
+		bson.M{"banned": bson.M{"$ne": true}},
+	}}
+	cursor, err := s.users.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+
+	ids := make([]int64, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	return ids, nil
+}
+
+func (s *MongoStore) EachUser(ctx context.Context, from, before time.Time, fn func(User) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := s.users.Find(ctx, timeRange("joined_at", from, before), opts)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var u User
+		if err := cursor.Decode(&u); err != nil {
+			return fmt.Errorf("failed to decode user: %w", err)
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// timeRange filters field to [from, before), leaving zero ends open.
+func timeRange(field string, from, before time.Time) bson.M {
+	cond := bson.M{}
+	if !from.IsZero() {
+		cond["$gte"] = from
+	}
+	if !before.IsZero() {
+		cond["$lt"] = before
+	}
+	if len(cond) == 0 {
+		return bson.M{}
+	}
+	return bson.M{field: cond}
+}
+
+func (s *MongoStore) AddBroadcast(ctx context.Context, job Broadcast) (primitive.ObjectID, error) {
+	if job.Status == "" {
+		job.Status = BroadcastQueued
+	}
+	job.CreatedAt = time.Now().UTC()
+	res, err := s.broadcasts.InsertOne(ctx, job)
+	if err != nil {
+		// Scheduled runs are unique, see mongoIndexes.
+		if mongo.IsDuplicateKeyError(err) {
+			return primitive.NilObjectID, ErrAlreadyQueued
+		}
+		return primitive.NilObjectID, fmt.Errorf("failed to queue broadcast: %w", err)
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func (s *MongoStore) ClaimBroadcast(ctx context.Context, worker string, lease time.Duration) (*Broadcast, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"status":      bson.M{"$in": bson.A{BroadcastQueued, BroadcastRunning}},
+		"lease_until": bson.M{"$lt": now},
+	}
+	update := bson.M{"$set": bson.M{
+		"status":      BroadcastRunning,
+		"worker":      worker,
+		"lease_until": now.Add(lease),
+	}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job Broadcast
+	if err := s.broadcasts.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to claim broadcast: %w", err)
+	}
+	return &job, nil
+}
+
+func (s *MongoStore) CheckpointBroadcast(ctx context.Context, job *Broadcast, worker string, lease time.Duration) (string, error) {
+	update := bson.M{"$set": bson.M{
+		"cursor":      job.Cursor,
+		"sent":        job.Sent,
+		"failed":      job.Failed,
+		"errors":      job.Errors,
+		"lease_until": time.Now().UTC().Add(lease),
+	}}
+
+	var current Broadcast
+	err := s.broadcasts.FindOneAndUpdate(ctx, bson.M{"_id": job.ID, "worker": worker}, update).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to checkpoint broadcast: %w", err)
+	}
+	return current.Status, nil
+}
+
+func (s *MongoStore) FinishBroadcast(ctx context.Context, job *Broadcast, status string) error {
+	job.Status = status
+	job.FinishedAt = time.Now().UTC()
+	_, err := s.broadcasts.UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": bson.M{
+		"status":      job.Status,
+		"cursor":      job.Cursor,
+		"sent":        job.Sent,
+		"failed":      job.Failed,
+		"errors":      job.Errors,
+		"finished_at": job.FinishedAt,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to finish broadcast: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoStore) GetBroadcast(ctx context.Context, id primitive.ObjectID) (*Broadcast, error) {
+	var job Broadcast
+	if err := s.broadcasts.FindOne(ctx, bson.M{"_id": id}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve broadcast: %w", err)
+	}
+	return &job, nil
+}
+
+func (s *MongoStore) SetBroadcastStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*Broadcast, error) {
+	set := bson.M{"status": status}
+	if status == BroadcastQueued {
+		// Let any worker claim the resumed job straight away.
+		set["lease_until"] = time.Time{}
+	}
+
+	var job Broadcast
+	err := s.broadcasts.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": bson.M{"$in": from}}, bson.M{"$set": set}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("broadcast can no longer be changed")
+		}
+		return nil, fmt.Errorf("failed to update broadcast: %w", err)
+	}
+	return &job, nil
+}
+
+func (s *MongoStore) AddBroadcastFailure(ctx context.Context, f BroadcastFailure) error {
+	f.At = time.Now().UTC()
+	if _, err := s.failures.InsertOne(ctx, f); err != nil {
+		return fmt.Errorf("failed to record broadcast failure: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoStore) EachBroadcastFailure(ctx context.Context, id primitive.ObjectID, fn func(BroadcastFailure) error) error {
+	cursor, err := s.failures.Find(ctx, bson.M{"broadcast_id": id}, options.Find().SetSort(bson.D{{Key: "user_id", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve broadcast failures: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var f BroadcastFailure
+		if err := cursor.Decode(&f); err != nil {
+			return fmt.Errorf("failed to decode broadcast failure: %w", err)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) AddBroadcastDeliveries(ctx context.Context, deliveries []BroadcastDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(deliveries))
+	for i, d := range deliveries {
+		docs[i] = d
+	}
+
+	if _, err := s.deliveries.InsertMany(ctx, docs); err != nil {
+		return fmt.Errorf("failed to record broadcast deliveries: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoStore) EachBroadcastDelivery(ctx context.Context, id primitive.ObjectID, fn func(BroadcastDelivery) error) error {
+	cursor, err := s.deliveries.Find(ctx, bson.M{"broadcast_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to retrieve broadcast deliveries: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var d BroadcastDelivery
+		if err := cursor.Decode(&d); err != nil {
+			return fmt.Errorf("failed to decode broadcast delivery: %w", err)
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) DeleteBroadcastDeliveries(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.deliveries.DeleteMany(ctx, bson.M{"broadcast_id": id}); err != nil {
+		return fmt.Errorf("failed to remove broadcast deliveries: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoStore) SetBroadcastOptions(ctx context.Context, id primitive.ObjectID, o BroadcastOptions) (*Broadcast, error) {
+	// Set every option explicitly; the struct tags would omit false values.
+	set := bson.M{"forward": o.Forward, "silent": o.Silent, "pin": o.Pin, "protect": o.Protect}
+	var job Broadcast
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.broadcasts.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": BroadcastDraft}, bson.M{"$set": set}, opts).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("broadcast can no longer be changed")
+		}
+		return nil, fmt.Errorf("failed to update broadcast: %w", err)
+	}
+	return &job, nil
+}
+
+func (s *MongoStore) CountReachableUsers(ctx context.Context, segment *Segment) (int64, error) {
+	filter := bson.M{"$and": bson.A{
+		segmentFilter(segment),
+		bson.M{"inactive": bson.M{"$ne": true}},
+		bson.M{"banned": bson.M{"$ne": true}},
+	}}
+	count, err := s.users.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *MongoStore) AddSchedule(ctx context.Context, sch Schedule) (primitive.ObjectID, error) {
+	sch.Active = true
+	sch.CreatedAt = time.Now().UTC()
+	res, err := s.schedules.InsertOne(ctx, sch)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func (s *MongoStore) GetActiveSchedules(ctx context.Context) ([]Schedule, error) {
+	cursor, err := s.schedules.Find(ctx, bson.M{"active": true}, options.Find().SetSort(bson.D{{Key: "next_run", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve schedules: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var schedules []Schedule
+	if err = cursor.All(ctx, &schedules); err != nil {
+		return nil, fmt.Errorf("failed to decode schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+func (s *MongoStore) GetDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error) {
+	cursor, err := s.schedules.Find(ctx, bson.M{"active": true, "next_run": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve due schedules: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var schedules []Schedule
+	if err = cursor.All(ctx, &schedules); err != nil {
+		return nil, fmt.Errorf("failed to decode schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+func (s *MongoStore) GetSchedule(ctx context.Context, id primitive.ObjectID) (*Schedule, error) {
+	var sch Schedule
+	if err := s.schedules.FindOne(ctx, bson.M{"_id": id, "active": true}).Decode(&sch); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve schedule: %w", err)
+	}
+	return &sch, nil
+}
+
+func (s *MongoStore) AdvanceSchedule(ctx context.Context, sch *Schedule, next time.Time, failures int, lastError string) (bool, error) {
+	set := bson.M{"last_run": time.Now().UTC(), "failures": failures, "last_error": lastError}
+	if next.IsZero() {
+		set["active"] = false
+	} else {
+		set["next_run"] = next
+	}
+	update := bson.M{"$set": set}
+	if sch.CurrentRun.IsZero() {
+		update["$unset"] = bson.M{"current_run": ""}
+	} else {
+		set["current_run"] = sch.CurrentRun
+	}
+
+	res, err := s.schedules.UpdateOne(ctx, bson.M{"_id": sch.ID, "active": true, "next_run": sch.NextRun}, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to advance schedule: %w", err)
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (s *MongoStore) SetScheduleOptions(ctx context.Context, id primitive.ObjectID, o BroadcastOptions) (*Schedule, error) {
+	// Set every option explicitly; the struct tags would omit false values.
+	set := bson.M{"forward": o.Forward, "silent": o.Silent, "pin": o.Pin, "protect": o.Protect}
+	var sch Schedule
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.schedules.FindOneAndUpdate(ctx, bson.M{"_id": id, "active": true}, bson.M{"$set": set}, opts).Decode(&sch)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to update schedule: %w", err)
+	}
+	return &sch, nil
+}
+
+func (s *MongoStore) UpdateSchedule(ctx context.Context, id primitive.ObjectID, cron string, next time.Time, segment string) error {
+	res, err := s.schedules.UpdateOne(ctx, bson.M{"_id": id, "active": true}, bson.M{
+		"$set": bson.M{
+			"cron":     cron,
+			"next_run": next,
+			"segment":  segment,
+		},
+		"$unset": bson.M{"current_run": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("schedule %s not found", id.Hex())
+	}
+	return nil
+}
+
+func (s *MongoStore) CancelSchedule(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.schedules.UpdateOne(ctx, bson.M{"_id": id, "active": true}, bson.M{"$set": bson.M{"active": false}})
+	if err != nil {
+		return fmt.Errorf("failed to cancel schedule: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("schedule %s not found", id.Hex())
+	}
+	return nil
+}
+
+func (s *MongoStore) AddBalanceBatch(ctx context.Context, batch BalanceBatch) (primitive.ObjectID, error) {
+	batch.Status = BatchPending
+	batch.CreatedAt = time.Now().UTC()
+	res, err := s.batches.InsertOne(ctx, batch)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to save batch: %w", err)
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func (s *MongoStore) GetBalanceBatch(ctx context.Context, id primitive.ObjectID) (*BalanceBatch, error) {
+	var batch BalanceBatch
+	if err := s.batches.FindOne(ctx, bson.M{"_id": id}).Decode(&batch); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve batch: %w", err)
+	}
+	return &batch, nil
+}
+
+func (s *MongoStore) SetBalanceBatchStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*BalanceBatch, error) {
+	var batch BalanceBatch
+	err := s.batches.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": bson.M{"$in": from}}, bson.M{"$set": bson.M{"status": status}}).Decode(&batch)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrBatchChanged
+		}
+		return nil, fmt.Errorf("failed to update batch: %w", err)
+	}
+	return &batch, nil
+}
+
+func (s *MongoStore) GetBalanceBatchesByStatus(ctx context.Context, statuses []string) ([]BalanceBatch, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := s.batches.Find(ctx, bson.M{"status": bson.M{"$in": statuses}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve batches: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var batches []BalanceBatch
+	if err := cursor.All(ctx, &batches); err != nil {
+		return nil, fmt.Errorf("failed to decode batches: %w", err)
+	}
+	return batches, nil
+}
+
+func (s *MongoStore) GetMessageTemplate(ctx context.Context, message, language string) (*MessageTemplate, error) {
+	var tmpl MessageTemplate
+	if err := s.templates.FindOne(ctx, bson.M{"_id": messageTemplateID(message, language)}).Decode(&tmpl); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve template %s: %w", messageTemplateID(message, language), err)
+	}
+	return &tmpl, nil
+}
+
+func (s *MongoStore) GetMessageTemplates(ctx context.Context) ([]MessageTemplate, error) {
+	cursor, err := s.templates.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve templates: %w", err)
+	}
+
+	var templates []MessageTemplate
+	if err := cursor.All(ctx, &templates); err != nil {
+		return nil, fmt.Errorf("failed to decode templates: %w", err)
+	}
+	return templates, nil
+}
+
+func (s *MongoStore) SetMessageTemplate(ctx context.Context, tmpl MessageTemplate) error {
+	tmpl.ID = messageTemplateID(tmpl.Message, tmpl.Language)
+	_, err := s.templates.ReplaceOne(ctx, bson.M{"_id": tmpl.ID}, tmpl, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save template %s: %w", tmpl.ID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteMessageTemplate(ctx context.Context, message, language string) error {
+	res, err := s.templates.DeleteOne(ctx, bson.M{"_id": messageTemplateID(message, language)})
+	if err != nil {
+		return fmt.Errorf("failed to delete template %s: %w", messageTemplateID(message, language), err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+var comparisonOps = map[string]string{">=": "$gte", "<=": "$lte", ">": "$gt", "<": "$lt", "=": "$eq"}
+
+// segmentFilter turns a segment into a filter on the users collection.
+func segmentFilter(seg *Segment) bson.M {
+	var and bson.A
+	numeric := func(field string, conds []Comparison) {
+		// Numeric fields are stored with omitempty, so a missing value is compared as zero.
+		for _, c := range conds {
+			and = append(and, bson.M{"$expr": bson.M{comparisonOps[c.Op]: bson.A{bson.M{"$ifNull": bson.A{"$" + field, 0}}, c.Value}}})
+		}
+	}
+	numeric("balance", seg.Balance)
+	numeric("referral_count", seg.Referrals)
+
+	joined := bson.M{}
+	if !seg.JoinedFrom.IsZero() {
+		joined["$gte"] = seg.JoinedFrom
+	}
+	if !seg.JoinedBefore.IsZero() {
+		joined["$lt"] = seg.JoinedBefore
+	}
+	if len(joined) > 0 {
+		and = append(and, bson.M{"joined_at": joined})
+	}
+
+	if seg.HasAccNo != nil {
+		if *seg.HasAccNo {
+			and = append(and, bson.M{"acc_no": bson.M{"$gt": 0}})
+		} else {
+			and = append(and, bson.M{"$or": bson.A{
+				bson.M{"acc_no": bson.M{"$exists": false}},
+				bson.M{"acc_no": bson.M{"$lte": 0}},
+			}})
+		}
+	}
+
+	if seg.Lang != "" {
+		// Like User.effectiveLanguage: the picked language, else Telegram's.
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"language": seg.Lang},
+			bson.M{"language": bson.M{"$in": bson.A{nil, ""}}, "language_code": seg.Lang},
+		}})
+	}
+	if seg.Referrer != 0 {
+		and = append(and, bson.M{"referrer": seg.Referrer})
+	}
+
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+func (s *MongoStore) GetConversation(ctx context.Context, key string) (*Conversation, error) {
+	var conv Conversation
+	if err := s.conversations.FindOne(ctx, bson.M{"_id": key}).Decode(&conv); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to load conversation %s: %w", key, err)
+	}
+	return &conv, nil
+}
+
+func (s *MongoStore) SaveConversation(ctx context.Context, conv Conversation) error {
+	set := bson.M{"state": conv.State, "updated_at": conv.UpdatedAt}
+	unset := bson.M{}
+	if conv.ExpiresAt.IsZero() {
+		unset["expires_at"] = ""
+	} else {
+		set["expires_at"] = conv.ExpiresAt
+	}
+	if conv.PromptMessageID != 0 {
+		set["prompt_chat_id"] = conv.PromptChatID
+		set["prompt_message_id"] = conv.PromptMessageID
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if _, err := s.conversations.UpdateOne(ctx, bson.M{"_id": conv.Key}, update, options.Update().SetUpsert(true)); err != nil {
+		return fmt.Errorf("failed to save conversation %s: %w", conv.Key, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteConversation(ctx context.Context, key string) error {
+	if _, err := s.conversations.DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+		return fmt.Errorf("failed to end conversation %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) TakeExpiredConversation(ctx context.Context, now time.Time) (*Conversation, error) {
+	var conv Conversation
+	err := s.conversations.FindOneAndDelete(ctx, bson.M{"expires_at": bson.M{"$lte": now}}).Decode(&conv)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to expire conversations: %w", err)
+	}
+	return &conv, nil
+}
+
+func (s *MongoStore) ExportRecords(ctx context.Context, collection string, fn func(record any) error) error {
+	index := backupCollectionIndex(collection)
+	if index < 0 {
+		return fmt.Errorf("unknown collection %q", collection)
+	}
+
+	cur, err := s.db.Collection(collection).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %s: %w", collection, err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		record := backupCollections[index].New()
+		if err := cur.Decode(record); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", collection, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// importBatchSize is the number of records ImportRecords writes at a time.
+const importBatchSize = 500
+
+func (s *MongoStore) ImportRecords(ctx context.Context, next func() (string, any, error)) error {
+	var (
+		collection string
+		models     []mongo.WriteModel
+	)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := s.db.Collection(collection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", collection, err)
+		}
+		return nil
+	}
+
+	for {
+		name, record, err := next()
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		if name != collection || len(models) >= importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			collection = name
+		}
+
+		filter, err := recordFilter(record)
+		if err != nil {
+			return err
+		}
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(record).SetUpsert(true))
+	}
+}
+
+// recordFilter matches the stored copy of a backup record.
+func recordFilter(record any) (bson.M, error) {
+	switch r := record.(type) {
+	case *User:
+		return bson.M{"_id": r.ID}, nil
+	case *Referral:
+		return bson.M{"referee": r.Referee}, nil
+	case *LedgerEntry:
+		return bson.M{"_id": r.ID}, nil
+	case *Withdrawal:
+		return bson.M{"_id": r.ID}, nil
+	case *Broadcast:
+		return bson.M{"_id": r.ID}, nil
+	case *BroadcastFailure:
+		return bson.M{"broadcast_id": r.BroadcastID, "user_id": r.UserID}, nil
+	case *BroadcastDelivery:
+		return bson.M{"broadcast_id": r.BroadcastID, "user_id": r.UserID}, nil
+	case *Schedule:
+		return bson.M{"_id": r.ID}, nil
+	case *BalanceBatch:
+		return bson.M{"_id": r.ID}, nil
+	case *MessageTemplate:
+		return bson.M{"_id": r.ID}, nil
+	default:
+		return nil, fmt.Errorf("unknown record type %T", record)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// tokenBucket is a simple token-bucket rate limiter. Tokens refill at rate per
+// second up to burst, and Wait blocks until one is available.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (t *tokenBucket) Wait() {
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+		t.last = now
+
+		if t.tokens >= 1 {
+			t.tokens--
+			t.mu.Unlock()
+			return
+		}
+
+		wait := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+		t.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Pause empties the bucket and holds off refilling for d, used when Telegram
+// asks us to back off.
+func (t *tokenBucket) Pause(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = 0
+	t.last = time.Now().Add(d)
+}
+
+// retryAfter returns how long Telegram asked us to wait, or zero if err is not a flood error.
+func retryAfter(err error) time.Duration {
+	var tgErr *gotgbot.TelegramError
+	if errors.As(err, &tgErr) && tgErr.Code == 429 && tgErr.ResponseParams != nil {
+		return time.Duration(tgErr.ResponseParams.RetryAfter) * time.Second
+	}
+	return 0
+}
+
+// Kinds of Telegram delivery errors, as reported by classifyError.
+const (
+	ErrKindBlocked      = "blocked"
+	ErrKindDeactivated  = "deactivated"
+	ErrKindChatNotFound = "chat_not_found"
+	ErrKindFlood        = "flood"
+	ErrKindOther        = "other"
+)
+
+// classifyError maps a Telegram API error to one of the ErrKind values.
+func classifyError(err error) string {
+	var tgErr *gotgbot.TelegramError
+	if !errors.As(err, &tgErr) {
+		return ErrKindOther
+	}
+
+	desc := strings.ToLower(tgErr.Description)
+	switch {
+	case tgErr.Code == 429:
+		return ErrKindFlood
+	case strings.Contains(desc, "bot was blocked by the user"):
+		return ErrKindBlocked
+	case strings.Contains(desc, "user is deactivated"):
+		return ErrKindDeactivated
+	case strings.Contains(desc, "chat not found"):
+		return ErrKindChatNotFound
+	default:
+		return ErrKindOther
+	}
+}
+
+// isUnreachable reports whether an error kind means the user can no longer be messaged.
+func isUnreachable(kind string) bool {
+	return kind == ErrKindBlocked || kind == ErrKindDeactivated || kind == ErrKindChatNotFound
+}
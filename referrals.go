@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+const referralsPageSize = 10
+
+// referralsCallback renders one page of the "My Referrals" screen.
+// Callback data is "referrals.<n|p>.<cursor>", where n pages forward from the
+// cursor and p pages backward from it.
+func (a *App) referralsCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	query := ctx.CallbackQuery
+	user := ctx.EffectiveUser
+	l := tr(ctx)
+
+	splitData := strings.Split(query.Data, ".")
+	if len(splitData) < 3 {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.invalid_callback"),
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	backward := splitData[1] == "p"
+	cursor := stringToInt64(splitData[2])
+
+	total, err := a.store.CountReferredUsers(requestContext(ctx), user.Id)
+	if err != nil {
+		log.Printf("Failed to count referrals: %v", err)
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.generic"),
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	referred, hasMore, err := a.store.GetReferredUsers(requestContext(ctx), user.Id, cursor, backward, referralsPageSize)
+	if err != nil {
+		log.Printf("Failed to fetch referrals: %v", err)
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.generic"),
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	hasPrev, hasNext := cursor != 0 && !backward, hasMore
+	if backward {
+		hasPrev, hasNext = hasMore, true
+	}
+
+	var sb strings.Builder
+	sb.WriteString(l.T("referrals.title", "count", total) + "\n\n")
+	if len(referred) == 0 {
+		sb.WriteString(l.T("referrals.empty"))
+	}
+
+	for _, r := range referred {
+		joined := l.T("referrals.unknown")
+		if !r.JoinedAt.IsZero() {
+			joined = r.JoinedAt.Format("2006-01-02")
+		}
+
+		subscribed := "❔"
+		if ok, err := isSubscribed(b, r.ID); err == nil && ok {
+			subscribed = "✅"
+		} else if err == nil {
+			subscribed = "❌"
+		}
+
+		reward := l.T("referrals.earned")
+		if r.RewardPending {
+			reward = l.T("referrals.pending")
+		}
+
+		sb.WriteString(l.T("referrals.entry", "user", mention(&r), "joined", joined, "subscribed", subscribed, "reward", HTML(reward)))
+	}
+
+	var nav []gotgbot.InlineKeyboardButton
+	if hasPrev && len(referred) > 0 {
+		nav = append(nav, gotgbot.InlineKeyboardButton{
+			Text:         l.T("referrals.prev"),
+			CallbackData: fmt.Sprintf("referrals.p.%d", referred[0].ID),
+		})
+	}
+	if hasNext && len(referred) > 0 {
+		nav = append(nav, gotgbot.InlineKeyboardButton{
+			Text:         l.T("referrals.next"),
+			CallbackData: fmt.Sprintf("referrals.n.%d", referred[len(referred)-1].ID),
+		})
+	}
+
+	var extra [][]gotgbot.InlineKeyboardButton
+	if len(nav) > 0 {
+		extra = append(extra, nav)
+	}
+	button := menuMarkup(b, l, "referrals", user.Id, extra...)
+
+	_, _ = query.Answer(b, nil)
+	_, _, _ = msg.EditText(b, sb.String(), &gotgbot.EditMessageTextOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: button,
+		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
+			IsDisabled: true,
+		},
+	})
+
+	return nil
+}
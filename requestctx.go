@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// dbTimeout bounds the database work of one update, and of each store call a
+// background job makes. DB_TIMEOUT overrides it.
+var dbTimeout = 10 * time.Second
+
+// requestContextKey holds the context of an update in its ext.Context Data.
+const requestContextKey = "request_context"
+
+// requestProcessor handles every update under a context with a deadline,
+// derived from base so that all of them are cancelled on shutdown.
+type requestProcessor struct {
+	base context.Context
+}
+
+func (p requestProcessor) ProcessUpdate(d *ext.Dispatcher, b *gotgbot.Bot, ctx *ext.Context) error {
+	reqCtx, cancel := context.WithTimeout(p.base, dbTimeout)
+	defer cancel()
+
+	if ctx.Data == nil {
+		ctx.Data = make(map[string]interface{})
+	}
+	ctx.Data[requestContextKey] = reqCtx
+	return ext.BaseProcessor{}.ProcessUpdate(d, b, ctx)
+}
+
+// requestContext returns the context of the update being handled.
+func requestContext(ctx *ext.Context) context.Context {
+	if reqCtx, ok := ctx.Data[requestContextKey].(context.Context); ok {
+		return reqCtx
+	}
+	return context.Background()
+}
+
+// storeContext bounds a single store call made outside of an update.
+func (a *App) storeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(a.base, dbTimeout)
+}
+
+// replyTimedOut tells the user their update ran out of time, so they know to
+// try again rather than wait.
+func replyTimedOut(b *gotgbot.Bot, ctx *ext.Context) {
+	if query := ctx.CallbackQuery; query != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      tr(ctx).T("error.timed_out_alert"),
+			ShowAlert: true,
+		})
+		return
+	}
+
+	if msg := ctx.EffectiveMessage; msg != nil && msg.Chat.Type == "private" {
+		_, _ = msg.Reply(b, tr(ctx).T("error.timed_out"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	}
+}
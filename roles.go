@@ -0,0 +1,54 @@
+package main
+
+// Role is the level of access a Telegram user has to admin features.
+type Role int
+
+const (
+	RoleUser Role = iota
+	RoleAdmin
+	RoleOwner
+)
+
+// Permission names an admin action that is checked against a Role.
+type Permission int
+
+const (
+	PermViewUsers Permission = iota
+	PermViewLedger
+	PermBanUsers
+	PermAdjustBalance
+	// PermViewWithdrawals covers exports of withdrawals, which hold payout
+	// account numbers.
+	PermViewWithdrawals
+	// PermViewPayouts covers the balance and account number columns of
+	// user exports.
+	PermViewPayouts
+)
+
+// rolePermissions lists what each role may do. The owner may do everything.
+var rolePermissions = map[Role]map[Permission]bool{
+	RoleAdmin: {
+		PermViewUsers:  true,
+		PermViewLedger: true,
+		PermBanUsers:   true,
+	},
+}
+
+// AdminIDs holds the users with the admin role, set from ADMIN_IDS.
+var AdminIDs = map[int64]bool{}
+
+func roleOf(userID int64) Role {
+	switch {
+	case userID == OwnerID:
+		return RoleOwner
+	case AdminIDs[userID]:
+		return RoleAdmin
+	default:
+		return RoleUser
+	}
+}
+
+func can(userID int64, perm Permission) bool {
+	role := roleOf(userID)
+	return role == RoleOwner || rolePermissions[role][perm]
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	schedulerInterval = 30 * time.Second
+	// scheduleLease is how long a claimed run is hidden from other instances
+	// while its broadcast is queued. A run whose instance dies before the
+	// schedule is advanced is picked up again once the lease is over.
+	scheduleLease = 5 * time.Minute
+	// scheduleRetryDelay is the wait before retrying a run that could not be
+	// queued, multiplied by its number of failures.
+	scheduleRetryDelay = time.Minute
+	// scheduleMaxFailures is how often a run is attempted before it is skipped.
+	scheduleMaxFailures = 5
+)
+
+// scheduleLayouts are the accepted formats for one-shot schedules, in UTC.
+var scheduleLayouts = []string{"2006-01-02 15:04", "2006-01-02T15:04", time.RFC3339}
+
+const scheduleHelp = `<b>Usage:</b> reply to a message with
+<code>/schedule &lt;when&gt; [| filters]</code>
+
+<b>when</b> is either a UTC time such as <code>2026-01-31 18:00</code>
+or a cron expression such as <code>0 9 * * 1</code> (every Monday 09:00 UTC).`
+
+// parseWhen parses a schedule spec into its cron expression (empty for
+// one-shot schedules) and the first run time.
+func parseWhen(spec string) (string, time.Time, error) {
+	spec = strings.TrimSpace(spec)
+	for _, layout := range scheduleLayouts {
+		if t, err := time.ParseInLocation(layout, spec, time.UTC); err == nil {
+			if !t.After(time.Now()) {
+				return "", time.Time{}, fmt.Errorf("scheduled time is in the past")
+			}
+			return "", t.UTC(), nil
+		}
+	}
+
+	c, err := parseCron(spec)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	next, err := c.Next(time.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return spec, next, nil
+}
+
+// splitScheduleArgs splits "<when> | <filters>" and validates both halves.
+func splitScheduleArgs(args string) (cron string, next time.Time, segment string, err error) {
+	when, segment, _ := strings.Cut(args, "|")
+	segment = strings.TrimSpace(segment)
+	if _, err = parseSegment(segment); err != nil {
+		return "", time.Time{}, "", err
+	}
+
+	cron, next, err = parseWhen(when)
+	return cron, next, segment, err
+}
+
+func (a *App) schedule(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.Chat.Type != "private" {
+		return nil
+	}
+
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil
+	}
+
+	reply := msg.ReplyToMessage
+	args := strings.Join(ctx.Args()[1:], " ")
+	if reply == nil || args == "" {
+		_, _ = msg.Reply(b, scheduleHelp, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	cron, next, segment, err := splitScheduleArgs(args)
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ "+html.EscapeString(err.Error())+"\n\n"+scheduleHelp, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	button := &gotgbot.InlineKeyboardMarkup{}
+	if reply.ReplyMarkup != nil {
+		button.InlineKeyboard = reply.ReplyMarkup.InlineKeyboard
+	}
+
+	id, err := a.store.AddSchedule(requestContext(ctx), Schedule{
+		FromChatID:  msg.Chat.Id,
+		MessageID:   reply.MessageId,
+		ReplyMarkup: button,
+		Segment:     segment,
+		Cron:        cron,
+		NextRun:     next,
+		CreatedBy:   msg.From.Id,
+	})
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ "+CustomError(err).Error(), nil)
+		return err
+	}
+
+	_, err = msg.Reply(b, fmt.Sprintf("⏰ <b>Broadcast scheduled</b>\n\n%s", formatSchedule(&Schedule{
+		ID:      id,
+		Segment: segment,
+		Cron:    cron,
+		NextRun: next,
+	})), &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: optionRows(BroadcastOptions{}, "sched", id.Hex())},
+	})
+	return err
+}
+
+func formatSchedule(sch *Schedule) string {
+	repeat := "once"
+	if sch.Cron != "" {
+		repeat = "<code>" + html.EscapeString(sch.Cron) + "</code>"
+	}
+
+	audience := "all users"
+	if sch.Segment != "" {
+		audience = "<code>" + html.EscapeString(sch.Segment) + "</code>"
+	}
+
+	text := fmt.Sprintf(
+		"🆔 <code>%s</code>\n"+
+			"🔁 <b>Repeat:</b> %s\n"+
+			"⏭ <b>Next run:</b> %s\n"+
+			"🎯 <b>Audience:</b> %s\n"+
+			"⚙️ <b>Mode:</b> %s\n",
+		sch.ID.Hex(), repeat, sch.NextRun.Format("2006-01-02 15:04 MST"), audience, describeOptions(sch.BroadcastOptions))
+	if sch.LastError != "" {
+		text += "⚠️ <b>Last failure:</b> " + html.EscapeString(sch.LastError) + "\n"
+	}
+	return text
+}
+
+func (a *App) listSchedules(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil
+	}
+
+	schedules, err := a.store.GetActiveSchedules(requestContext(ctx))
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ "+CustomError(err).Error(), nil)
+		return err
+	}
+
+	if len(schedules) == 0 {
+		_, _ = msg.Reply(b, "📭 <b>No scheduled broadcasts.</b>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	text := "⏰ <b>Scheduled broadcasts</b>\n\n"
+	var buttons [][]gotgbot.InlineKeyboardButton
+	for i, sch := range schedules {
+		text += fmt.Sprintf("<b>#%d</b>\n%s\n", i+1, formatSchedule(&sch))
+		buttons = append(buttons, []gotgbot.InlineKeyboardButton{{
+			Text:         fmt.Sprintf("✖️ Cancel #%d", i+1),
+			CallbackData: "sched.cancel." + sch.ID.Hex(),
+		}})
+	}
+	text += "✏️ Edit with <code>/reschedule &lt;id&gt; &lt;when&gt; [| filters]</code>"
+
+	_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: buttons},
+	})
+	return err
+}
+
+func (a *App) reschedule(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil
+	}
+
+	args := ctx.Args()[1:]
+	if len(args) < 2 {
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/reschedule &lt;id&gt; &lt;when&gt; [| filters]</code>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	id, err := primitive.ObjectIDFromHex(args[0])
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Invalid schedule ID.", nil)
+		return nil
+	}
+
+	cron, next, segment, err := splitScheduleArgs(strings.Join(args[1:], " "))
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ "+html.EscapeString(err.Error())+"\n\n"+scheduleHelp, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	if err = a.store.UpdateSchedule(requestContext(ctx), id, cron, next, segment); err != nil {
+		_, _ = msg.Reply(b, "❌ "+CustomError(err).Error(), nil)
+		return nil
+	}
+
+	sch, err := a.store.GetSchedule(requestContext(ctx), id)
+	if err != nil {
+		sch = &Schedule{ID: id, Segment: segment, Cron: cron, NextRun: next}
+	}
+	_, err = msg.Reply(b, "✅ <b>Schedule updated</b>\n\n"+formatSchedule(sch), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	return err
+}
+
+func (a *App) unschedule(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, "You must be the owner to use this command.", nil)
+		return nil
+	}
+
+	args := ctx.Args()[1:]
+	if len(args) < 1 {
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/unschedule &lt;id&gt;</code>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	id, err := primitive.ObjectIDFromHex(args[0])
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Invalid schedule ID.", nil)
+		return nil
+	}
+
+	if err = a.store.CancelSchedule(requestContext(ctx), id); err != nil {
+		_, _ = msg.Reply(b, "❌ "+CustomError(err).Error(), nil)
+		return nil
+	}
+
+	_, err = msg.Reply(b, "✅ Schedule cancelled.", nil)
+	return err
+}
+
+// scheduleCallback handles "sched.cancel.<id>" buttons from /schedules and
+// the delivery option toggles of a new schedule.
+func (a *App) scheduleCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	query := ctx.CallbackQuery
+	if ctx.EffectiveUser.Id != OwnerID {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ You are not authorized to do this.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	splitData := strings.Split(query.Data, ".")
+	if len(splitData) < 3 {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid callback data.", ShowAlert: true})
+		return nil
+	}
+
+	id, err := primitive.ObjectIDFromHex(splitData[2])
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid schedule ID.", ShowAlert: true})
+		return nil
+	}
+
+	switch splitData[1] {
+	case "forward", "silent", "pin", "protect":
+		sch, err := a.store.GetSchedule(requestContext(ctx), id)
+		if err == nil {
+			sch, err = a.store.SetScheduleOptions(requestContext(ctx), id, toggleOption(sch.BroadcastOptions, splitData[1]))
+		}
+		if errors.Is(err, ErrNotFound) {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ This schedule is no longer active.", ShowAlert: true})
+			return nil
+		}
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + CustomError(err).Error(), ShowAlert: true})
+			return err
+		}
+
+		_, _ = query.Answer(b, nil)
+		_, _, _ = ctx.EffectiveMessage.EditText(b, "⏰ <b>Broadcast scheduled</b>\n\n"+formatSchedule(sch), &gotgbot.EditMessageTextOpts{
+			ParseMode:   "HTML",
+			ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: optionRows(sch.BroadcastOptions, "sched", id.Hex())},
+		})
+		return nil
+	case "cancel":
+		err = a.store.CancelSchedule(requestContext(ctx), id)
+	default:
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Invalid callback data.", ShowAlert: true})
+		return nil
+	}
+
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + err.Error(), ShowAlert: true})
+		return nil
+	}
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "✅ Schedule cancelled."})
+	return nil
+}
+
+// scheduleWorker queues a broadcast for every schedule that has come due,
+// until stop is cancelled.
+func (a *App) scheduleWorker(stop context.Context, b *gotgbot.Bot) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		a.runDueSchedules(b)
+		select {
+		case <-ticker.C:
+		case <-stop.Done():
+			return
+		}
+	}
+}
+
+func (a *App) runDueSchedules(b *gotgbot.Bot) {
+	now := time.Now().UTC()
+	ctx, cancel := a.storeContext()
+	schedules, err := a.store.GetDueSchedules(ctx, now)
+	cancel()
+	if err != nil {
+		log.Printf("Scheduler: %v", err)
+		return
+	}
+
+	for _, sch := range schedules {
+		a.runSchedule(b, sch, now)
+	}
+}
+
+// runSchedule queues the broadcast of a due schedule. The run is claimed by
+// moving NextRun past a lease, so only one instance queues it, and the
+// schedule only moves on to its next run once the broadcast is queued. A run
+// that fails is retried later and reported to the schedule's creator.
+//
+// The run is recorded as CurrentRun with the claim and its broadcast is queued
+// under it, so a run claimed again after a crash is not queued twice.
+func (a *App) runSchedule(b *gotgbot.Bot, sch Schedule, now time.Time) {
+	if sch.CurrentRun.IsZero() {
+		sch.CurrentRun = sch.NextRun
+	}
+	// Stores keep times to the millisecond, and the claim is compared later.
+	claim := now.Add(scheduleLease).Truncate(time.Millisecond)
+	ctx, cancel := a.storeContext()
+	won, err := a.store.AdvanceSchedule(ctx, &sch, claim, sch.Failures, sch.LastError)
+	cancel()
+	if err != nil {
+		log.Printf("Scheduler: %v", err)
+		return
+	}
+	if !won {
+		// Another instance already claimed this run.
+		return
+	}
+	sch.NextRun = claim
+
+	// Missed runs are not replayed; a recurring schedule continues from now.
+	var next time.Time
+	if sch.Cron != "" {
+		var c *cronSchedule
+		if c, err = parseCron(sch.Cron); err == nil {
+			next, err = c.Next(now)
+		}
+	}
+	if err == nil {
+		err = a.queueScheduledBroadcast(b, &sch)
+	}
+
+	failures, lastError := 0, ""
+	if err != nil {
+		log.Printf("Scheduler: schedule %s: %v", sch.ID.Hex(), err)
+		failures, lastError = sch.Failures+1, err.Error()
+		retry := failures < scheduleMaxFailures
+		if retry {
+			next = now.Add(time.Duration(failures) * scheduleRetryDelay)
+		} else {
+			// Give up on this run; a recurring schedule still gets its next one.
+			failures = 0
+		}
+		reportScheduleFailure(b, &sch, err, retry, next)
+		if !retry {
+			sch.CurrentRun = time.Time{}
+		}
+	} else {
+		sch.CurrentRun = time.Time{}
+	}
+
+	ctx, cancel = a.storeContext()
+	defer cancel()
+	if _, err := a.store.AdvanceSchedule(ctx, &sch, next, failures, lastError); err != nil {
+		log.Printf("Scheduler: %v", err)
+	}
+}
+
+// reportScheduleFailure tells the creator of a schedule that a run could not
+// be queued, and when it runs next.
+func reportScheduleFailure(b *gotgbot.Bot, sch *Schedule, err error, retry bool, next time.Time) {
+	text := fmt.Sprintf("⚠️ <b>Scheduled broadcast failed</b>\n🆔 <code>%s</code>\n\n❌ %s\n\n",
+		sch.ID.Hex(), html.EscapeString(CustomError(err).Error()))
+	switch {
+	case retry:
+		text += "🔁 Retrying at " + next.Format("2006-01-02 15:04 MST") + "."
+	case next.IsZero():
+		text += fmt.Sprintf("✖️ Gave up after %d attempts; the schedule is no longer active.", scheduleMaxFailures)
+	default:
+		text += fmt.Sprintf("✖️ Skipped this run after %d attempts; the next one is at %s.", scheduleMaxFailures, next.Format("2006-01-02 15:04 MST"))
+	}
+
+	if _, err := b.SendMessage(sch.CreatedBy, text, &gotgbot.SendMessageOpts{ParseMode: "HTML"}); err != nil {
+		log.Printf("Scheduler: failed to report failure of schedule %s: %v", sch.ID.Hex(), err)
+	}
+}
+
+func (a *App) queueScheduledBroadcast(b *gotgbot.Bot, sch *Schedule) error {
+	segment, err := parseSegment(sch.Segment)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := a.storeContext()
+	defer cancel()
+
+	total, err := a.store.CountReachableUsers(ctx, segment)
+	if err != nil {
+		return err
+	}
+
+	progress, err := b.SendMessage(sch.CreatedBy, "⏰ <b>Scheduled broadcast starting...</b>", &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+		ReplyParameters: &gotgbot.ReplyParameters{
+			MessageId:                sch.MessageID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send progress message: %v", err)
+	}
+
+	_, err = a.store.AddBroadcast(ctx, Broadcast{
+		FromChatID:        sch.FromChatID,
+		MessageID:         sch.MessageID,
+		ReplyMarkup:       sch.ReplyMarkup,
+		CreatedBy:         sch.CreatedBy,
+		Segment:           sch.Segment,
+		BroadcastOptions:  sch.BroadcastOptions,
+		Total:             total,
+		ProgressChatID:    progress.Chat.Id,
+		ProgressMessageID: progress.MessageId,
+		ScheduleID:        sch.ID,
+		ScheduleRun:       sch.CurrentRun,
+	})
+	if errors.Is(err, ErrAlreadyQueued) {
+		// Queued before a crash; that broadcast reports its own progress.
+		log.Printf("Scheduler: run %s of schedule %s was already queued", sch.CurrentRun.Format(time.RFC3339), sch.ID.Hex())
+		_, _ = b.DeleteMessage(progress.Chat.Id, progress.MessageId, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	wakeBroadcastWorker()
+	return nil
+}
@@ -0,0 +1,3 @@
+-- Restores import users before the users who referred them and check the
+-- reference when they commit.
+ALTER TABLE users ALTER CONSTRAINT users_referrer_fkey DEFERRABLE INITIALLY IMMEDIATE;
@@ -0,0 +1,4 @@
+-- Date range exports.
+CREATE INDEX users_joined_at_idx ON users (joined_at);
+CREATE INDEX ledger_created_idx ON ledger (created_at, id);
+CREATE INDEX withdrawals_requested_idx ON withdrawals (requested_at, id);
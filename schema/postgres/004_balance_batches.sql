@@ -0,0 +1,22 @@
+-- Bulk balance changes and the ledger entries recorded under them.
+-- Entries of a batch are keyed by the row they apply, so a batch interrupted
+-- midway can be run again without applying a row twice. Other entries keep
+-- row 0.
+ALTER TABLE ledger ADD COLUMN batch CHAR(24) NOT NULL DEFAULT '';
+ALTER TABLE ledger ADD COLUMN batch_row INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ledger ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX ledger_batch_idx ON ledger (batch);
+CREATE UNIQUE INDEX ledger_batch_row_idx ON ledger (batch, batch_row, kind) WHERE batch_row > 0;
+
+CREATE TABLE balance_batches (
+    id         CHAR(24) PRIMARY KEY,
+    file_name  TEXT NOT NULL DEFAULT '',
+    batch_rows TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    created_by BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+-- Batches left applying or reverting are resumed at startup.
+CREATE INDEX balance_batches_status_idx ON balance_batches (status);
@@ -0,0 +1,2 @@
+-- The interface language picked with /language.
+ALTER TABLE users ADD COLUMN language TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+-- The owner's edits of message templates.
+CREATE TABLE message_templates (
+    id         TEXT PRIMARY KEY,
+    message    TEXT NOT NULL,
+    language   TEXT NOT NULL,
+    body       TEXT NOT NULL,
+    updated_by BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,16 @@
+-- Delivery options copied to the broadcasts a schedule queues, and the
+-- failures of its current run.
+ALTER TABLE schedules ADD COLUMN forward BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE schedules ADD COLUMN silent BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE schedules ADD COLUMN pin BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE schedules ADD COLUMN protect BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE schedules ADD COLUMN failures INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE schedules ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+
+-- The run a schedule is queueing, and the run that queued a broadcast. Each
+-- run is queued once, even when it is claimed again after a crash.
+ALTER TABLE schedules ADD COLUMN current_run TIMESTAMPTZ;
+ALTER TABLE broadcasts ADD COLUMN schedule_id CHAR(24) NOT NULL DEFAULT '';
+ALTER TABLE broadcasts ADD COLUMN schedule_run TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX broadcasts_schedule_run_idx ON broadcasts (schedule_id, schedule_run) WHERE schedule_id <> '';
@@ -0,0 +1,126 @@
+CREATE TABLE users (
+    id              INTEGER PRIMARY KEY,
+    referrer        BIGINT REFERENCES users (id),
+    referral_count  BIGINT NOT NULL DEFAULT 0,
+    acc_no          BIGINT NOT NULL DEFAULT 0,
+    balance         REAL NOT NULL DEFAULT 0,
+    first_name      TEXT NOT NULL DEFAULT '',
+    username        TEXT NOT NULL DEFAULT '',
+    language_code   TEXT NOT NULL DEFAULT '',
+    is_premium      BOOLEAN NOT NULL DEFAULT FALSE,
+    joined_at       TIMESTAMP,
+    last_seen       TIMESTAMP,
+    reward_pending  BOOLEAN NOT NULL DEFAULT FALSE,
+    banned          BOOLEAN NOT NULL DEFAULT FALSE,
+    inactive        BOOLEAN NOT NULL DEFAULT FALSE,
+    inactive_since  TIMESTAMP,
+    inactive_reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX users_referrer_idx ON users (referrer);
+CREATE INDEX users_referral_count_idx ON users (referral_count);
+CREATE INDEX users_last_seen_idx ON users (last_seen);
+CREATE INDEX users_username_idx ON users (LOWER(username));
+
+CREATE TABLE referrals (
+    referee    INTEGER PRIMARY KEY REFERENCES users (id),
+    referrer   BIGINT NOT NULL REFERENCES users (id),
+    created_at TIMESTAMP
+);
+
+CREATE INDEX referrals_referrer_idx ON referrals (referrer, referee);
+
+CREATE TABLE ledger (
+    id         CHAR(24) PRIMARY KEY,
+    user_id    BIGINT NOT NULL REFERENCES users (id),
+    amount     REAL NOT NULL,
+    kind       TEXT NOT NULL,
+    actor      BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX ledger_user_idx ON ledger (user_id, id);
+
+CREATE TABLE withdrawals (
+    id           CHAR(24) PRIMARY KEY,
+    user_id      BIGINT NOT NULL REFERENCES users (id),
+    amount       REAL NOT NULL,
+    acc_no       BIGINT NOT NULL,
+    status       TEXT NOT NULL,
+    requested_at TIMESTAMP NOT NULL,
+    approved_at  TIMESTAMP
+);
+
+CREATE INDEX withdrawals_user_idx ON withdrawals (user_id, id);
+
+CREATE TABLE broadcasts (
+    id                  CHAR(24) PRIMARY KEY,
+    from_chat_id        BIGINT NOT NULL,
+    message_id          BIGINT NOT NULL,
+    reply_markup        TEXT NOT NULL DEFAULT '',
+    created_by          BIGINT NOT NULL,
+    segment             TEXT NOT NULL DEFAULT '',
+    forward             BOOLEAN NOT NULL DEFAULT FALSE,
+    silent              BOOLEAN NOT NULL DEFAULT FALSE,
+    pin                 BOOLEAN NOT NULL DEFAULT FALSE,
+    protect             BOOLEAN NOT NULL DEFAULT FALSE,
+    status              TEXT NOT NULL,
+    cursor_id           BIGINT NOT NULL DEFAULT 0,
+    total               BIGINT NOT NULL DEFAULT 0,
+    sent                BIGINT NOT NULL DEFAULT 0,
+    failed              BIGINT NOT NULL DEFAULT 0,
+    errors              TEXT NOT NULL DEFAULT '',
+    progress_chat_id    BIGINT NOT NULL DEFAULT 0,
+    progress_message_id BIGINT NOT NULL DEFAULT 0,
+    worker              TEXT NOT NULL DEFAULT '',
+    lease_until         TIMESTAMP,
+    created_at          TIMESTAMP NOT NULL,
+    finished_at         TIMESTAMP
+);
+
+CREATE INDEX broadcasts_status_idx ON broadcasts (status, created_at);
+
+CREATE TABLE broadcast_failures (
+    broadcast_id CHAR(24) NOT NULL REFERENCES broadcasts (id) ON DELETE CASCADE,
+    user_id      BIGINT NOT NULL,
+    kind         TEXT NOT NULL,
+    description  TEXT NOT NULL,
+    at           TIMESTAMP NOT NULL
+);
+
+CREATE INDEX broadcast_failures_idx ON broadcast_failures (broadcast_id, user_id);
+
+CREATE TABLE broadcast_deliveries (
+    broadcast_id CHAR(24) NOT NULL REFERENCES broadcasts (id) ON DELETE CASCADE,
+    user_id      BIGINT NOT NULL,
+    message_id   BIGINT NOT NULL
+);
+
+CREATE INDEX broadcast_deliveries_idx ON broadcast_deliveries (broadcast_id);
+
+CREATE TABLE schedules (
+    id           CHAR(24) PRIMARY KEY,
+    from_chat_id BIGINT NOT NULL,
+    message_id   BIGINT NOT NULL,
+    reply_markup TEXT NOT NULL DEFAULT '',
+    segment      TEXT NOT NULL DEFAULT '',
+    cron         TEXT NOT NULL DEFAULT '',
+    next_run     TIMESTAMP NOT NULL,
+    last_run     TIMESTAMP,
+    active       BOOLEAN NOT NULL,
+    created_by   BIGINT NOT NULL,
+    created_at   TIMESTAMP NOT NULL
+);
+
+CREATE INDEX schedules_due_idx ON schedules (active, next_run);
+
+CREATE TABLE conversations (
+    key               TEXT PRIMARY KEY,
+    state             TEXT NOT NULL,
+    updated_at        TIMESTAMP NOT NULL,
+    expires_at        TIMESTAMP,
+    prompt_chat_id    BIGINT NOT NULL DEFAULT 0,
+    prompt_message_id BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX conversations_expires_idx ON conversations (expires_at);
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segmentHelp documents the targeting syntax accepted by parseSegment.
+const segmentHelp = `<b>Targeting filters</b> (space separated, all must match):
+<code>balance&gt;10</code> — balance compared with <code>&gt; &gt;= &lt; &lt;= =</code>
+<code>referrals=0</code> — number of referrals, same operators
+<code>joined=2024-01-01..2024-02-01</code> — join date range, either end optional
+<code>accno=yes</code> / <code>accno=no</code> — has set an account number
+<code>lang=en</code> — language picked with /language, else the Telegram language code
+<code>referrer=123456</code> — referred by a specific user`
+
+// segmentUsage renders a problem with a targeting query followed by the syntax.
+func segmentUsage(problem string) string {
+	return "❌ " + html.EscapeString(problem) + "\n\n" + segmentHelp
+}
+
+// segmentOps are the comparison operators of the targeting syntax, longest first
+// so that ">=" is not mistaken for ">".
+var segmentOps = []string{">=", "<=", ">", "<", "="}
+
+// Comparison is a numeric condition such as "> 10".
+type Comparison struct {
+	Op    string
+	Value float64
+}
+
+func (c Comparison) Match(n float64) bool {
+	switch c.Op {
+	case ">=":
+		return n >= c.Value
+	case "<=":
+		return n <= c.Value
+	case ">":
+		return n > c.Value
+	case "<":
+		return n < c.Value
+	default:
+		return n == c.Value
+	}
+}
+
+// Segment is a parsed targeting query. Every set condition must match; the
+// zero Segment matches everyone. Each Store translates it for its backend.
+type Segment struct {
+	Balance   []Comparison
+	Referrals []Comparison
+	// JoinedFrom is inclusive and JoinedBefore exclusive; zero means unbounded.
+	JoinedFrom   time.Time
+	JoinedBefore time.Time
+	// HasAccNo is nil when the account number does not matter.
+	HasAccNo *bool
+	Lang     string
+	Referrer int64
+}
+
+// Match reports whether u is in the segment.
+func (s *Segment) Match(u *User) bool {
+	for _, c := range s.Balance {
+		if !c.Match(u.Balance) {
+			return false
+		}
+	}
+	for _, c := range s.Referrals {
+		if !c.Match(float64(u.ReferralCount)) {
+			return false
+		}
+	}
+	if !s.JoinedFrom.IsZero() && u.JoinedAt.Before(s.JoinedFrom) {
+		return false
+	}
+	if !s.JoinedBefore.IsZero() && !u.JoinedAt.Before(s.JoinedBefore) {
+		return false
+	}
+	if s.HasAccNo != nil && *s.HasAccNo != (u.AccNo > 0) {
+		return false
+	}
+	if s.Lang != "" && s.Lang != u.effectiveLanguage() {
+		return false
+	}
+	if s.Referrer != 0 && s.Referrer != u.Referrer {
+		return false
+	}
+	return true
+}
+
+// parseSegment parses a targeting query such as "balance>10 lang=en".
+// An empty query matches everyone.
+func parseSegment(query string) (*Segment, error) {
+	seg := &Segment{}
+	for _, term := range strings.Fields(query) {
+		key, op, value, ok := splitSegmentTerm(term)
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q", term)
+		}
+
+		if key == "balance" || key == "referrals" {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number in %q", term)
+			}
+			if key == "balance" {
+				seg.Balance = append(seg.Balance, Comparison{Op: op, Value: n})
+			} else {
+				seg.Referrals = append(seg.Referrals, Comparison{Op: op, Value: n})
+			}
+			continue
+		}
+
+		if op != "=" {
+			return nil, fmt.Errorf("only = is supported for %q", key)
+		}
+
+		switch key {
+		case "joined":
+			start, end, err := parseDateRange(value)
+			if err != nil {
+				return nil, fmt.Errorf("%v in %q", err, term)
+			}
+			// Several ranges narrow each other down.
+			if start.After(seg.JoinedFrom) {
+				seg.JoinedFrom = start
+			}
+			if !end.IsZero() && (seg.JoinedBefore.IsZero() || end.Before(seg.JoinedBefore)) {
+				seg.JoinedBefore = end
+			}
+
+		case "accno":
+			var has bool
+			switch strings.ToLower(value) {
+			case "yes":
+				has = true
+			case "no":
+				has = false
+			default:
+				return nil, fmt.Errorf("accno must be yes or no")
+			}
+			seg.HasAccNo = &has
+
+		case "lang":
+			seg.Lang = strings.ToLower(value)
+
+		case "referrer":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf("invalid user ID in %q", term)
+			}
+			seg.Referrer = id
+
+		default:
+			return nil, fmt.Errorf("unknown filter %q", key)
+		}
+	}
+
+	return seg, nil
+}
+
+// parseDateRange parses "2024-01-01..2024-02-01", where either end may be
+// left out, or a single day. start is inclusive and end exclusive; a zero
+// time leaves that end open.
+func parseDateRange(value string) (start, end time.Time, err error) {
+	from, to, found := strings.Cut(value, "..")
+	if from != "" {
+		if start, err = time.Parse("2006-01-02", from); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date")
+		}
+	}
+	if to != "" && found {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date")
+		}
+		// The end date is inclusive.
+		end = t.AddDate(0, 0, 1)
+	} else if !found && from != "" {
+		end = start.AddDate(0, 0, 1)
+	}
+	if start.IsZero() && end.IsZero() {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid date range")
+	}
+	return start, end, nil
+}
+
+func splitSegmentTerm(term string) (key, op, value string, ok bool) {
+	for _, o := range segmentOps {
+		if i := strings.Index(term, o); i > 0 {
+			return strings.ToLower(term[:i]), o, term[i+len(o):], term[i+len(o):] != ""
+		}
+	}
+	return "", "", "", false
+}
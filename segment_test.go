@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSegmentUsageEscapesTerms(t *testing.T) {
+	tests := []struct {
+		query, escaped string
+	}{
+		{"<x", `&#34;&lt;x&#34;`},
+		{"<b>=1", `&#34;&lt;b&#34;`},
+		{"a&b=1", `&#34;a&amp;b&#34;`},
+		{"balance>10 joined=</code>", `&#34;joined=&lt;/code&gt;&#34;`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := parseSegment(tc.query)
+			if err == nil {
+				t.Fatal("parseSegment() succeeded")
+			}
+			got := strings.TrimSuffix(segmentUsage(err.Error()), segmentHelp)
+			if !strings.Contains(got, tc.escaped) {
+				t.Errorf("segmentUsage() = %q, want it to contain %q", got, tc.escaped)
+			}
+		})
+	}
+}
+
+func TestParseSegment(t *testing.T) {
+	day := func(value string) time.Time {
+		t.Helper()
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	yes, no := true, false
+
+	tests := []struct {
+		query string
+		want  Segment
+	}{
+		{"", Segment{}},
+		{"balance>10 BALANCE<=20.5", Segment{Balance: []Comparison{{">", 10}, {"<=", 20.5}}}},
+		{"referrals>=1 referrals<5", Segment{Referrals: []Comparison{{">=", 1}, {"<", 5}}}},
+		{"referrals=0", Segment{Referrals: []Comparison{{"=", 0}}}},
+		{"joined=2024-01-01..2024-01-31", Segment{JoinedFrom: day("2024-01-01"), JoinedBefore: day("2024-02-01")}},
+		{"joined=2024-02-29", Segment{JoinedFrom: day("2024-02-29"), JoinedBefore: day("2024-03-01")}},
+		{"joined=2024-01-01..", Segment{JoinedFrom: day("2024-01-01")}},
+		{"joined=..2024-12-31", Segment{JoinedBefore: day("2025-01-01")}},
+		{"joined=2024-01-01..2024-03-31 joined=2024-02-01..2024-12-31", Segment{JoinedFrom: day("2024-02-01"), JoinedBefore: day("2024-04-01")}},
+		{"accno=YES", Segment{HasAccNo: &yes}},
+		{"accno=no", Segment{HasAccNo: &no}},
+		{"lang=EN", Segment{Lang: "en"}},
+		{"referrer=123456", Segment{Referrer: 123456}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			got, err := parseSegment(tc.query)
+			if err != nil {
+				t.Fatalf("parseSegment() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("parseSegment() = %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSegmentRejectsInvalidQueries(t *testing.T) {
+	for _, query := range []string{
+		"balance",
+		"balance>",
+		">5",
+		"balance>x",
+		"referrals=many",
+		"joined>2024-01-01",
+		"joined=..",
+		"joined=2024-13-01",
+		"joined=2024-01-01..2024-02-30",
+		"joined=01/02/2024",
+		"accno=maybe",
+		"lang>en",
+		"referrer=0",
+		"referrer=abc",
+		"country=de",
+		"balance>10 country=de",
+	} {
+		t.Run(query, func(t *testing.T) {
+			if seg, err := parseSegment(query); err == nil {
+				t.Errorf("parseSegment(%q) = %+v, want an error", query, *seg)
+			}
+		})
+	}
+}
+
+func TestSegmentMatchesJoinedBounds(t *testing.T) {
+	seg, err := parseSegment("joined=2024-01-01..2024-01-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		joined time.Time
+		want   bool
+	}{
+		{time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC), false},
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC), true},
+		{time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), false},
+		{time.Time{}, false},
+	}
+	for _, tc := range tests {
+		if got := seg.Match(&User{JoinedAt: tc.joined}); got != tc.want {
+			t.Errorf("Match(joined %s) = %v, want %v", tc.joined, got, tc.want)
+		}
+	}
+}
+
+func TestSegmentMatch(t *testing.T) {
+	user := &User{ID: 5, Balance: 10, ReferralCount: 2, AccNo: 42, LanguageCode: "ru", Language: "en", Referrer: 7}
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"balance>=10 balance<=10 balance=10", true},
+		{"balance>10", false},
+		{"balance<10", false},
+		{"referrals>1 referrals<3", true},
+		{"referrals=0", false},
+		{"accno=yes", true},
+		{"accno=no", false},
+		{"lang=en", true},
+		{"lang=ru", false},
+		{"referrer=7", true},
+		{"referrer=8", false},
+		{"balance>5 referrer=8", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			seg, err := parseSegment(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := seg.Match(user); got != tc.want {
+				t.Errorf("Match() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// shutdownTimeout bounds how long shutdown waits for in-flight handlers and
+// background jobs. SHUTDOWN_TIMEOUT overrides it.
+var shutdownTimeout = 30 * time.Second
+
+// abortGrace is how long cancelled work gets to unwind once shutdownTimeout
+// has passed.
+const abortGrace = 5 * time.Second
+
+// goJob runs fn in the background as work that shutdown waits for.
+func (a *App) goJob(fn func()) {
+	a.jobs.Add(1)
+	go func() {
+		defer a.jobs.Done()
+		fn()
+	}()
+}
+
+// shutdown is how main winds the bot down.
+type shutdown struct {
+	updater *ext.Updater
+	// stopJobs asks background jobs to stop at their next safe point.
+	stopJobs context.CancelFunc
+	// abort cancels the contexts of everything still running.
+	abort context.CancelFunc
+	// deleteWebhook removes the webhook once updates have stopped.
+	deleteWebhook bool
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM. It then stops taking
+// updates, waits for in-flight handlers and background jobs, and closes the
+// store. Work still running after shutdownTimeout is cancelled, so a deploy
+// can't hang forever on a stuck handler.
+func (a *App) waitForShutdown(b *gotgbot.Bot, s shutdown) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+	log.Printf("Received %s, shutting down...", sig)
+
+	drained := make(chan struct{})
+	go func() {
+		// Stop returns once the handlers already running have finished.
+		if err := s.updater.Stop(); err != nil {
+			log.Printf("Failed to stop updater: %v", err)
+		}
+		a.jobs.Wait()
+		close(drained)
+	}()
+	s.stopJobs()
+
+	select {
+	case <-drained:
+		log.Println("In-flight work finished")
+	case <-time.After(shutdownTimeout):
+		log.Printf("In-flight work still running after %s, cancelling it", shutdownTimeout)
+		s.abort()
+		select {
+		case <-drained:
+		case <-time.After(abortGrace):
+			log.Println("Gave up waiting for in-flight work")
+		}
+	}
+
+	if s.deleteWebhook {
+		if _, err := b.DeleteWebhook(nil); err != nil {
+			log.Printf("Failed to delete webhook: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	if err := a.store.Close(ctx); err != nil {
+		log.Printf("Failed to close store: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,1925 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+)
+
+// SQL dialects supported by SQLStore.
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// schemaFS holds the migrations of each dialect, applied in file name order.
+//
+//go:embed schema
+var schemaFS embed.FS
+
+// migrationLockKey is the Postgres advisory lock held while migrating, so
+// replicas starting together do not apply the same migration twice.
+const migrationLockKey = 7_264_011
+
+// SQLStore is the Store backed by PostgreSQL or SQLite. IDs that are
+// ObjectIDs in Mongo are kept as their hex form, so both backends hand the
+// same IDs to the handlers.
+type SQLStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// OpenSQLStore connects to the database and applies pending migrations. For
+// Postgres dsn is a connection URL, for SQLite the path of the database file.
+func OpenSQLStore(ctx context.Context, dialect, dsn string) (*SQLStore, error) {
+	var driver string
+	switch dialect {
+	case DialectPostgres:
+		driver = "pgx"
+	case DialectSQLite:
+		driver = "sqlite"
+		// Foreign keys are off by default in SQLite. Immediate transactions take
+		// the write lock up front, which is what serialises debits, and WAL lets
+		// readers carry on meanwhile. Times are written in a sortable format.
+		dsn = "file:" + dsn + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)&_txlock=immediate&_time_format=sqlite"
+	default:
+		return nil, fmt.Errorf("unknown SQL dialect %q", dialect)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	s := &SQLStore{db: db, dialect: dialect}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+// migrate applies the embedded migrations of the dialect that have not been
+// applied yet, each in its own transaction.
+func (s *SQLStore) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    BIGINT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	dir := path.Join("schema", s.dialect)
+	files, err := fs.ReadDir(schemaFS, dir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid migration name %q", name)
+		}
+
+		body, err := fs.ReadFile(schemaFS, path.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+
+		err = s.tx(ctx, func(tx *sql.Tx) error {
+			if s.dialect == DialectPostgres {
+				if _, err := s.exec(ctx, tx, "SELECT pg_advisory_xact_lock(?)", migrationLockKey); err != nil {
+					return err
+				}
+			}
+
+			var applied bool
+			if err := s.queryRow(ctx, tx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)", version).Scan(&applied); err != nil {
+				return err
+			}
+			if applied {
+				return nil
+			}
+
+			// Without arguments both drivers run every statement in the file.
+			if _, err := tx.ExecContext(ctx, string(body)); err != nil {
+				return err
+			}
+			if _, err := s.exec(ctx, tx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", version, name, time.Now().UTC()); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %s", name)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// rebind rewrites the ? placeholders the queries are written with into the
+// $n form Postgres expects.
+func (s *SQLStore) rebind(query string) string {
+	if s.dialect != DialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *SQLStore) exec(ctx context.Context, q querier, query string, args ...any) (sql.Result, error) {
+	return q.ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLStore) query(ctx context.Context, q querier, query string, args ...any) (*sql.Rows, error) {
+	return q.QueryContext(ctx, s.rebind(query), args...)
+}
+
+func (s *SQLStore) queryRow(ctx context.Context, q querier, query string, args ...any) *sql.Row {
+	return q.QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+// tx runs fn in a transaction, committing if it returns nil.
+func (s *SQLStore) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// forUpdate locks the selected rows until the transaction ends. SQLite has no
+// row locks; its immediate transactions already hold the database write lock.
+func (s *SQLStore) forUpdate() string {
+	if s.dialect == DialectPostgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// skipLocked is forUpdate for queues, where workers pass over rows another
+// worker is claiming instead of waiting for them.
+func (s *SQLStore) skipLocked() string {
+	if s.dialect == DialectPostgres {
+		return " FOR UPDATE SKIP LOCKED"
+	}
+	return ""
+}
+
+// placeholders returns n comma separated placeholders for an IN list.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// nullTime stores the zero time as NULL, matching omitempty in Mongo.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+func fromNullTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time.UTC()
+}
+
+func nullInt(n int64) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// toJSON encodes v for a TEXT column, storing nil as an empty string.
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	if string(b) == "null" {
+		return "", nil
+	}
+	return string(b), nil
+}
+
+func fromJSON(data string, v any) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func objectIDFromHex(hex string) primitive.ObjectID {
+	id, err := primitive.ObjectIDFromHex(strings.TrimSpace(hex))
+	if err != nil {
+		return primitive.NilObjectID
+	}
+	return id
+}
+
+const userColumns = "id, referrer, referral_count, acc_no, balance, first_name, username, language_code, is_premium, joined_at, last_seen, reward_pending, banned, inactive, inactive_since, inactive_reason, language"
+
+// prefixColumns qualifies each column of a column list with a table alias.
+func prefixColumns(alias, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, c := range cols {
+		cols[i] = alias + "." + c
+	}
+	return strings.Join(cols, ", ")
+}
+
+// scanUser scans the userColumns of a row, after any extra leading columns.
+func scanUser(row scanner, extra ...any) (*User, error) {
+	var (
+		u                                 User
+		referrer                          sql.NullInt64
+		joinedAt, lastSeen, inactiveSince sql.NullTime
+	)
+	dest := append(extra,
+		&u.ID, &referrer, &u.ReferralCount, &u.AccNo, &u.Balance,
+		&u.FirstName, &u.Username, &u.LanguageCode, &u.IsPremium,
+		&joinedAt, &lastSeen, &u.RewardPending, &u.Banned,
+		&u.Inactive, &inactiveSince, &u.InactiveReason, &u.Language,
+	)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	u.Referrer = referrer.Int64
+	u.JoinedAt = fromNullTime(joinedAt)
+	u.LastSeen = fromNullTime(lastSeen)
+	u.InactiveSince = fromNullTime(inactiveSince)
+	return &u, nil
+}
+
+// userValues returns the values of the userColumns of user.
+func userValues(user User) []any {
+	return []any{
+		user.ID, nullInt(user.Referrer), user.ReferralCount, user.AccNo, user.Balance,
+		user.FirstName, user.Username, user.LanguageCode, user.IsPremium,
+		nullTime(user.JoinedAt), nullTime(user.LastSeen), user.RewardPending, user.Banned,
+		user.Inactive, nullTime(user.InactiveSince), user.InactiveReason, user.Language,
+	}
+}
+
+func scanUsers(rows *sql.Rows) ([]User, error) {
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLStore) AddUser(ctx context.Context, user User) error {
+	return s.insertUser(ctx, s.db, user)
+}
+
+func (s *SQLStore) insertUser(ctx context.Context, q querier, user User) error {
+	var exists bool
+	err := s.queryRow(ctx, q, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", user.ID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check user existence: %w", err)
+	}
+
+	if exists {
+		return fmt.Errorf("user with ID %d already exists", user.ID)
+	}
+
+	if user.JoinedAt.IsZero() {
+		user.JoinedAt = time.Now().UTC()
+	}
+	if user.LastSeen.IsZero() {
+		user.LastSeen = user.JoinedAt
+	}
+
+	_, err = s.exec(ctx, q, "INSERT INTO users ("+userColumns+") VALUES ("+placeholders(17)+")", userValues(user)...)
+	if err != nil {
+		return fmt.Errorf("failed to add user: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLStore) ReferUser(ctx context.Context, referrerID int64, newUser User) error {
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		err := s.queryRow(ctx, tx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", referrerID).Scan(&exists)
+		if err != nil || !exists {
+			return fmt.Errorf("referrer with ID %d does not exist", referrerID)
+		}
+
+		newUser.Referrer = referrerID
+		newUser.RewardPending = true
+
+		if err := s.insertUser(ctx, tx, newUser); err != nil {
+			return err
+		}
+
+		_, err = s.exec(ctx, tx, "INSERT INTO referrals (referee, referrer, created_at) VALUES (?, ?, ?)",
+			newUser.ID, referrerID, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("failed to record referral: %w", err)
+		}
+
+		_, err = s.exec(ctx, tx, "UPDATE users SET referral_count = referral_count + 1 WHERE id = ?", referrerID)
+		if err != nil {
+			return fmt.Errorf("failed to update referrer's referral count: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) GetUser(ctx context.Context, userID int64) (*User, error) {
+	user, err := scanUser(s.queryRow(ctx, s.db, "SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve user %d: %w", userID, err)
+	}
+	return user, nil
+}
+
+func (s *SQLStore) GetReferredUsers(ctx context.Context, referrerID, cursor int64, backward bool, limit int64) ([]User, bool, error) {
+	query := "SELECT r.created_at, " + prefixColumns("u", userColumns) +
+		" FROM referrals r JOIN users u ON u.id = r.referee WHERE r.referrer = ?"
+	args := []any{referrerID}
+	order := "ASC"
+	if backward {
+		query += " AND r.referee < ?"
+		args = append(args, cursor)
+		order = "DESC"
+	} else if cursor != 0 {
+		query += " AND r.referee > ?"
+		args = append(args, cursor)
+	}
+	query += " ORDER BY r.referee " + order + " LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := s.query(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to retrieve referred users: %w", err)
+	}
+	defer rows.Close()
+
+	var referredUsers []User
+	for rows.Next() {
+		var referredAt sql.NullTime
+		u, err := scanUser(rows, &referredAt)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode referred users: %w", err)
+		}
+		if u.JoinedAt.IsZero() {
+			u.JoinedAt = fromNullTime(referredAt)
+		}
+		referredUsers = append(referredUsers, *u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to retrieve referred users: %w", err)
+	}
+
+	hasMore := int64(len(referredUsers)) > limit
+	if hasMore {
+		referredUsers = referredUsers[:limit]
+	}
+
+	if backward {
+		for i, j := 0, len(referredUsers)-1; i < j; i, j = i+1, j-1 {
+			referredUsers[i], referredUsers[j] = referredUsers[j], referredUsers[i]
+		}
+	}
+	return referredUsers, hasMore, nil
+}
+
+func (s *SQLStore) CountReferredUsers(ctx context.Context, referrerID int64) (int64, error) {
+	var count int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM referrals WHERE referrer = ?", referrerID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count referred users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *SQLStore) MarkReferralRewarded(ctx context.Context, userID int64) error {
+	_, err := s.exec(ctx, s.db, "UPDATE users SET reward_pending = FALSE WHERE id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark referral reward for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) UpdateUserProfile(ctx context.Context, profile User) (*User, error) {
+	// Any interaction proves the user can be reached again.
+	res, err := s.exec(ctx, s.db, `UPDATE users SET first_name = ?, username = ?, language_code = ?, is_premium = ?, last_seen = ?,
+    inactive = FALSE, inactive_since = NULL, inactive_reason = '' WHERE id = ?`,
+		profile.FirstName, profile.Username, profile.LanguageCode, profile.IsPremium, time.Now().UTC(), profile.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update profile for user %d: %w", profile.ID, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetUser(ctx, profile.ID)
+}
+
+// likeEscaper escapes the LIKE wildcards of a search term.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *SQLStore) SearchUsers(ctx context.Context, query string, limit int64) ([]User, error) {
+	query = strings.TrimPrefix(strings.TrimSpace(query), "@")
+	if query == "" {
+		return nil, nil
+	}
+
+	prefix := likeEscaper.Replace(strings.ToLower(query)) + "%"
+	where := `LOWER(username) LIKE ? ESCAPE '\' OR LOWER(first_name) LIKE ? ESCAPE '\'`
+	args := []any{prefix, prefix}
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		where += " OR id = ?"
+		args = append(args, id)
+	}
+	args = append(args, limit)
+
+	rows, err := s.query(ctx, s.db, "SELECT "+userColumns+" FROM users WHERE "+where+" ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+
+	users, err := scanUsers(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
+
+func (s *SQLStore) SetUserBanned(ctx context.Context, userID int64, banned bool) error {
+	_, err := s.exec(ctx, s.db, "UPDATE users SET banned = ? WHERE id = ?", banned, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update ban status for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) AddLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	entry.CreatedAt = time.Now().UTC()
+	_, err := s.exec(ctx, s.db, "INSERT INTO ledger ("+ledgerColumns+") VALUES ("+placeholders(9)+")", ledgerValues(&entry)...)
+	if err != nil {
+		return fmt.Errorf("failed to record ledger entry for user %d: %w", entry.UserID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) ApplyLedgerEntry(ctx context.Context, entry LedgerEntry) error {
+	entry.ID = primitive.NewObjectID()
+	entry.CreatedAt = time.Now().UTC()
+
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		var balance float64
+		err := s.queryRow(ctx, tx, "SELECT balance FROM users WHERE id = ?"+s.forUpdate(), entry.UserID).Scan(&balance)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return fmt.Errorf("failed to update balance: %w", err)
+		}
+		if balance+entry.Amount < 0 {
+			return fmt.Errorf("insufficient balance for user %d", entry.UserID)
+		}
+
+		if _, err := s.exec(ctx, tx, "UPDATE users SET balance = ? WHERE id = ?", balance+entry.Amount, entry.UserID); err != nil {
+			return fmt.Errorf("failed to update balance: %w", err)
+		}
+		_, err = s.exec(ctx, tx, "INSERT INTO ledger ("+ledgerColumns+") VALUES ("+placeholders(9)+")", ledgerValues(&entry)...)
+		if err != nil {
+			return fmt.Errorf("failed to record ledger entry for user %d: %w", entry.UserID, err)
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) ApplyBatchEntry(ctx context.Context, entry LedgerEntry) (bool, error) {
+	entry.ID = primitive.NewObjectID()
+	entry.CreatedAt = time.Now().UTC()
+
+	applied := false
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		// The unique index on batch rows skips an entry recorded before.
+		res, err := s.exec(ctx, tx, "INSERT INTO ledger ("+ledgerColumns+") VALUES ("+placeholders(9)+") ON CONFLICT DO NOTHING", ledgerValues(&entry)...)
+		if err != nil {
+			return fmt.Errorf("failed to record ledger entry for user %d: %w", entry.UserID, err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+
+		var balance float64
+		err = s.queryRow(ctx, tx, "SELECT balance FROM users WHERE id = ?"+s.forUpdate(), entry.UserID).Scan(&balance)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("user with ID %d does not exist", entry.UserID)
+			}
+			return fmt.Errorf("failed to update balance: %w", err)
+		}
+		if balance+entry.Amount < 0 {
+			return fmt.Errorf("insufficient balance for user %d", entry.UserID)
+		}
+
+		if _, err := s.exec(ctx, tx, "UPDATE users SET balance = ? WHERE id = ?", balance+entry.Amount, entry.UserID); err != nil {
+			return fmt.Errorf("failed to update balance: %w", err)
+		}
+		applied = true
+		return nil
+	})
+	return applied, err
+}
+
+const ledgerColumns = "id, user_id, amount, kind, actor, batch, batch_row, reason, created_at"
+
+// ledgerValues returns the values of the ledgerColumns of e.
+func ledgerValues(e *LedgerEntry) []any {
+	batch := ""
+	if !e.Batch.IsZero() {
+		batch = e.Batch.Hex()
+	}
+	return []any{e.ID.Hex(), e.UserID, e.Amount, e.Kind, e.Actor, batch, e.Row, e.Reason, e.CreatedAt.UTC()}
+}
+
+func scanLedgerEntry(row scanner) (*LedgerEntry, error) {
+	var (
+		e         LedgerEntry
+		id, batch string
+	)
+	if err := row.Scan(&id, &e.UserID, &e.Amount, &e.Kind, &e.Actor, &batch, &e.Row, &e.Reason, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	e.ID = objectIDFromHex(id)
+	e.Batch = objectIDFromHex(batch)
+	e.CreatedAt = e.CreatedAt.UTC()
+	return &e, nil
+}
+
+func (s *SQLStore) GetLedgerEntries(ctx context.Context, userID int64, limit int64) ([]LedgerEntry, error) {
+	rows, err := s.query(ctx, s.db, "SELECT "+ledgerColumns+" FROM ledger WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve ledger: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		e, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode ledger: %w", err)
+		}
+		entries = append(entries, *e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve ledger: %w", err)
+	}
+	return entries, nil
+}
+
+func (s *SQLStore) GetLedgerSummary(ctx context.Context, userID int64) (*LedgerSummary, error) {
+	summary := LedgerSummary{}
+	err := s.queryRow(ctx, s.db, `SELECT
+    COALESCE(SUM(CASE WHEN amount > 0 THEN amount ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN amount < 0 THEN amount ELSE 0 END), 0),
+    COUNT(*)
+FROM ledger WHERE user_id = ?`, userID).Scan(&summary.Credits, &summary.Debits, &summary.Entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarise ledger: %w", err)
+	}
+	return &summary, nil
+}
+
+func (s *SQLStore) EachLedgerEntry(ctx context.Context, from, before time.Time, fn func(LedgerEntry) error) error {
+	where, args := timeRangeWhere("created_at", from, before)
+	rows, err := s.query(ctx, s.db, "SELECT "+ledgerColumns+" FROM ledger WHERE "+where+" ORDER BY created_at, id", args...)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve ledger: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanLedgerEntry(rows)
+		if err != nil {
+			return fmt.Errorf("failed to decode ledger entry: %w", err)
+		}
+		if err := fn(*e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) EachBatchLedgerEntry(ctx context.Context, batch primitive.ObjectID, fn func(LedgerEntry) error) error {
+	rows, err := s.query(ctx, s.db, "SELECT "+ledgerColumns+" FROM ledger WHERE batch = ? ORDER BY id", batch.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to retrieve ledger: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanLedgerEntry(rows)
+		if err != nil {
+			return fmt.Errorf("failed to decode ledger entry: %w", err)
+		}
+		if err := fn(*e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+const withdrawalColumns = "id, user_id, amount, acc_no, status, requested_at, approved_at"
+
+func scanWithdrawal(row scanner) (*Withdrawal, error) {
+	var (
+		w          Withdrawal
+		id         string
+		approvedAt sql.NullTime
+	)
+	if err := row.Scan(&id, &w.UserID, &w.Amount, &w.AccNo, &w.Status, &w.RequestedAt, &approvedAt); err != nil {
+		return nil, err
+	}
+	w.ID = objectIDFromHex(id)
+	w.RequestedAt = w.RequestedAt.UTC()
+	w.ApprovedAt = fromNullTime(approvedAt)
+	return &w, nil
+}
+
+func (s *SQLStore) AddWithdrawal(ctx context.Context, w Withdrawal) (primitive.ObjectID, error) {
+	w.ID = primitive.NewObjectID()
+	w.Status = WithdrawalPending
+	w.RequestedAt = time.Now().UTC()
+	_, err := s.exec(ctx, s.db, "INSERT INTO withdrawals ("+withdrawalColumns+") VALUES (?, ?, ?, ?, ?, ?, NULL)",
+		w.ID.Hex(), w.UserID, w.Amount, w.AccNo, w.Status, w.RequestedAt)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to record withdrawal: %w", err)
+	}
+	return w.ID, nil
+}
+
+func (s *SQLStore) ApproveWithdrawal(ctx context.Context, id primitive.ObjectID) (*Withdrawal, error) {
+	res, err := s.exec(ctx, s.db, "UPDATE withdrawals SET status = ?, approved_at = ? WHERE id = ? AND status = ?",
+		WithdrawalApproved, time.Now().UTC(), id.Hex(), WithdrawalPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to approve withdrawal: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, fmt.Errorf("withdrawal %s not found or already approved", id.Hex())
+	}
+
+	w, err := scanWithdrawal(s.queryRow(ctx, s.db, "SELECT "+withdrawalColumns+" FROM withdrawals WHERE id = ?", id.Hex()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to approve withdrawal: %w", err)
+	}
+	return w, nil
+}
+
+func (s *SQLStore) GetWithdrawals(ctx context.Context, userID int64, limit int64) ([]Withdrawal, int64, error) {
+	var count int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM withdrawals WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return nil, 0, fmt.Errorf("failed to count withdrawals: %w", err)
+	}
+
+	rows, err := s.query(ctx, s.db, "SELECT "+withdrawalColumns+" FROM withdrawals WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve withdrawals: %w", err)
+	}
+	defer rows.Close()
+
+	var withdrawals []Withdrawal
+	for rows.Next() {
+		w, err := scanWithdrawal(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode withdrawals: %w", err)
+		}
+		withdrawals = append(withdrawals, *w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve withdrawals: %w", err)
+	}
+	return withdrawals, count, nil
+}
+
+func (s *SQLStore) EachWithdrawal(ctx context.Context, from, before time.Time, fn func(Withdrawal) error) error {
+	where, args := timeRangeWhere("requested_at", from, before)
+	rows, err := s.query(ctx, s.db, "SELECT "+withdrawalColumns+" FROM withdrawals WHERE "+where+" ORDER BY requested_at, id", args...)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve withdrawals: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		w, err := scanWithdrawal(rows)
+		if err != nil {
+			return fmt.Errorf("failed to decode withdrawal: %w", err)
+		}
+		if err := fn(*w); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) UpdateUserBalance(ctx context.Context, userID int64, amount float64) error {
+	res, err := s.exec(ctx, s.db, "UPDATE users SET balance = balance + ? WHERE id = ?", amount, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update balance for user %d: %w", userID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update balance for user %d: %w", userID, err)
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) RemoveBalance(ctx context.Context, userID int64, amount float64) (float64, error) {
+	if amount <= 0 {
+		return 0, fmt.Errorf("amount to remove must be greater than zero")
+	}
+
+	var balance float64
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		// The row stays locked until commit, so concurrent debits queue up
+		// behind each other instead of both passing the balance check.
+		err := s.queryRow(ctx, tx, "SELECT balance FROM users WHERE id = ?"+s.forUpdate(), userID).Scan(&balance)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("user with ID %d does not exist", userID)
+			}
+			return fmt.Errorf("failed to update balance: %w", err)
+		}
+
+		if balance < amount {
+			return fmt.Errorf("insufficient balance for user %d", userID)
+		}
+
+		balance -= amount
+		if _, err := s.exec(ctx, tx, "UPDATE users SET balance = ? WHERE id = ?", balance, userID); err != nil {
+			return fmt.Errorf("failed to update balance: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+func (s *SQLStore) UpdateUserAccNo(ctx context.Context, userID int64, accNo int64) error {
+	_, err := s.exec(ctx, s.db, "UPDATE users SET acc_no = ? WHERE id = ?", accNo, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update acc_no for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) SetUserLanguage(ctx context.Context, userID int64, language string) error {
+	_, err := s.exec(ctx, s.db, "UPDATE users SET language = ? WHERE id = ?", language, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update language for user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetTopReferrers(ctx context.Context, limit int64) ([]User, error) {
+	rows, err := s.query(ctx, s.db, "SELECT "+userColumns+" FROM users WHERE referral_count > 0 ORDER BY referral_count DESC, id LIMIT ?", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve top referrers: %w", err)
+	}
+
+	users, err := scanUsers(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode top referrers: %w", err)
+	}
+	return users, nil
+}
+
+func (s *SQLStore) CountActiveUsers(ctx context.Context, since time.Time) (int64, error) {
+	var count int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM users WHERE last_seen >= ?", since.UTC()).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count active users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *SQLStore) CountUsers(ctx context.Context) (int64, error) {
+	var count int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *SQLStore) MarkUserInactive(ctx context.Context, userID int64, reason string) error {
+	_, err := s.exec(ctx, s.db, "UPDATE users SET inactive = TRUE, inactive_since = ?, inactive_reason = ? WHERE id = ?",
+		time.Now().UTC(), reason, userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark user %d inactive: %w", userID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) CountInactiveUsers(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.query(ctx, s.db, "SELECT inactive_reason, COUNT(*) FROM users WHERE inactive GROUP BY inactive_reason")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count inactive users: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var (
+			reason string
+			count  int64
+		)
+		if err := rows.Scan(&reason, &count); err != nil {
+			return nil, fmt.Errorf("failed to decode inactive users: %w", err)
+		}
+		counts[reason] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count inactive users: %w", err)
+	}
+	return counts, nil
+}
+
+// segmentWhere turns a segment into a condition on the users table.
+func segmentWhere(seg *Segment) (string, []any) {
+	var (
+		conds []string
+		args  []any
+	)
+	// The operators come from segmentOps, so they are safe to inline.
+	for _, c := range seg.Balance {
+		conds = append(conds, "balance "+c.Op+" ?")
+		args = append(args, c.Value)
+	}
+	for _, c := range seg.Referrals {
+		conds = append(conds, "referral_count "+c.Op+" ?")
+		args = append(args, c.Value)
+	}
+
+	if !seg.JoinedFrom.IsZero() {
+		conds = append(conds, "joined_at >= ?")
+		args = append(args, seg.JoinedFrom.UTC())
+	}
+	if !seg.JoinedBefore.IsZero() {
+		conds = append(conds, "joined_at < ?")
+		args = append(args, seg.JoinedBefore.UTC())
+	}
+
+	if seg.HasAccNo != nil {
+		if *seg.HasAccNo {
+			conds = append(conds, "acc_no > 0")
+		} else {
+			conds = append(conds, "acc_no <= 0")
+		}
+	}
+
+	if seg.Lang != "" {
+		// Like User.effectiveLanguage: the picked language, else Telegram's.
+		conds = append(conds, "COALESCE(NULLIF(language, ''), language_code) = ?")
+		args = append(args, seg.Lang)
+	}
+	if seg.Referrer != 0 {
+		conds = append(conds, "referrer = ?")
+		args = append(args, seg.Referrer)
+	}
+
+	if len(conds) == 0 {
+		return "TRUE", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (s *SQLStore) CountReachableUsers(ctx context.Context, segment *Segment) (int64, error) {
+	where, args := segmentWhere(segment)
+
+	var count int64
+	if err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM users WHERE NOT inactive AND NOT banned AND "+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
+func (s *SQLStore) GetUserIDsAfter(ctx context.Context, after int64, limit int64, segment *Segment) ([]int64, error) {
+	where, args := segmentWhere(segment)
+	args = append([]any{after}, args...)
+	args = append(args, limit)
+
+	rows, err := s.query(ctx, s.db, "SELECT id FROM users WHERE id > ? AND NOT inactive AND NOT banned AND "+where+" ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve users: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to decode users: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve users: %w", err)
+	}
+	return ids, nil
+}
+
+func (s *SQLStore) EachUser(ctx context.Context, from, before time.Time, fn func(User) error) error {
+	where, args := timeRangeWhere("joined_at", from, before)
+	rows, err := s.query(ctx, s.db, "SELECT "+userColumns+" FROM users WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return fmt.Errorf("failed to decode user: %w", err)
+		}
+		if err := fn(*u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// timeRangeWhere limits column to [from, before), leaving zero ends open.
+func timeRangeWhere(column string, from, before time.Time) (string, []any) {
+	var (
+		conds []string
+		args  []any
+	)
+	if !from.IsZero() {
+		conds = append(conds, column+" >= ?")
+		args = append(args, from.UTC())
+	}
+	if !before.IsZero() {
+		conds = append(conds, column+" < ?")
+		args = append(args, before.UTC())
+	}
+	if len(conds) == 0 {
+		return "TRUE", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+const broadcastColumns = "id, from_chat_id, message_id, reply_markup, created_by, segment, forward, silent, pin, protect, status, cursor_id, total, sent, failed, errors, progress_chat_id, progress_message_id, worker, lease_until, created_at, finished_at, " +
+	"schedule_id, schedule_run"
+
+func scanBroadcast(row scanner) (*Broadcast, error) {
+	var (
+		job                                 Broadcast
+		id, markup, errs, scheduleID        string
+		leaseUntil, finishedAt, scheduleRun sql.NullTime
+	)
+	err := row.Scan(&id, &job.FromChatID, &job.MessageID, &markup, &job.CreatedBy, &job.Segment,
+		&job.Forward, &job.Silent, &job.Pin, &job.Protect, &job.Status,
+		&job.Cursor, &job.Total, &job.Sent, &job.Failed, &errs,
+		&job.ProgressChatID, &job.ProgressMessageID, &job.Worker, &leaseUntil, &job.CreatedAt, &finishedAt,
+		&scheduleID, &scheduleRun)
+	if err != nil {
+		return nil, err
+	}
+
+	job.ID = objectIDFromHex(id)
+	if err := fromJSON(markup, &job.ReplyMarkup); err != nil {
+		return nil, fmt.Errorf("invalid reply markup: %w", err)
+	}
+	if err := fromJSON(errs, &job.Errors); err != nil {
+		return nil, fmt.Errorf("invalid error counts: %w", err)
+	}
+	job.LeaseUntil = fromNullTime(leaseUntil)
+	job.CreatedAt = job.CreatedAt.UTC()
+	job.FinishedAt = fromNullTime(finishedAt)
+	job.ScheduleID = objectIDFromHex(scheduleID)
+	job.ScheduleRun = fromNullTime(scheduleRun)
+	return &job, nil
+}
+
+// broadcastValues returns the values of the broadcastColumns of job.
+func broadcastValues(job *Broadcast) ([]any, error) {
+	markup, err := toJSON(job.ReplyMarkup)
+	if err != nil {
+		return nil, err
+	}
+	errs, err := toJSON(job.Errors)
+	if err != nil {
+		return nil, err
+	}
+	scheduleID := ""
+	if !job.ScheduleID.IsZero() {
+		scheduleID = job.ScheduleID.Hex()
+	}
+	return []any{
+		job.ID.Hex(), job.FromChatID, job.MessageID, markup, job.CreatedBy, job.Segment,
+		job.Forward, job.Silent, job.Pin, job.Protect, job.Status,
+		job.Cursor, job.Total, job.Sent, job.Failed, errs,
+		job.ProgressChatID, job.ProgressMessageID, job.Worker, nullTime(job.LeaseUntil), job.CreatedAt.UTC(), nullTime(job.FinishedAt),
+		scheduleID, nullTime(job.ScheduleRun),
+	}, nil
+}
+
+func (s *SQLStore) getBroadcast(ctx context.Context, q querier, id string, lock string) (*Broadcast, error) {
+	return scanBroadcast(s.queryRow(ctx, q, "SELECT "+broadcastColumns+" FROM broadcasts WHERE id = ?"+lock, id))
+}
+
+func (s *SQLStore) AddBroadcast(ctx context.Context, job Broadcast) (primitive.ObjectID, error) {
+	if job.ID.IsZero() {
+		job.ID = primitive.NewObjectID()
+	}
+	if job.Status == "" {
+		job.Status = BroadcastQueued
+	}
+	job.CreatedAt = time.Now().UTC()
+
+	values, err := broadcastValues(&job)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to queue broadcast: %w", err)
+	}
+
+	// The unique index on scheduled runs skips a run queued before.
+	res, err := s.exec(ctx, s.db, "INSERT INTO broadcasts ("+broadcastColumns+") VALUES ("+placeholders(24)+") ON CONFLICT DO NOTHING", values...)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to queue broadcast: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to queue broadcast: %w", err)
+	} else if n == 0 {
+		return primitive.NilObjectID, ErrAlreadyQueued
+	}
+	return job.ID, nil
+}
+
+func (s *SQLStore) ClaimBroadcast(ctx context.Context, worker string, lease time.Duration) (*Broadcast, error) {
+	now := time.Now().UTC()
+
+	var job *Broadcast
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		var id string
+		err := s.queryRow(ctx, tx, `SELECT id FROM broadcasts
+WHERE status IN (?, ?) AND (lease_until IS NULL OR lease_until < ?)
+ORDER BY created_at LIMIT 1`+s.skipLocked(), BroadcastQueued, BroadcastRunning, now).Scan(&id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+
+		_, err = s.exec(ctx, tx, "UPDATE broadcasts SET status = ?, worker = ?, lease_until = ? WHERE id = ?",
+			BroadcastRunning, worker, now.Add(lease), id)
+		if err != nil {
+			return err
+		}
+
+		job, err = s.getBroadcast(ctx, tx, id, "")
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim broadcast: %w", err)
+	}
+	return job, nil
+}
+
+func (s *SQLStore) CheckpointBroadcast(ctx context.Context, job *Broadcast, worker string, lease time.Duration) (string, error) {
+	errs, err := toJSON(job.Errors)
+	if err != nil {
+		return "", fmt.Errorf("failed to checkpoint broadcast: %w", err)
+	}
+
+	var status string
+	err = s.tx(ctx, func(tx *sql.Tx) error {
+		res, err := s.exec(ctx, tx, "UPDATE broadcasts SET cursor_id = ?, sent = ?, failed = ?, errors = ?, lease_until = ? WHERE id = ? AND worker = ?",
+			job.Cursor, job.Sent, job.Failed, errs, time.Now().UTC().Add(lease), job.ID.Hex(), worker)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		return s.queryRow(ctx, tx, "SELECT status FROM broadcasts WHERE id = ?", job.ID.Hex()).Scan(&status)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to checkpoint broadcast: %w", err)
+	}
+	return status, nil
+}
+
+func (s *SQLStore) FinishBroadcast(ctx context.Context, job *Broadcast, status string) error {
+	job.Status = status
+	job.FinishedAt = time.Now().UTC()
+
+	errs, err := toJSON(job.Errors)
+	if err != nil {
+		return fmt.Errorf("failed to finish broadcast: %w", err)
+	}
+	_, err = s.exec(ctx, s.db, "UPDATE broadcasts SET status = ?, cursor_id = ?, sent = ?, failed = ?, errors = ?, finished_at = ? WHERE id = ?",
+		job.Status, job.Cursor, job.Sent, job.Failed, errs, job.FinishedAt, job.ID.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to finish broadcast: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetBroadcast(ctx context.Context, id primitive.ObjectID) (*Broadcast, error) {
+	job, err := s.getBroadcast(ctx, s.db, id.Hex(), "")
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve broadcast: %w", err)
+	}
+	return job, nil
+}
+
+func (s *SQLStore) SetBroadcastStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*Broadcast, error) {
+	var job *Broadcast
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		job, err = s.getBroadcast(ctx, tx, id.Hex(), s.forUpdate())
+		if err != nil {
+			return err
+		}
+		if !contains(from, job.Status) {
+			return sql.ErrNoRows
+		}
+
+		update := "UPDATE broadcasts SET status = ? WHERE id = ?"
+		if status == BroadcastQueued {
+			// Let any worker claim the resumed job straight away.
+			update = "UPDATE broadcasts SET status = ?, lease_until = NULL WHERE id = ?"
+		}
+		_, err = s.exec(ctx, tx, update, status, id.Hex())
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("broadcast can no longer be changed")
+		}
+		return nil, fmt.Errorf("failed to update broadcast: %w", err)
+	}
+	return job, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SQLStore) SetBroadcastOptions(ctx context.Context, id primitive.ObjectID, o BroadcastOptions) (*Broadcast, error) {
+	res, err := s.exec(ctx, s.db, "UPDATE broadcasts SET forward = ?, silent = ?, pin = ?, protect = ? WHERE id = ? AND status = ?",
+		o.Forward, o.Silent, o.Pin, o.Protect, id.Hex(), BroadcastDraft)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update broadcast: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, fmt.Errorf("broadcast can no longer be changed")
+	}
+	return s.GetBroadcast(ctx, id)
+}
+
+func (s *SQLStore) AddBroadcastFailure(ctx context.Context, f BroadcastFailure) error {
+	f.At = time.Now().UTC()
+	_, err := s.exec(ctx, s.db, "INSERT INTO broadcast_failures (broadcast_id, user_id, kind, description, at) VALUES (?, ?, ?, ?, ?)",
+		f.BroadcastID.Hex(), f.UserID, f.Kind, f.Description, f.At)
+	if err != nil {
+		return fmt.Errorf("failed to record broadcast failure: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) EachBroadcastFailure(ctx context.Context, id primitive.ObjectID, fn func(BroadcastFailure) error) error {
+	rows, err := s.query(ctx, s.db, "SELECT user_id, kind, description, at FROM broadcast_failures WHERE broadcast_id = ? ORDER BY user_id", id.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to retrieve broadcast failures: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := BroadcastFailure{BroadcastID: id}
+		if err := rows.Scan(&f.UserID, &f.Kind, &f.Description, &f.At); err != nil {
+			return fmt.Errorf("failed to decode broadcast failure: %w", err)
+		}
+		f.At = f.At.UTC()
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) AddBroadcastDeliveries(ctx context.Context, deliveries []BroadcastDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		for _, d := range deliveries {
+			_, err := s.exec(ctx, tx, "INSERT INTO broadcast_deliveries (broadcast_id, user_id, message_id) VALUES (?, ?, ?)",
+				d.BroadcastID.Hex(), d.UserID, d.MessageID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record broadcast deliveries: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) EachBroadcastDelivery(ctx context.Context, id primitive.ObjectID, fn func(BroadcastDelivery) error) error {
+	rows, err := s.query(ctx, s.db, "SELECT user_id, message_id FROM broadcast_deliveries WHERE broadcast_id = ?", id.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to retrieve broadcast deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := BroadcastDelivery{BroadcastID: id}
+		if err := rows.Scan(&d.UserID, &d.MessageID); err != nil {
+			return fmt.Errorf("failed to decode broadcast delivery: %w", err)
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) DeleteBroadcastDeliveries(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.exec(ctx, s.db, "DELETE FROM broadcast_deliveries WHERE broadcast_id = ?", id.Hex()); err != nil {
+		return fmt.Errorf("failed to remove broadcast deliveries: %w", err)
+	}
+	return nil
+}
+
+const scheduleColumns = "id, from_chat_id, message_id, reply_markup, segment, cron, next_run, last_run, active, created_by, created_at, " +
+	"forward, silent, pin, protect, failures, last_error, current_run"
+
+// scheduleValues returns the values of the scheduleColumns of sch.
+func scheduleValues(sch *Schedule) ([]any, error) {
+	markup, err := toJSON(sch.ReplyMarkup)
+	if err != nil {
+		return nil, err
+	}
+	return []any{
+		sch.ID.Hex(), sch.FromChatID, sch.MessageID, markup, sch.Segment, sch.Cron,
+		sch.NextRun.UTC(), nullTime(sch.LastRun), sch.Active, sch.CreatedBy, sch.CreatedAt.UTC(),
+		sch.Forward, sch.Silent, sch.Pin, sch.Protect, sch.Failures, sch.LastError, nullTime(sch.CurrentRun),
+	}, nil
+}
+
+func scanSchedule(row scanner) (*Schedule, error) {
+	var (
+		sch                 Schedule
+		id, markup          string
+		lastRun, currentRun sql.NullTime
+	)
+	err := row.Scan(&id, &sch.FromChatID, &sch.MessageID, &markup, &sch.Segment, &sch.Cron,
+		&sch.NextRun, &lastRun, &sch.Active, &sch.CreatedBy, &sch.CreatedAt,
+		&sch.Forward, &sch.Silent, &sch.Pin, &sch.Protect, &sch.Failures, &sch.LastError, &currentRun)
+	if err != nil {
+		return nil, err
+	}
+	sch.ID = objectIDFromHex(id)
+	if err := fromJSON(markup, &sch.ReplyMarkup); err != nil {
+		return nil, fmt.Errorf("invalid reply markup: %w", err)
+	}
+	sch.NextRun = sch.NextRun.UTC()
+	sch.LastRun = fromNullTime(lastRun)
+	sch.CurrentRun = fromNullTime(currentRun)
+	sch.CreatedAt = sch.CreatedAt.UTC()
+	return &sch, nil
+}
+
+func scanSchedules(rows *sql.Rows) ([]Schedule, error) {
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		sch, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *sch)
+	}
+	return schedules, rows.Err()
+}
+
+func (s *SQLStore) AddSchedule(ctx context.Context, sch Schedule) (primitive.ObjectID, error) {
+	if sch.ID.IsZero() {
+		sch.ID = primitive.NewObjectID()
+	}
+	sch.Active = true
+	sch.CreatedAt = time.Now().UTC()
+
+	values, err := scheduleValues(&sch)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to save schedule: %w", err)
+	}
+	_, err = s.exec(ctx, s.db, "INSERT INTO schedules ("+scheduleColumns+") VALUES ("+placeholders(18)+")", values...)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return sch.ID, nil
+}
+
+func (s *SQLStore) GetActiveSchedules(ctx context.Context) ([]Schedule, error) {
+	rows, err := s.query(ctx, s.db, "SELECT "+scheduleColumns+" FROM schedules WHERE active ORDER BY next_run")
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve schedules: %w", err)
+	}
+
+	schedules, err := scanSchedules(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+func (s *SQLStore) GetDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error) {
+	rows, err := s.query(ctx, s.db, "SELECT "+scheduleColumns+" FROM schedules WHERE active AND next_run <= ?", now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve due schedules: %w", err)
+	}
+
+	schedules, err := scanSchedules(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+func (s *SQLStore) GetSchedule(ctx context.Context, id primitive.ObjectID) (*Schedule, error) {
+	sch, err := scanSchedule(s.queryRow(ctx, s.db, "SELECT "+scheduleColumns+" FROM schedules WHERE id = ? AND active", id.Hex()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve schedule: %w", err)
+	}
+	return sch, nil
+}
+
+func (s *SQLStore) AdvanceSchedule(ctx context.Context, sch *Schedule, next time.Time, failures int, lastError string) (bool, error) {
+	update := "UPDATE schedules SET last_run = ?, current_run = ?, failures = ?, last_error = ?, next_run = ? WHERE id = ? AND active AND next_run = ?"
+	args := []any{time.Now().UTC(), nullTime(sch.CurrentRun), failures, lastError, next.UTC(), sch.ID.Hex(), sch.NextRun.UTC()}
+	if next.IsZero() {
+		update = "UPDATE schedules SET last_run = ?, current_run = ?, failures = ?, last_error = ?, active = FALSE WHERE id = ? AND active AND next_run = ?"
+		args = []any{time.Now().UTC(), nullTime(sch.CurrentRun), failures, lastError, sch.ID.Hex(), sch.NextRun.UTC()}
+	}
+
+	res, err := s.exec(ctx, s.db, update, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to advance schedule: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to advance schedule: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (s *SQLStore) SetScheduleOptions(ctx context.Context, id primitive.ObjectID, o BroadcastOptions) (*Schedule, error) {
+	res, err := s.exec(ctx, s.db, "UPDATE schedules SET forward = ?, silent = ?, pin = ?, protect = ? WHERE id = ? AND active",
+		o.Forward, o.Silent, o.Pin, o.Protect, id.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to update schedule: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetSchedule(ctx, id)
+}
+
+func (s *SQLStore) UpdateSchedule(ctx context.Context, id primitive.ObjectID, cron string, next time.Time, segment string) error {
+	res, err := s.exec(ctx, s.db, "UPDATE schedules SET cron = ?, next_run = ?, current_run = NULL, segment = ? WHERE id = ? AND active",
+		cron, next.UTC(), segment, id.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("schedule %s not found", id.Hex())
+	}
+	return nil
+}
+
+func (s *SQLStore) CancelSchedule(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.exec(ctx, s.db, "UPDATE schedules SET active = FALSE WHERE id = ? AND active", id.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to cancel schedule: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("schedule %s not found", id.Hex())
+	}
+	return nil
+}
+
+const batchColumns = "id, file_name, batch_rows, status, created_by, created_at"
+
+// batchValues returns the values of the batchColumns of batch.
+func batchValues(batch *BalanceBatch) ([]any, error) {
+	rows, err := json.Marshal(batch.Rows)
+	if err != nil {
+		return nil, err
+	}
+	return []any{batch.ID.Hex(), batch.FileName, string(rows), batch.Status, batch.CreatedBy, batch.CreatedAt.UTC()}, nil
+}
+
+func scanBatch(row scanner) (*BalanceBatch, error) {
+	var (
+		batch    BalanceBatch
+		id, rows string
+	)
+	if err := row.Scan(&id, &batch.FileName, &rows, &batch.Status, &batch.CreatedBy, &batch.CreatedAt); err != nil {
+		return nil, err
+	}
+	batch.ID = objectIDFromHex(id)
+	if err := fromJSON(rows, &batch.Rows); err != nil {
+		return nil, fmt.Errorf("invalid rows: %w", err)
+	}
+	batch.CreatedAt = batch.CreatedAt.UTC()
+	return &batch, nil
+}
+
+func (s *SQLStore) getBatch(ctx context.Context, q querier, id string, lock string) (*BalanceBatch, error) {
+	return scanBatch(s.queryRow(ctx, q, "SELECT "+batchColumns+" FROM balance_batches WHERE id = ?"+lock, id))
+}
+
+func (s *SQLStore) AddBalanceBatch(ctx context.Context, batch BalanceBatch) (primitive.ObjectID, error) {
+	if batch.ID.IsZero() {
+		batch.ID = primitive.NewObjectID()
+	}
+	batch.Status = BatchPending
+	batch.CreatedAt = time.Now().UTC()
+
+	values, err := batchValues(&batch)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to save batch: %w", err)
+	}
+	_, err = s.exec(ctx, s.db, "INSERT INTO balance_batches ("+batchColumns+") VALUES ("+placeholders(6)+")", values...)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to save batch: %w", err)
+	}
+	return batch.ID, nil
+}
+
+func (s *SQLStore) GetBalanceBatch(ctx context.Context, id primitive.ObjectID) (*BalanceBatch, error) {
+	batch, err := s.getBatch(ctx, s.db, id.Hex(), "")
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve batch: %w", err)
+	}
+	return batch, nil
+}
+
+func (s *SQLStore) SetBalanceBatchStatus(ctx context.Context, id primitive.ObjectID, from []string, status string) (*BalanceBatch, error) {
+	var batch *BalanceBatch
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		batch, err = s.getBatch(ctx, tx, id.Hex(), s.forUpdate())
+		if err != nil {
+			return err
+		}
+		if !contains(from, batch.Status) {
+			return sql.ErrNoRows
+		}
+		_, err = s.exec(ctx, tx, "UPDATE balance_batches SET status = ? WHERE id = ?", status, id.Hex())
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrBatchChanged
+		}
+		return nil, fmt.Errorf("failed to update batch: %w", err)
+	}
+	return batch, nil
+}
+
+func (s *SQLStore) GetBalanceBatchesByStatus(ctx context.Context, statuses []string) ([]BalanceBatch, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(statuses))
+	for i, status := range statuses {
+		args[i] = status
+	}
+
+	rows, err := s.query(ctx, s.db, "SELECT "+batchColumns+" FROM balance_batches WHERE status IN ("+placeholders(len(statuses))+") ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve batches: %w", err)
+	}
+	defer rows.Close()
+
+	var batches []BalanceBatch
+	for rows.Next() {
+		batch, err := scanBatch(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode batch: %w", err)
+		}
+		batches = append(batches, *batch)
+	}
+	return batches, rows.Err()
+}
+
+const templateColumns = "id, message, language, body, updated_by, updated_at"
+
+func scanTemplate(row scanner) (*MessageTemplate, error) {
+	var tmpl MessageTemplate
+	if err := row.Scan(&tmpl.ID, &tmpl.Message, &tmpl.Language, &tmpl.Text, &tmpl.UpdatedBy, &tmpl.UpdatedAt); err != nil {
+		return nil, err
+	}
+	tmpl.UpdatedAt = tmpl.UpdatedAt.UTC()
+	return &tmpl, nil
+}
+
+func templateValues(tmpl *MessageTemplate) []any {
+	return []any{tmpl.ID, tmpl.Message, tmpl.Language, tmpl.Text, tmpl.UpdatedBy, tmpl.UpdatedAt.UTC()}
+}
+
+func (s *SQLStore) GetMessageTemplate(ctx context.Context, message, language string) (*MessageTemplate, error) {
+	id := messageTemplateID(message, language)
+	tmpl, err := scanTemplate(s.queryRow(ctx, s.db, "SELECT "+templateColumns+" FROM message_templates WHERE id = ?", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to retrieve template %s: %w", id, err)
+	}
+	return tmpl, nil
+}
+
+func (s *SQLStore) GetMessageTemplates(ctx context.Context) ([]MessageTemplate, error) {
+	rows, err := s.query(ctx, s.db, "SELECT "+templateColumns+" FROM message_templates ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve templates: %w", err)
+	}
+	defer rows.Close()
+
+	var templates []MessageTemplate
+	for rows.Next() {
+		tmpl, err := scanTemplate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode templates: %w", err)
+		}
+		templates = append(templates, *tmpl)
+	}
+	return templates, rows.Err()
+}
+
+func (s *SQLStore) SetMessageTemplate(ctx context.Context, tmpl MessageTemplate) error {
+	tmpl.ID = messageTemplateID(tmpl.Message, tmpl.Language)
+	if _, err := s.exec(ctx, s.db, upsert("message_templates", templateColumns, "id"), templateValues(&tmpl)...); err != nil {
+		return fmt.Errorf("failed to save template %s: %w", tmpl.ID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteMessageTemplate(ctx context.Context, message, language string) error {
+	id := messageTemplateID(message, language)
+	res, err := s.exec(ctx, s.db, "DELETE FROM message_templates WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete template %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) ExportRecords(ctx context.Context, collection string, fn func(record any) error) error {
+	var (
+		query string
+		scan  func(rows *sql.Rows) (any, error)
+	)
+	switch collection {
+	case "users":
+		query = "SELECT " + userColumns + " FROM users ORDER BY id"
+		scan = func(rows *sql.Rows) (any, error) { return scanUser(rows) }
+	case "referrals":
+		query = "SELECT referee, referrer, created_at FROM referrals ORDER BY referee"
+		scan = func(rows *sql.Rows) (any, error) {
+			var (
+				r         Referral
+				createdAt sql.NullTime
+			)
+			err := rows.Scan(&r.Referee, &r.Referrer, &createdAt)
+			r.CreatedAt = fromNullTime(createdAt)
+			return &r, err
+		}
+	case "ledger":
+		query = "SELECT " + ledgerColumns + " FROM ledger ORDER BY id"
+		scan = func(rows *sql.Rows) (any, error) { return scanLedgerEntry(rows) }
+	case "withdrawals":
+		query = "SELECT " + withdrawalColumns + " FROM withdrawals ORDER BY id"
+		scan = func(rows *sql.Rows) (any, error) { return scanWithdrawal(rows) }
+	case "broadcasts":
+		query = "SELECT " + broadcastColumns + " FROM broadcasts ORDER BY id"
+		scan = func(rows *sql.Rows) (any, error) { return scanBroadcast(rows) }
+	case "broadcast_failures":
+		query = "SELECT broadcast_id, user_id, kind, description, at FROM broadcast_failures ORDER BY broadcast_id, user_id"
+		scan = func(rows *sql.Rows) (any, error) {
+			var (
+				f  BroadcastFailure
+				id string
+			)
+			err := rows.Scan(&id, &f.UserID, &f.Kind, &f.Description, &f.At)
+			f.BroadcastID = objectIDFromHex(id)
+			f.At = f.At.UTC()
+			return &f, err
+		}
+	case "broadcast_deliveries":
+		query = "SELECT broadcast_id, user_id, message_id FROM broadcast_deliveries ORDER BY broadcast_id, user_id"
+		scan = func(rows *sql.Rows) (any, error) {
+			var (
+				d  BroadcastDelivery
+				id string
+			)
+			err := rows.Scan(&id, &d.UserID, &d.MessageID)
+			d.BroadcastID = objectIDFromHex(id)
+			return &d, err
+		}
+	case "schedules":
+		query = "SELECT " + scheduleColumns + " FROM schedules ORDER BY id"
+		scan = func(rows *sql.Rows) (any, error) { return scanSchedule(rows) }
+	case "balance_batches":
+		query = "SELECT " + batchColumns + " FROM balance_batches ORDER BY id"
+		scan = func(rows *sql.Rows) (any, error) { return scanBatch(rows) }
+	case "message_templates":
+		query = "SELECT " + templateColumns + " FROM message_templates ORDER BY id"
+		scan = func(rows *sql.Rows) (any, error) { return scanTemplate(rows) }
+	default:
+		return fmt.Errorf("unknown collection %q", collection)
+	}
+
+	rows, err := s.query(ctx, s.db, query)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %s: %w", collection, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, err := scan(rows)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", collection, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// upsert returns an INSERT of columns into table that updates the row whose
+// key columns conflict instead.
+func upsert(table, columns, key string) string {
+	cols := strings.Split(columns, ", ")
+	keys := strings.Split(key, ", ")
+	var set []string
+	for _, c := range cols {
+		if !contains(keys, c) {
+			set = append(set, c+" = excluded."+c)
+		}
+	}
+	return "INSERT INTO " + table + " (" + columns + ") VALUES (" + placeholders(len(cols)) + ") ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+func (s *SQLStore) ImportRecords(ctx context.Context, next func() (string, any, error)) error {
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		// Users may be imported before the users who referred them, so check
+		// foreign keys when the transaction commits.
+		deferKeys := "PRAGMA defer_foreign_keys = ON"
+		if s.dialect == DialectPostgres {
+			deferKeys = "SET CONSTRAINTS ALL DEFERRED"
+		}
+		if _, err := tx.ExecContext(ctx, deferKeys); err != nil {
+			return err
+		}
+
+		for {
+			collection, record, err := next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := s.importRecord(ctx, tx, record); err != nil {
+				return fmt.Errorf("failed to import %s: %w", collection, err)
+			}
+		}
+	})
+}
+
+func (s *SQLStore) importRecord(ctx context.Context, tx *sql.Tx, record any) error {
+	var (
+		query  string
+		values []any
+		err    error
+	)
+	switch r := record.(type) {
+	case *User:
+		query, values = upsert("users", userColumns, "id"), userValues(*r)
+	case *Referral:
+		query, values = upsert("referrals", "referee, referrer, created_at", "referee"), []any{r.Referee, r.Referrer, nullTime(r.CreatedAt)}
+	case *LedgerEntry:
+		query, values = upsert("ledger", ledgerColumns, "id"), ledgerValues(r)
+	case *Withdrawal:
+		query = upsert("withdrawals", withdrawalColumns, "id")
+		values = []any{r.ID.Hex(), r.UserID, r.Amount, r.AccNo, r.Status, r.RequestedAt.UTC(), nullTime(r.ApprovedAt)}
+	case *Broadcast:
+		query = upsert("broadcasts", broadcastColumns, "id")
+		values, err = broadcastValues(r)
+	case *BroadcastFailure:
+		// Failures and deliveries have no key of their own; a user has at most
+		// one of each per broadcast.
+		if _, err := s.exec(ctx, tx, "DELETE FROM broadcast_failures WHERE broadcast_id = ? AND user_id = ?", r.BroadcastID.Hex(), r.UserID); err != nil {
+			return err
+		}
+		query = "INSERT INTO broadcast_failures (broadcast_id, user_id, kind, description, at) VALUES (?, ?, ?, ?, ?)"
+		values = []any{r.BroadcastID.Hex(), r.UserID, r.Kind, r.Description, r.At.UTC()}
+	case *BroadcastDelivery:
+		if _, err := s.exec(ctx, tx, "DELETE FROM broadcast_deliveries WHERE broadcast_id = ? AND user_id = ?", r.BroadcastID.Hex(), r.UserID); err != nil {
+			return err
+		}
+		query = "INSERT INTO broadcast_deliveries (broadcast_id, user_id, message_id) VALUES (?, ?, ?)"
+		values = []any{r.BroadcastID.Hex(), r.UserID, r.MessageID}
+	case *Schedule:
+		query = upsert("schedules", scheduleColumns, "id")
+		values, err = scheduleValues(r)
+	case *BalanceBatch:
+		query = upsert("balance_batches", batchColumns, "id")
+		values, err = batchValues(r)
+	case *MessageTemplate:
+		query, values = upsert("message_templates", templateColumns, "id"), templateValues(r)
+	default:
+		return fmt.Errorf("unknown record type %T", record)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(ctx, tx, query, values...)
+	return err
+}
+
+const conversationColumns = "key, state, updated_at, expires_at, prompt_chat_id, prompt_message_id"
+
+func scanConversation(row scanner) (*Conversation, error) {
+	var (
+		conv      Conversation
+		state     string
+		expiresAt sql.NullTime
+	)
+	if err := row.Scan(&conv.Key, &state, &conv.UpdatedAt, &expiresAt, &conv.PromptChatID, &conv.PromptMessageID); err != nil {
+		return nil, err
+	}
+	if err := fromJSON(state, &conv.State); err != nil {
+		return nil, fmt.Errorf("invalid state: %w", err)
+	}
+	conv.UpdatedAt = conv.UpdatedAt.UTC()
+	conv.ExpiresAt = fromNullTime(expiresAt)
+	return &conv, nil
+}
+
+func (s *SQLStore) GetConversation(ctx context.Context, key string) (*Conversation, error) {
+	conv, err := scanConversation(s.queryRow(ctx, s.db, "SELECT "+conversationColumns+" FROM conversations WHERE key = ?", key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to load conversation %s: %w", key, err)
+	}
+	return conv, nil
+}
+
+func (s *SQLStore) SaveConversation(ctx context.Context, conv Conversation) error {
+	state, err := toJSON(conv.State)
+	if err != nil {
+		return fmt.Errorf("failed to save conversation %s: %w", conv.Key, err)
+	}
+
+	// A state change without a new prompt keeps the prompt of the flow.
+	_, err = s.exec(ctx, s.db, `INSERT INTO conversations (`+conversationColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET
+    state = excluded.state,
+    updated_at = excluded.updated_at,
+    expires_at = excluded.expires_at,
+    prompt_chat_id = CASE WHEN excluded.prompt_message_id = 0 THEN conversations.prompt_chat_id ELSE excluded.prompt_chat_id END,
+    prompt_message_id = CASE WHEN excluded.prompt_message_id = 0 THEN conversations.prompt_message_id ELSE excluded.prompt_message_id END`,
+		conv.Key, state, conv.UpdatedAt.UTC(), nullTime(conv.ExpiresAt), conv.PromptChatID, conv.PromptMessageID)
+	if err != nil {
+		return fmt.Errorf("failed to save conversation %s: %w", conv.Key, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteConversation(ctx context.Context, key string) error {
+	if _, err := s.exec(ctx, s.db, "DELETE FROM conversations WHERE key = ?", key); err != nil {
+		return fmt.Errorf("failed to end conversation %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) TakeExpiredConversation(ctx context.Context, now time.Time) (*Conversation, error) {
+	var conv *Conversation
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		conv, err = scanConversation(s.queryRow(ctx, tx, "SELECT "+conversationColumns+" FROM conversations WHERE expires_at <= ? ORDER BY expires_at LIMIT 1"+s.skipLocked(), now.UTC()))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				conv = nil
+				return nil
+			}
+			return err
+		}
+		_, err = s.exec(ctx, tx, "DELETE FROM conversations WHERE key = ?", conv.Key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire conversations: %w", err)
+	}
+	return conv, nil
+}
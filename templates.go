@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// maxMessageLength is the longest text Telegram accepts in one message.
+const maxMessageLength = 4096
+
+// editableTemplate is a catalog message the owner may reword in chat.
+type editableTemplate struct {
+	Message string
+	// Description is the message ID of what the message is for.
+	Description string
+	// Sample holds name, value pairs standing in for the real arguments in
+	// previews. Every argument the message gets must be listed.
+	Sample []any
+}
+
+// editableTemplates are the messages /template can change. Edits are Go
+// text/template text in Telegram HTML, stored per language; a language
+// without an edit keeps using its catalog.
+var editableTemplates = []editableTemplate{
+	{Message: "start.welcome", Description: "templates.about.welcome", Sample: []any{"name", "Alice", "balance", 0.0, "referrals", 0}},
+	{Message: "start.welcome_back", Description: "templates.about.welcome_back", Sample: []any{"name", "Alice", "balance", 1250.5, "referrals", 3}},
+	{Message: "start.referral_success", Description: "templates.about.referral_success", Sample: []any{"name", "Alice", "id", "123456789", "reward", 10.0}},
+	{Message: "withdraw.prompt", Description: "templates.about.withdraw_prompt"},
+	{Message: "withdraw.submitted", Description: "templates.about.withdraw_submitted"},
+	{Message: "withdraw.approved", Description: "templates.about.withdraw_approved", Sample: []any{"amount", 50.0}},
+}
+
+// templateUsage renders a problem with a template command followed by the usage.
+func templateUsage(l *Locale, problem string) string {
+	return l.T("templates.invalid", "error", problem, "usage", HTML(l.T("templates.usage")))
+}
+
+func findEditableTemplate(message string) (*editableTemplate, bool) {
+	for i := range editableTemplates {
+		if editableTemplates[i].Message == message {
+			return &editableTemplates[i], true
+		}
+	}
+	return nil, false
+}
+
+// sampleFields lists the arguments of a template as {{.name}} placeholders.
+func (t *editableTemplate) sampleFields(l *Locale) string {
+	var fields []string
+	for i := 0; i < len(t.Sample); i += 2 {
+		fields = append(fields, fmt.Sprintf("<code>{{.%s}}</code>", t.Sample[i]))
+	}
+	if len(fields) == 0 {
+		return l.T("templates.no_placeholders")
+	}
+	return strings.Join(fields, ", ")
+}
+
+// checkTemplate parses text as an edit of message and renders it with the
+// sample arguments, so syntax errors and unknown arguments are caught before
+// the edit is used. Problems are described in l.
+func checkTemplate(l *Locale, message, text string) error {
+	t, ok := findEditableTemplate(message)
+	if !ok {
+		return errors.New(l.T("templates.not_editable", "message", message))
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.New(l.T("templates.empty"))
+	}
+
+	rendered, err := localeFor().Render(message, text, t.Sample...)
+	if err != nil {
+		return err
+	}
+	if n := utf8.RuneCountInString(rendered); n > maxMessageLength {
+		return errors.New(l.T("templates.too_long", "length", n, "max", maxMessageLength))
+	}
+	return nil
+}
+
+// message renders an editable message for l, using the owner's edit for the
+// language when there is one. Like T, it escapes args and returns HTML. A
+// broken edit falls back to the catalog.
+func (a *App) message(c context.Context, l *Locale, message string, args ...any) string {
+	tmpl, err := a.store.GetMessageTemplate(c, message, l.Tag)
+	switch {
+	case err == nil:
+		text, err := l.Render(message, tmpl.Text, args...)
+		if err == nil {
+			return text
+		}
+		log.Printf("Failed to render template %s: %v", tmpl.ID, err)
+	case !errors.Is(err, ErrNotFound):
+		log.Printf("Failed to load template %s: %v", messageTemplateID(message, l.Tag), err)
+	}
+	return l.T(message, args...)
+}
+
+// templateArgs reads "<message> [language]" from the arguments of a
+// template command. The language defaults to the default language. Errors
+// are HTML in l.
+func templateArgs(l *Locale, args []string) (*editableTemplate, string, error) {
+	if len(args) == 0 {
+		return nil, "", errors.New(l.T("templates.name_message"))
+	}
+
+	t, ok := findEditableTemplate(args[0])
+	if !ok {
+		return nil, "", errors.New(l.T("templates.unknown_message", "message", args[0]))
+	}
+
+	language := defaultLanguage
+	if len(args) > 1 {
+		language = strings.ToLower(args[1])
+		if _, ok := locales[language]; !ok {
+			return nil, "", errors.New(l.T("templates.unknown_language", "language", language, "languages", strings.Join(languageTags(), ", ")))
+		}
+	}
+	return t, language, nil
+}
+
+// templates lists the editable messages and the languages they are edited in.
+func (a *App) templates(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	l := tr(ctx)
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, l.T("error.unauthorized"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	edited, err := a.store.GetMessageTemplates(requestContext(ctx))
+	if err != nil {
+		_, _ = msg.Reply(b, l.T("templates.load_failed", "error", CustomError(err).Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+	languages := map[string][]string{}
+	for _, tmpl := range edited {
+		languages[tmpl.Message] = append(languages[tmpl.Message], tmpl.Language)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(l.T("templates.title"))
+	for _, t := range editableTemplates {
+		sb.WriteString(l.T("templates.entry", "message", t.Message, "description", HTML(l.T(t.Description)),
+			"languages", strings.Join(languages[t.Message], ", ")))
+	}
+	sb.WriteString(l.T("templates.legend", "usage", HTML(l.T("templates.usage"))))
+
+	_, _ = msg.Reply(b, sb.String(), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	return nil
+}
+
+// template shows the text of a message in one language, with buttons to
+// preview it and to reset an edit.
+func (a *App) template(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	l := tr(ctx)
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, l.T("error.unauthorized"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	t, language, err := templateArgs(l, ctx.Args()[1:])
+	if err != nil {
+		_, _ = msg.Reply(b, templateUsage(l, err.Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	text, markup, err := a.templateView(requestContext(ctx), l, t, language)
+	if err != nil {
+		_, _ = msg.Reply(b, l.T("templates.load_failed", "error", CustomError(err).Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{ParseMode: "HTML", ReplyMarkup: markup})
+	return nil
+}
+
+// templateView renders the /template card of a message in language for an
+// owner reading l.
+func (a *App) templateView(c context.Context, l *Locale, t *editableTemplate, language string) (string, gotgbot.InlineKeyboardMarkup, error) {
+	id := messageTemplateID(t.Message, language)
+	buttons := []gotgbot.InlineKeyboardButton{{Text: l.T("templates.preview"), CallbackData: "tmpl.preview." + id}}
+
+	source, status := locales[language].Source(t.Message), l.T("templates.default_text")
+	tmpl, err := a.store.GetMessageTemplate(c, t.Message, language)
+	switch {
+	case err == nil:
+		source = tmpl.Text
+		status = l.T("templates.edited_by", "user", fmt.Sprint(tmpl.UpdatedBy), "date", tmpl.UpdatedAt.Format("2006-01-02 15:04 MST"))
+		buttons = append(buttons, gotgbot.InlineKeyboardButton{Text: l.T("templates.reset"), CallbackData: "tmpl.reset." + id})
+	case !errors.Is(err, ErrNotFound):
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+
+	text := l.T("templates.view", "description", HTML(l.T(t.Description)), "message", t.Message, "language", language,
+		"status", HTML(status), "placeholders", HTML(t.sampleFields(l)), "source", source)
+	return text, gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{buttons}}, nil
+}
+
+// setTemplate previews the replied-to text as the new version of a message.
+// The preview carries the buttons that save it, so Telegram has accepted the
+// markup before anything is stored.
+func (a *App) setTemplate(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	l := tr(ctx)
+	if msg.From.Id != OwnerID {
+		_, _ = msg.Reply(b, l.T("error.unauthorized"), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	t, language, err := templateArgs(l, ctx.Args()[1:])
+	if err != nil {
+		_, _ = msg.Reply(b, templateUsage(l, err.Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	draft := msg.ReplyToMessage
+	if draft == nil || draft.Text == "" {
+		_, _ = msg.Reply(b, templateUsage(l, l.T("templates.reply_to_draft")), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	if err := checkTemplate(l, t.Message, draft.Text); err != nil {
+		_, _ = msg.Reply(b, l.T("templates.draft_error", "error", err.Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	preview, _ := locales[language].Render(t.Message, draft.Text, t.Sample...)
+	id := messageTemplateID(t.Message, language)
+	_, err = draft.Reply(b, preview, &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+			{Text: l.T("templates.save"), CallbackData: "tmpl.save." + id},
+			{Text: l.T("templates.discard"), CallbackData: "tmpl.discard." + id},
+		}}},
+		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{IsDisabled: true},
+	})
+	if err != nil {
+		_, _ = msg.Reply(b, l.T("templates.rejected", "error", err.Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	}
+	return nil
+}
+
+// templateCallback handles the buttons of template views and previews, with
+// data "tmpl.<action>.<language>:<message>".
+func (a *App) templateCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	query := ctx.CallbackQuery
+	l := tr(ctx)
+	if ctx.EffectiveUser.Id != OwnerID {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      l.T("error.unauthorized_action"),
+			ShowAlert: true,
+		})
+		return nil
+	}
+
+	splitData := strings.SplitN(query.Data, ".", 3)
+	if len(splitData) < 3 {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: l.T("error.invalid_callback"), ShowAlert: true})
+		return nil
+	}
+	language, message, _ := strings.Cut(splitData[2], ":")
+	t, ok := findEditableTemplate(message)
+	if _, known := locales[language]; !ok || !known {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: l.T("error.invalid_callback"), ShowAlert: true})
+		return nil
+	}
+
+	prompt := ctx.EffectiveMessage
+	switch splitData[1] {
+	case "preview":
+		_, _ = query.Answer(b, nil)
+		preview := a.message(requestContext(ctx), locales[language], t.Message, t.Sample...)
+		_, err := b.SendMessage(prompt.Chat.Id, preview, &gotgbot.SendMessageOpts{
+			ParseMode:          "HTML",
+			LinkPreviewOptions: &gotgbot.LinkPreviewOptions{IsDisabled: true},
+		})
+		if err != nil {
+			_, _ = prompt.Reply(b, l.T("templates.preview_failed", "error", err.Error()), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		}
+	case "save":
+		draft := prompt.ReplyToMessage
+		if draft == nil || draft.Text == "" {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: l.T("templates.draft_gone"), ShowAlert: true})
+			return nil
+		}
+		// The draft may have been edited since the preview.
+		if err := checkTemplate(l, t.Message, draft.Text); err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + err.Error(), ShowAlert: true})
+			return nil
+		}
+
+		err := a.store.SetMessageTemplate(requestContext(ctx), MessageTemplate{
+			Message:   t.Message,
+			Language:  language,
+			Text:      draft.Text,
+			UpdatedBy: ctx.EffectiveUser.Id,
+			UpdatedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + CustomError(err).Error(), ShowAlert: true})
+			return nil
+		}
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: l.T("templates.saved_alert")})
+		_, _, _ = prompt.EditReplyMarkup(b, nil)
+		_, _ = prompt.Reply(b, l.T("templates.saved", "message", t.Message, "language", language), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	case "discard":
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: l.T("templates.discarded")})
+		_, _ = prompt.Delete(b, nil)
+	case "reset":
+		err := a.store.DeleteMessageTemplate(requestContext(ctx), t.Message, language)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ " + CustomError(err).Error(), ShowAlert: true})
+			return nil
+		}
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: l.T("templates.reset_done")})
+
+		text, markup, err := a.templateView(requestContext(ctx), l, t, language)
+		if err == nil {
+			_, _, _ = prompt.EditText(b, text, &gotgbot.EditMessageTextOpts{ParseMode: "HTML", ReplyMarkup: markup})
+		}
+	default:
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: l.T("error.invalid_callback"), ShowAlert: true})
+	}
+	return nil
+}
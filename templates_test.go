@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMessageEscapesArgumentsInEditedTemplate(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	err := store.SetMessageTemplate(ctx, MessageTemplate{
+		ID:        messageTemplateID("start.welcome", "en"),
+		Message:   "start.welcome",
+		Language:  "en",
+		Text:      "<b>Hi {{.name}}</b>, you have {{.balance}}",
+		UpdatedBy: 1,
+		UpdatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{store: store, base: ctx}
+
+	for _, tc := range hostileNames {
+		t.Run(tc.name, func(t *testing.T) {
+			got := a.message(ctx, locales["en"], "start.welcome", "name", tc.name, "balance", 1250.5, "referrals", 0)
+			if want := "<b>Hi " + tc.escaped + "</b>, you have 1,250.50"; got != want {
+				t.Errorf("message() = %q, want %q", got, want)
+			}
+		})
+	}
+}
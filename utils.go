@@ -2,8 +2,13 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
 )
@@ -39,3 +44,44 @@ func onlyInt64(msg *gotgbot.Message) bool {
 		return false
 	}
 }
+
+// newUser builds a User document from the Telegram profile of the sender.
+func newUser(u *gotgbot.User) User {
+	return User{
+		ID:           u.Id,
+		FirstName:    u.FirstName,
+		Username:     u.Username,
+		LanguageCode: u.LanguageCode,
+		IsPremium:    u.IsPremium,
+	}
+}
+
+// mention renders a user as an HTML link with their name and username,
+// falling back to the numeric ID for users stored before profiles existed.
+func mention(u *User) HTML {
+	name := html.EscapeString(u.FirstName)
+	if name == "" {
+		name = fmt.Sprint(u.ID)
+	}
+
+	text := fmt.Sprintf(`<a href="tg://user?id=%d">%s</a>`, u.ID, name)
+	if u.Username != "" {
+		text += " (@" + html.EscapeString(u.Username) + ")"
+	}
+	return HTML(text)
+}
+
+// durationEnv reads a Go duration such as "10m" from the environment.
+// An unset variable yields def and "0" disables the timeout.
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s is not a valid duration: %v", name, err)
+	}
+	return d
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestMentionEscapesNames(t *testing.T) {
+	for _, tc := range hostileNames {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mention(&User{ID: 42, FirstName: tc.name, Username: tc.name})
+			want := HTML(`<a href="tg://user?id=42">` + tc.escaped + `</a> (@` + tc.escaped + `)`)
+			if got != want {
+				t.Errorf("mention() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMentionFallsBackToID(t *testing.T) {
+	if got, want := mention(&User{ID: 42}), HTML(`<a href="tg://user?id=42">42</a>`); got != want {
+		t.Errorf("mention() = %q, want %q", got, want)
+	}
+}